@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jaksi/sshutils"
+)
+
+type adminConfig struct {
+	Address         string `yaml:"address"`
+	Token           string `yaml:"token"`
+	TranscriptLines int    `yaml:"transcript_lines"`
+	ASNFile         string `yaml:"asn_file"`
+}
+
+// liveConnection is an active connection, as seen by the admin API.
+type liveConnection struct {
+	conn          *sshutils.Conn
+	id            string
+	user          string
+	clientVersion string
+	start         time.Time
+	// transcriptLines caps the transcript kept for the connection.
+	transcriptLines int
+
+	mutex      sync.Mutex
+	channels   map[int]string
+	terminals  map[int]liveTerminal
+	command    string
+	transcript []string
+}
+
+var (
+	liveConnections      = map[string]*liveConnection{}
+	liveConnectionsMutex sync.Mutex
+)
+
+// registerLiveConnection makes a connection available to the admin API until it's unregistered.
+func registerLiveConnection(conn *sshutils.Conn, id string, transcriptLines int) *liveConnection {
+	connection := &liveConnection{
+		conn:            conn,
+		id:              id,
+		user:            conn.User(),
+		clientVersion:   string(conn.ClientVersion()),
+		start:           time.Now(),
+		transcriptLines: transcriptLines,
+		channels:        map[int]string{},
+		terminals:       map[int]liveTerminal{},
+	}
+	liveConnectionsMutex.Lock()
+	liveConnections[id] = connection
+	liveConnectionsMutex.Unlock()
+	return connection
+}
+
+// unregister, addChannel and removeChannel do nothing for connections that aren't registered, as the admin API is disabled.
+func (connection *liveConnection) unregister() {
+	if connection == nil {
+		return
+	}
+	liveConnectionsMutex.Lock()
+	defer liveConnectionsMutex.Unlock()
+	if liveConnections[connection.id] == connection {
+		delete(liveConnections, connection.id)
+	}
+}
+
+// getLiveConnection returns an active connection by ID, if there's one.
+func getLiveConnection(id string) *liveConnection {
+	liveConnectionsMutex.Lock()
+	defer liveConnectionsMutex.Unlock()
+	return liveConnections[id]
+}
+
+func (connection *liveConnection) addChannel(channelID int, channelType string) {
+	if connection == nil {
+		return
+	}
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	connection.channels[channelID] = channelType
+}
+
+func (connection *liveConnection) removeChannel(channelID int) {
+	if connection == nil {
+		return
+	}
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	delete(connection.channels, channelID)
+}
+
+// add updates the connection with a logged event.
+func (connection *liveConnection) add(record logRecord) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	switch entry := record.entry.(type) {
+	case execLog:
+		connection.command = entry.Command
+	case sessionInputLog:
+		connection.command = decodedText(entry.Input, entry.Encoding)
+	}
+	if len(connection.transcript) < connection.transcriptLines {
+		connection.transcript = append(connection.transcript, string(record.plain(true)))
+	}
+}
+
+type liveChannelInfo struct {
+	ChannelID string `json:"channel_id"`
+	Type      string `json:"type"`
+}
+
+type liveConnectionInfo struct {
+	ConnectionID   string            `json:"connection_id"`
+	Source         string            `json:"source"`
+	User           string            `json:"user"`
+	ClientVersion  string            `json:"client_version"`
+	Start          time.Time         `json:"start"`
+	Duration       float64           `json:"duration"`
+	Channels       []liveChannelInfo `json:"channels"`
+	CurrentCommand string            `json:"current_command"`
+}
+
+func (connection *liveConnection) info() liveConnectionInfo {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	info := liveConnectionInfo{
+		ConnectionID:   connection.id,
+		Source:         connection.conn.RemoteAddr().String(),
+		User:           connection.user,
+		ClientVersion:  connection.clientVersion,
+		Start:          connection.start.UTC(),
+		Duration:       time.Since(connection.start).Seconds(),
+		Channels:       []liveChannelInfo{},
+		CurrentCommand: connection.command,
+	}
+	channelIDs := make([]int, 0, len(connection.channels))
+	for channelID := range connection.channels {
+		channelIDs = append(channelIDs, channelID)
+	}
+	sort.Ints(channelIDs)
+	for _, channelID := range channelIDs {
+		info.Channels = append(info.Channels, liveChannelInfo{uniqueChannelID(connection.id, channelID), connection.channels[channelID]})
+	}
+	return info
+}
+
+// disconnect forcibly closes the connection.
+func (connection *liveConnection) disconnect() error {
+	if summary := getConnectionSummary(connection.conn.RemoteAddr()); summary != nil {
+		summary.setDisconnectReason("disconnected by admin")
+	}
+	return connection.conn.Close()
+}
+
+func writeAdminJSON(writer http.ResponseWriter, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(value); err != nil {
+		warningLogger.Printf("Failed to write admin API response: %v", err)
+	}
+}
+
+// adminAuth only lets requests with the bearer token of the config in effect through.
+func adminAuth(configs *configReloader, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		cfg := configs.config()
+		token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if !ok || cfg.Admin.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Admin.Token)) != 1 {
+			writer.Header().Set("WWW-Authenticate", `Bearer realm="sshesame"`)
+			http.Error(writer, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// adminConnection serves a request about a single live connection, if it's still active.
+func adminConnection(handle func(writer http.ResponseWriter, request *http.Request, connection *liveConnection)) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		connection := getLiveConnection(request.PathValue("id"))
+		if connection == nil {
+			http.Error(writer, "connection not found", http.StatusNotFound)
+			return
+		}
+		handle(writer, request, connection)
+	}
+}
+
+// newAdminHandler serves the admin API and the dashboard, using the config in effect for each request.
+func newAdminHandler(configs *configReloader) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/connections", func(writer http.ResponseWriter, request *http.Request) {
+		liveConnectionsMutex.Lock()
+		connections := make([]*liveConnection, 0, len(liveConnections))
+		for _, connection := range liveConnections {
+			connections = append(connections, connection)
+		}
+		liveConnectionsMutex.Unlock()
+		infos := make([]liveConnectionInfo, len(connections))
+		for i, connection := range connections {
+			infos[i] = connection.info()
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Start.Before(infos[j].Start) })
+		writeAdminJSON(writer, infos)
+	})
+	mux.HandleFunc("GET /api/connections/{id}", adminConnection(func(writer http.ResponseWriter, request *http.Request, connection *liveConnection) {
+		writeAdminJSON(writer, connection.info())
+	}))
+	mux.HandleFunc("GET /api/connections/{id}/transcript", adminConnection(func(writer http.ResponseWriter, request *http.Request, connection *liveConnection) {
+		connection.mutex.Lock()
+		transcript := append([]string{}, connection.transcript...)
+		connection.mutex.Unlock()
+		if request.URL.Query().Get("format") == "json" {
+			writeAdminJSON(writer, transcript)
+			return
+		}
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, line := range transcript {
+			writer.Write([]byte(line + "\n"))
+		}
+	}))
+	mux.HandleFunc("GET /api/connections/{id}/watch", adminConnection(serveSpectator))
+	mux.HandleFunc("POST /api/connections/{id}/takeover", adminConnection(serveTakeover(true)))
+	mux.HandleFunc("DELETE /api/connections/{id}/takeover", adminConnection(serveTakeover(false)))
+	mux.HandleFunc("POST /api/connections/{id}/output", adminConnection(serveOperatorOutput))
+	mux.HandleFunc("DELETE /api/connections/{id}", adminConnection(func(writer http.ResponseWriter, request *http.Request, connection *liveConnection) {
+		if err := connection.disconnect(); err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("POST /api/logs/reopen", func(writer http.ResponseWriter, request *http.Request) {
+		infoLogger.Printf("Reopening log files due to an admin API request")
+		configs.reopenLogs()
+		writer.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /api/dashboard", func(writer http.ResponseWriter, request *http.Request) {
+		cfg := configs.config()
+		if cfg.dashboard == nil {
+			http.Error(writer, "dashboard disabled", http.StatusNotFound)
+			return
+		}
+		writeAdminJSON(writer, cfg.dashboard.summary())
+	})
+	mux.HandleFunc("GET /api/sessions/{id}/transcript", func(writer http.ResponseWriter, request *http.Request) {
+		cfg := configs.config()
+		var transcript []string
+		ok := false
+		if cfg.dashboard != nil {
+			transcript, ok = cfg.dashboard.transcript(request.PathValue("id"))
+		}
+		if !ok {
+			http.Error(writer, "session not found", http.StatusNotFound)
+			return
+		}
+		writeAdminJSON(writer, transcript)
+	})
+	handler := http.NewServeMux()
+	handler.Handle("/api/", adminAuth(configs, mux))
+	handler.Handle("/", dashboardHandler())
+	return handler
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaksi/sshutils"
+	"golang.org/x/crypto/ssh"
+)
+
+func adminRequest(t *testing.T, method string, url string, token string) *http.Response {
+	t.Helper()
+	request, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func getLiveConnectionInfos(t *testing.T, url string) []liveConnectionInfo {
+	t.Helper()
+	response := adminRequest(t, "GET", url+"/api/connections", "secret")
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status=%v, want 200", response.StatusCode)
+	}
+	infos := []liveConnectionInfo{}
+	if err := json.NewDecoder(response.Body).Decode(&infos); err != nil {
+		t.Fatal(err)
+	}
+	return infos
+}
+
+func TestAdminAPI(t *testing.T) {
+	keyFile, err := generateKey(t.TempDir(), ecdsa_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config{}
+	cfg.Server.HostKeys = []string{keyFile}
+	cfg.Auth.PasswordAuth.Enabled = true
+	cfg.Auth.PasswordAuth.Accepted = true
+	cfg.Admin.Address = "127.0.0.1:0"
+	cfg.Admin.Token = "secret"
+	cfg.Admin.TranscriptLines = 10000
+	if err := cfg.setupSSHConfig(); err != nil {
+		t.Fatal(err)
+	}
+	setupLogBuffer(t, cfg)
+	server := httptest.NewServer(newAdminHandler(staticConfigs(cfg)))
+	defer server.Close()
+
+	listener, err := sshutils.Listen("127.0.0.1:0", cfg.sshConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	listener.Listener = trackingListener{listener.Listener}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		handleConnection(conn, cfg)
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "root",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		ClientVersion:   "SSH-2.0-admintest",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stdin.Write([]byte("uname -a\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if response := adminRequest(t, "GET", server.URL+"/api/connections", "wrong"); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status=%v, want 401 with a wrong token", response.StatusCode)
+	}
+	var info liveConnectionInfo
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		infos := getLiveConnectionInfos(t, server.URL)
+		if len(infos) == 1 && infos[0].CurrentCommand == "uname -a" {
+			info = infos[0]
+			break
+		}
+	}
+	if info.ConnectionID == "" {
+		t.Fatalf("connections=%v, want the connection running uname", getLiveConnectionInfos(t, server.URL))
+	}
+	if info.User != "root" || info.ClientVersion != "SSH-2.0-admintest" || len(info.Channels) != 1 || info.Channels[0] != (liveChannelInfo{info.ConnectionID + "-0", "session"}) {
+		t.Errorf("info=%+v, want the root session", info)
+	}
+
+	response := adminRequest(t, "GET", server.URL+"/api/connections/"+info.ConnectionID+"/transcript", "secret")
+	transcript, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if !strings.Contains(string(transcript), `输入："uname -a"`) {
+		t.Errorf("transcript=%v, want the input", string(transcript))
+	}
+	if response := adminRequest(t, "GET", server.URL+"/api/connections/unknown", "secret"); response.StatusCode != http.StatusNotFound {
+		t.Errorf("status=%v, want 404 for an unknown connection", response.StatusCode)
+	}
+
+	if response := adminRequest(t, "DELETE", server.URL+"/api/connections/"+info.ConnectionID, "secret"); response.StatusCode != http.StatusNoContent {
+		t.Errorf("status=%v, want 204", response.StatusCode)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection still open after disconnecting it")
+	}
+	if infos := getLiveConnectionInfos(t, server.URL); len(infos) != 0 {
+		t.Errorf("connections=%v, want none", infos)
+	}
+}
+
+func TestLiveConnectionTranscriptLines(t *testing.T) {
+	connection := &liveConnection{transcriptLines: 2}
+	for _, command := range []string{"id", "uname -a", "whoami"} {
+		connection.add(logRecord{time: time.Now(), remoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}, entry: execLog{Command: command}})
+	}
+	if len(connection.transcript) != 2 || !strings.Contains(connection.transcript[1], "uname -a") {
+		t.Errorf("transcript=%v, want the first 2 lines", connection.transcript)
+	}
+	if connection.command != "whoami" {
+		t.Errorf("command=%v, want the last command", connection.command)
+	}
+}
+
+func TestAdminReopenLogs(t *testing.T) {
+	logFile := path.Join(t.TempDir(), "sshesame.log")
+	file, err := openRotatingFile(logFile, logRotationConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	cfg := &config{}
+	cfg.Admin.Token = "secret"
+	cfg.logFileHandle = file
+	server := httptest.NewServer(newAdminHandler(staticConfigs(cfg)))
+	defer server.Close()
+
+	if err := os.Rename(logFile, logFile+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if response := adminRequest(t, "POST", server.URL+"/api/logs/reopen", "wrong"); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status=%v, want 401 with a wrong token", response.StatusCode)
+	}
+	if response := adminRequest(t, "POST", server.URL+"/api/logs/reopen", "secret"); response.StatusCode != http.StatusNoContent {
+		t.Errorf("status=%v, want 204", response.StatusCode)
+	}
+	if _, err := os.Stat(logFile); err != nil {
+		t.Errorf("log file not reopened: %v", err)
+	}
+}
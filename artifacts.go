@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// artifactStore keeps files captured from attackers (emails, uploads, ...) in the data directory.
+type artifactStore struct {
+	dir string
+}
+
+// save stores data captured on a connection, naming the file after the connection so it can be found from its events.
+func (store *artifactStore) save(kind string, connectionID string, extension string, data []byte) (string, error) {
+	dir := path.Join(store.dir, kind)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	fileName := fmt.Sprintf("%v-%v-%v%v", time.Now().UTC().Format("20060102T150405Z"), connectionID, hex.EncodeToString(hash[:8]), extension)
+	file := path.Join(dir, fileName)
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// create opens a new file to stream data captured on a connection or channel into, named after its ID.
+func (store *artifactStore) create(kind string, id string, extension string) (*os.File, error) {
+	dir := path.Join(store.dir, kind)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	fileName := fmt.Sprintf("%v-%v%v", time.Now().UTC().Format("20060102T150405Z"), id, extension)
+	return os.OpenFile(path.Join(dir, fileName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
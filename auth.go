@@ -23,9 +23,10 @@ func (cfg *config) getAuthLogCallback() func(conn ssh.ConnMetadata, method strin
 		} else {
 			acceptedLabel = "false"
 		}
-		authAttemptsMetric.WithLabelValues(method, acceptedLabel).Inc()
+		context := connContext{ConnMetadata: conn, cfg: cfg}
+		incWithExemplar(authAttemptsMetric.WithLabelValues(method, acceptedLabel), context.connectionID())
 		if method == "none" {
-			connContext{ConnMetadata: conn, cfg: cfg}.logEvent(noAuthLog{authLog: authLog{
+			context.logEvent(noAuthLog{authLog: authLog{
 				User:     conn.User(),
 				Accepted: err == nil,
 			}})
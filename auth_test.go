@@ -53,7 +53,7 @@ func TestNoAuthFail(t *testing.T) {
 	logBuffer := setupLogBuffer(t, cfg)
 	callback(mockConnContext{}, "none", errors.New(""))
 	logs := logBuffer.String()
-	expectedLogs := `[127.0.0.1:1234] authentication for user "root" without credentials rejected
+	expectedLogs := `[127.0.0.1:1234 736f6d6573657373] authentication for user "root" without credentials rejected
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -67,7 +67,7 @@ func TestNoAuthSuccess(t *testing.T) {
 	logBuffer := setupLogBuffer(t, cfg)
 	callback(mockConnContext{}, "none", nil)
 	logs := logBuffer.String()
-	expectedLogs := `[127.0.0.1:1234] authentication for user "root" without credentials accepted
+	expectedLogs := `[127.0.0.1:1234 736f6d6573657373] authentication for user "root" without credentials accepted
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -100,7 +100,7 @@ func TestPasswordFail(t *testing.T) {
 	if permissions != nil {
 		t.Errorf("permissions=%v, want nil", permissions)
 	}
-	expectedLogs := `[127.0.0.1:1234] authentication for user "root" with password "hunter2" rejected
+	expectedLogs := `[127.0.0.1:1234 736f6d6573657373] authentication for user "root" with password "hunter2" rejected
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -124,7 +124,7 @@ func TestPasswordSuccess(t *testing.T) {
 	if permissions != nil {
 		t.Errorf("permissions=%v, want nil", permissions)
 	}
-	expectedLogs := `[127.0.0.1:1234] authentication for user "root" with password "hunter2" accepted
+	expectedLogs := `[127.0.0.1:1234 736f6d6573657373] authentication for user "root" with password "hunter2" accepted
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -149,7 +149,7 @@ func TestPasswordFailJSON(t *testing.T) {
 	if permissions != nil {
 		t.Errorf("permissions=%v, want nil", permissions)
 	}
-	expectedLogs := `{"source":"127.0.0.1:1234","event_type":"password_auth","event":{"user":"root","accepted":false,"password":"hunter2"}}
+	expectedLogs := `{"source":"127.0.0.1:1234","connection_id":"736f6d6573657373","event_type":"password_auth","event":{"user":"root","accepted":false,"password":"hunter2"}}
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -174,7 +174,7 @@ func TestPasswordSuccessJSON(t *testing.T) {
 	if permissions != nil {
 		t.Errorf("permissions=%v, want nil", permissions)
 	}
-	expectedLogs := `{"source":"127.0.0.1:1234","event_type":"password_auth","event":{"user":"root","accepted":true,"password":"hunter2"}}
+	expectedLogs := `{"source":"127.0.0.1:1234","connection_id":"736f6d6573657373","event_type":"password_auth","event":{"user":"root","accepted":true,"password":"hunter2"}}
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -207,7 +207,7 @@ func TestPublicKeyFail(t *testing.T) {
 	if permissions != nil {
 		t.Errorf("permissions=%v, want nil", permissions)
 	}
-	expectedLogs := `[127.0.0.1:1234] authentication for user "root" with public key "SHA256:9faRaLujz6HiqA3/g5tI2zbfNvqHbBzZ19UI86swh0Q" rejected
+	expectedLogs := `[127.0.0.1:1234 736f6d6573657373] authentication for user "root" with public key "SHA256:9faRaLujz6HiqA3/g5tI2zbfNvqHbBzZ19UI86swh0Q" rejected
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -231,7 +231,7 @@ func TestPublicKeySuccess(t *testing.T) {
 	if permissions != nil {
 		t.Errorf("permissions=%v, want nil", permissions)
 	}
-	expectedLogs := `[127.0.0.1:1234] authentication for user "root" with public key "SHA256:9faRaLujz6HiqA3/g5tI2zbfNvqHbBzZ19UI86swh0Q" accepted
+	expectedLogs := `[127.0.0.1:1234 736f6d6573657373] authentication for user "root" with public key "SHA256:9faRaLujz6HiqA3/g5tI2zbfNvqHbBzZ19UI86swh0Q" accepted
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -256,7 +256,7 @@ func TestPublicKeyFailJSON(t *testing.T) {
 	if permissions != nil {
 		t.Errorf("permissions=%v, want nil", permissions)
 	}
-	expectedLogs := `{"source":"127.0.0.1:1234","event_type":"public_key_auth","event":{"user":"root","accepted":false,"public_key":"SHA256:9faRaLujz6HiqA3/g5tI2zbfNvqHbBzZ19UI86swh0Q"}}
+	expectedLogs := `{"source":"127.0.0.1:1234","connection_id":"736f6d6573657373","event_type":"public_key_auth","event":{"user":"root","accepted":false,"public_key":"SHA256:9faRaLujz6HiqA3/g5tI2zbfNvqHbBzZ19UI86swh0Q"}}
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -281,7 +281,7 @@ func TestPublicKeySuccessJSON(t *testing.T) {
 	if permissions != nil {
 		t.Errorf("permissions=%v, want nil", permissions)
 	}
-	expectedLogs := `{"source":"127.0.0.1:1234","event_type":"public_key_auth","event":{"user":"root","accepted":true,"public_key":"SHA256:9faRaLujz6HiqA3/g5tI2zbfNvqHbBzZ19UI86swh0Q"}}
+	expectedLogs := `{"source":"127.0.0.1:1234","connection_id":"736f6d6573657373","event_type":"public_key_auth","event":{"user":"root","accepted":true,"public_key":"SHA256:9faRaLujz6HiqA3/g5tI2zbfNvqHbBzZ19UI86swh0Q"}}
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -368,7 +368,7 @@ func TestKeyboardInteractiveFail(t *testing.T) {
 	if permissions != nil {
 		t.Errorf("permissions=%v, want nil", permissions)
 	}
-	expectedLogs := `[127.0.0.1:1234] authentication for user "root" with keyboard interactive answers ["a1" "a2"] rejected
+	expectedLogs := `[127.0.0.1:1234 736f6d6573657373] authentication for user "root" with keyboard interactive answers ["a1" "a2"] rejected
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -399,7 +399,7 @@ func TestKeyboardInteractiveSuccess(t *testing.T) {
 	if permissions != nil {
 		t.Errorf("permissions=%v, want nil", permissions)
 	}
-	expectedLogs := `[127.0.0.1:1234] authentication for user "root" with keyboard interactive answers ["a1" "a2"] accepted
+	expectedLogs := `[127.0.0.1:1234 736f6d6573657373] authentication for user "root" with keyboard interactive answers ["a1" "a2"] accepted
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -431,7 +431,7 @@ func TestKeyboardInteractiveFailJSON(t *testing.T) {
 	if permissions != nil {
 		t.Errorf("permissions=%v, want nil", permissions)
 	}
-	expectedLogs := `{"source":"127.0.0.1:1234","event_type":"keyboard_interactive_auth","event":{"user":"root","accepted":false,"answers":["a1","a2"]}}
+	expectedLogs := `{"source":"127.0.0.1:1234","connection_id":"736f6d6573657373","event_type":"keyboard_interactive_auth","event":{"user":"root","accepted":false,"answers":["a1","a2"]}}
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -463,7 +463,7 @@ func TestKeyboardInteractiveSuccessJSON(t *testing.T) {
 	if permissions != nil {
 		t.Errorf("permissions=%v, want nil", permissions)
 	}
-	expectedLogs := `{"source":"127.0.0.1:1234","event_type":"keyboard_interactive_auth","event":{"user":"root","accepted":true,"answers":["a1","a2"]}}
+	expectedLogs := `{"source":"127.0.0.1:1234","connection_id":"736f6d6573657373","event_type":"keyboard_interactive_auth","event":{"user":"root","accepted":true,"answers":["a1","a2"]}}
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/adrg/xdg"
+	"gopkg.in/yaml.v2"
+)
+
+// writeEffectiveConfig writes a config as YAML, with the defaults, default host keys and default algorithms filled in.
+func writeEffectiveConfig(writer io.Writer, cfg *config) error {
+	effective := *cfg
+	// Unset algorithms would be written as empty lists, which disable all of them
+	algorithms := cfg.sshConfig.Config
+	algorithms.SetDefaults()
+	effective.SSHProto.KeyExchanges, effective.SSHProto.Ciphers, effective.SSHProto.MACs = algorithms.KeyExchanges, algorithms.Ciphers, algorithms.MACs
+	configBytes, err := yaml.Marshal(effective)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(configBytes)
+	return err
+}
+
+// typeSchema returns the JSON Schema of values of a config type, as read from YAML.
+// Every setting can be null, which keeps its default value.
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		return map[string]interface{}{"type": []string{"string", "integer", "null"}, "description": "duration, e.g. 24h"}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		addStructProperties(t, properties)
+		return map[string]interface{}{"type": []string{"object", "null"}, "properties": properties, "additionalProperties": false}
+	case reflect.Slice:
+		return map[string]interface{}{"type": []string{"array", "null"}, "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		schema := map[string]interface{}{"type": []string{"object", "null"}, "additionalProperties": typeSchema(t.Elem())}
+		if t.Key().Kind() != reflect.String {
+			schema["propertyNames"] = map[string]interface{}{"pattern": "^[0-9]+$"}
+		}
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"type": []string{"boolean", "null"}}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": []string{"integer", "null"}}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": []string{"integer", "null"}, "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": []string{"number", "null"}}
+	case reflect.String:
+		return map[string]interface{}{"type": []string{"string", "null"}}
+	}
+	return map[string]interface{}{}
+}
+
+func addStructProperties(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if options == "inline" {
+			addStructProperties(field.Type, properties)
+			continue
+		}
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		properties[name] = typeSchema(field.Type)
+	}
+}
+
+// configSchema returns a JSON Schema of config files.
+func configSchema() map[string]interface{} {
+	schema := typeSchema(reflect.TypeOf(config{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "sshesame config"
+	return schema
+}
+
+func checkCommand(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	var configFiles configFilesFlag
+	flags.Var(&configFiles, "config", "config file, or directory of YAML config files, to check; can be given multiple times to merge them in order")
+	dataDir := flags.String("data_dir", path.Join(xdg.DataHome, "sshesame"), "data directory to store automatically generated host keys in")
+	schema := flags.Bool("schema", false, "print the JSON Schema of config files instead")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v check [flags]\n\nLoads and validates a config without listening, then prints the effective config with the defaults filled in.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return errors.New("unexpected arguments")
+	}
+	if *schema {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(configSchema())
+	}
+	configString, sources, err := readConfig(configFiles)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	sources.log()
+	cfg, err := parseConfig(configString, *dataDir)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	return writeEffectiveConfig(os.Stdout, cfg)
+}
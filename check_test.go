@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// checkSchema checks a YAML value against the parts of JSON Schema used by configSchema.
+func checkSchema(t *testing.T, schema map[string]interface{}, value interface{}, name string) {
+	t.Helper()
+	types, _ := schema["type"].([]string)
+	valueType := "null"
+	switch value.(type) {
+	case map[interface{}]interface{}:
+		valueType = "object"
+	case []interface{}:
+		valueType = "array"
+	case bool:
+		valueType = "boolean"
+	case int, int64, uint64:
+		valueType = "integer"
+	case float64:
+		valueType = "number"
+	case string:
+		valueType = "string"
+	}
+	if len(types) > 0 && !slices.Contains(types, valueType) {
+		t.Errorf("%v is a %v, want %v", name, valueType, types)
+		return
+	}
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		for key, child := range value {
+			childName := fmt.Sprintf("%v.%v", name, key)
+			if propertySchema, ok := properties[fmt.Sprint(key)]; ok {
+				checkSchema(t, propertySchema.(map[string]interface{}), child, childName)
+			} else if additional, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+				checkSchema(t, additional, child, childName)
+			} else {
+				t.Errorf("%v isn't in the schema", childName)
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			checkSchema(t, schema["items"].(map[string]interface{}), item, fmt.Sprintf("%v[%v]", name, i))
+		}
+	}
+}
+
+func TestConfigSchema(t *testing.T) {
+	schema := configSchema()
+	for _, file := range []string{"sshesame.yaml", "openssh.yaml"} {
+		configBytes, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var document interface{}
+		if err := yaml.Unmarshal(configBytes, &document); err != nil {
+			t.Fatal(err)
+		}
+		checkSchema(t, schema, document, file)
+	}
+
+	properties := schema["properties"].(map[string]interface{})
+	keyboardInteractive := properties["auth"].(map[string]interface{})["properties"].(map[string]interface{})["keyboard_interactive_auth"].(map[string]interface{})
+	if _, ok := keyboardInteractive["properties"].(map[string]interface{})["accepted"]; !ok {
+		t.Errorf("keyboard_interactive_auth=%v, want the inlined settings", keyboardInteractive)
+	}
+	if additional := properties["server"].(map[string]interface{})["additionalProperties"]; additional != false {
+		t.Errorf("additionalProperties=%v, want unknown settings rejected like the strict YAML parsing does", additional)
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	dataDir := t.TempDir()
+	writeTestKeys(t, dataDir)
+	configBytes, err := os.ReadFile("sshesame.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := parseConfig(string(configBytes), dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.logFileHandle != nil || cfg.logSinks != nil || cfg.eventStore != nil {
+		t.Error("parsing the config opened its outputs, want them left closed")
+	}
+	buffer := &bytes.Buffer{}
+	if err := writeEffectiveConfig(buffer, cfg); err != nil {
+		t.Fatal(err)
+	}
+	effectiveCfg, err := parseConfig(buffer.String(), t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to load the effective config: %v\n%v", err, buffer)
+	}
+	if len(effectiveCfg.Server.HostKeys) != 3 || len(effectiveCfg.SSHProto.Ciphers) == 0 {
+		t.Errorf("config=%+v, want the default host keys and algorithms", effectiveCfg)
+	}
+	effectiveBuffer := &bytes.Buffer{}
+	if err := writeEffectiveConfig(effectiveBuffer, effectiveCfg); err != nil {
+		t.Fatal(err)
+	}
+	if effectiveBuffer.String() != buffer.String() {
+		t.Errorf("effective config of the effective config=\n%v\nwant\n%v", effectiveBuffer, buffer)
+	}
+}
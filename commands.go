@@ -1,8 +1,13 @@
 package main
 import (
+	gocontext "context"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -33,6 +38,7 @@ type commandContext struct {
 	user           string
 	cwd            *string // Pointer to current working directory (managed by shell)
 	hostname       string  // Current session hostname
+	channel        channelContext // SSH channel the command runs on, used for logging
 }
 
 type command interface {
@@ -60,6 +66,8 @@ var commands = map[string]command{
 	"lscpu":    cmdLscpu{},  
 	"free":     cmdFree{},   
 	"lspci":    cmdLspci{},  
+	"curl":     cmdCurl{},
+	"wget":     cmdWget{},
 }
 
 var shellProgram = []string{"sh"} // Default shell program
@@ -257,6 +265,7 @@ func (cmdSu) execute(context commandContext) (uint32, error) {
 		stderr:   context.stderr,
 		pty:      context.pty,
 		user:     newContextUser, // Use the new user
+		channel:  context.channel,
 		// cwd and hostname will be re-initialized by the new cmdShell instance
 	}
 	// Execute the new shell
@@ -570,7 +579,7 @@ func (cmdFree) execute(context commandContext) (uint32, error) {
 
 	// Format the output similar to 'free' command (values in KiB)
 	// Right-align numbers using fmt.Sprintf padding
-	output := fmt.Sprintf("%10s %10s %10s %10s %10s %10s\n", "", "total", "used", "free", "shared", "buff/cache", "available")
+	output := fmt.Sprintf("%10s %10s %10s %10s %10s %10s %10s\n", "", "total", "used", "free", "shared", "buff/cache", "available")
 	output += fmt.Sprintf("%-10s %10d %10d %10d %10d %10d %10d\n", "Mem:", totalMem, usedMem, freeMem, sharedMem, buffCache, availableMem)
 	output += fmt.Sprintf("%-10s %10d %10d %10d\n", "Swap:", totalSwap, usedSwap, freeSwap)
 
@@ -593,6 +602,267 @@ func (cmdLspci) execute(context commandContext) (uint32, error) {
 }
 
 
+// --- Curl / Wget 命令实现 ---
+// Only the instance metadata service is reachable, everything else fails to resolve or connect.
+
+// joinQuotedArgs merges arguments split inside quotes, e.g. -H "Metadata: true".
+func joinQuotedArgs(args []string) []string {
+	var result []string
+	quote := ""
+	for _, arg := range args {
+		if quote != "" {
+			result[len(result)-1] += " " + arg
+			if strings.HasSuffix(arg, quote) {
+				last := result[len(result)-1]
+				result[len(result)-1] = last[1 : len(last)-1]
+				quote = ""
+			}
+			continue
+		}
+		if (strings.HasPrefix(arg, "\"") || strings.HasPrefix(arg, "'")) && !(len(arg) > 1 && strings.HasSuffix(arg, arg[:1])) {
+			quote = arg[:1]
+			result = append(result, arg)
+			continue
+		}
+		if len(arg) > 1 && (arg[0] == '"' || arg[0] == '\'') && arg[len(arg)-1] == arg[0] {
+			arg = arg[1 : len(arg)-1]
+		}
+		result = append(result, arg)
+	}
+	return result
+}
+
+type fakeHTTPRequest struct {
+	method   string
+	url      string
+	headers  http.Header
+	body     string
+	username string
+	password string
+}
+
+// fetchURL serves the request if it targets the metadata service, returning nil otherwise.
+func fetchURL(context commandContext, fakeRequest fakeHTTPRequest) (*httpResponseRecorder, *url.URL, error) {
+	if !strings.Contains(fakeRequest.url, "://") {
+		fakeRequest.url = "http://" + fakeRequest.url
+	}
+	requestURL, err := url.Parse(fakeRequest.url)
+	if err != nil {
+		return nil, nil, err
+	}
+	if context.channel.cfg == nil || !context.channel.cfg.Services.IMDS.Enabled || !imdsHosts[requestURL.Hostname()] || requestURL.Scheme != "http" || fakeURLPort(requestURL) != "80" {
+		return nil, requestURL, nil
+	}
+	request, err := http.NewRequest(fakeRequest.method, requestURL.String(), strings.NewReader(fakeRequest.body))
+	if err != nil {
+		return nil, requestURL, err
+	}
+	for name, values := range fakeRequest.headers {
+		request.Header[name] = values
+	}
+	if fakeRequest.username != "" || fakeRequest.password != "" {
+		request.SetBasicAuth(fakeRequest.username, fakeRequest.password)
+	}
+	request.RequestURI = requestURL.RequestURI()
+	request = request.WithContext(gocontext.WithValue(request.Context(), channelContextKey{}, context.channel))
+	recorder := &httpResponseRecorder{header: http.Header{}}
+	imdsHandler{}.ServeHTTP(recorder, request)
+	return recorder, requestURL, nil
+}
+
+type cmdCurl struct{}
+
+func (cmdCurl) execute(context commandContext) (uint32, error) {
+	args := joinQuotedArgs(context.args[1:])
+	request := fakeHTTPRequest{method: http.MethodGet, headers: http.Header{}}
+	output := ""
+	fail, include := false, false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		next := func() string {
+			if i+1 < len(args) {
+				i++
+				return args[i]
+			}
+			return ""
+		}
+		switch arg {
+		case "-X", "--request":
+			request.method = strings.ToUpper(next())
+		case "-H", "--header":
+			if name, value, ok := strings.Cut(next(), ":"); ok {
+				request.headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+			}
+		case "-d", "--data", "--data-raw", "--data-binary":
+			request.body = next()
+			if request.method == http.MethodGet {
+				request.method = http.MethodPost
+			}
+		case "-u", "--user":
+			request.username, request.password, _ = strings.Cut(next(), ":")
+		case "-o", "--output":
+			output = next()
+		case "-A", "--user-agent", "-m", "--max-time", "--connect-timeout", "-e", "--referer", "-b", "--cookie":
+			next()
+		case "-f", "--fail":
+			fail = true
+		case "-i", "--include":
+			include = true
+		default:
+			if strings.HasPrefix(arg, "-") {
+				if strings.Contains(arg[1:], "f") && !strings.HasPrefix(arg, "--") {
+					fail = true
+				}
+				continue
+			}
+			request.url = arg
+		}
+	}
+	if request.url == "" {
+		_, err := fmt.Fprintln(context.stderr, "curl: try 'curl --help' or 'curl --manual' for more information")
+		return 2, err
+	}
+	response, requestURL, err := fetchURL(context, request)
+	if err != nil {
+		_, err := fmt.Fprintf(context.stderr, "curl: (3) URL using bad/illegal format or missing URL\n")
+		return 3, err
+	}
+	if response == nil {
+		time.Sleep(time.Second)
+		if net.ParseIP(requestURL.Hostname()) == nil {
+			_, err := fmt.Fprintf(context.stderr, "curl: (6) Could not resolve host: %v\n", requestURL.Hostname())
+			return 6, err
+		}
+		_, err := fmt.Fprintf(context.stderr, "curl: (7) Failed to connect to %v port %v after 1002 ms: Connection refused\n", requestURL.Hostname(), fakeURLPort(requestURL))
+		return 7, err
+	}
+	if fail && response.status >= 400 {
+		_, err := fmt.Fprintf(context.stderr, "curl: (22) The requested URL returned error: %v\n", response.status)
+		return 22, err
+	}
+	if output != "" && output != "-" {
+		return 0, nil
+	}
+	if include {
+		if _, err := fmt.Fprintf(context.stdout, "HTTP/1.1 %v %v\n", response.status, http.StatusText(response.status)); err != nil {
+			return 1, err
+		}
+		for name, values := range response.header {
+			if _, err := fmt.Fprintf(context.stdout, "%v: %v\n", name, strings.Join(values, ", ")); err != nil {
+				return 1, err
+			}
+		}
+		if _, err := fmt.Fprintln(context.stdout); err != nil {
+			return 1, err
+		}
+	}
+	_, err = fmt.Fprint(context.stdout, response.body.String())
+	if err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
+
+func fakeURLPort(requestURL *url.URL) string {
+	if port := requestURL.Port(); port != "" {
+		return port
+	}
+	if requestURL.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+type cmdWget struct{}
+
+func (cmdWget) execute(context commandContext) (uint32, error) {
+	args := joinQuotedArgs(context.args[1:])
+	request := fakeHTTPRequest{method: http.MethodGet, headers: http.Header{}}
+	output := ""
+	quiet := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-O" && i+1 < len(args):
+			i++
+			output = args[i]
+		case strings.HasPrefix(arg, "--output-document="):
+			output = strings.TrimPrefix(arg, "--output-document=")
+		case arg == "--header" && i+1 < len(args):
+			i++
+			if name, value, ok := strings.Cut(args[i], ":"); ok {
+				request.headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+			}
+		case strings.HasPrefix(arg, "--header="):
+			if name, value, ok := strings.Cut(strings.TrimPrefix(arg, "--header="), ":"); ok {
+				request.headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+			}
+		case strings.HasPrefix(arg, "--method="):
+			request.method = strings.ToUpper(strings.TrimPrefix(arg, "--method="))
+		case arg == "-q" || arg == "--quiet" || arg == "-qO-":
+			quiet = true
+			if arg == "-qO-" {
+				output = "-"
+			}
+		case strings.HasPrefix(arg, "-"):
+		default:
+			request.url = arg
+		}
+	}
+	if request.url == "" {
+		_, err := fmt.Fprint(context.stderr, "wget: missing URL\nUsage: wget [OPTION]... [URL]...\n\nTry `wget --help' for more options.\n")
+		return 1, err
+	}
+	response, requestURL, err := fetchURL(context, request)
+	if err != nil {
+		_, err := fmt.Fprintf(context.stderr, "%v: Invalid URL %v: Unsupported scheme\n", request.url, request.url)
+		return 1, err
+	}
+	timestamp := time.Now().Format("2006-01-02 15:04:05")
+	if !quiet {
+		if _, err := fmt.Fprintf(context.stderr, "--%v--  %v\nConnecting to %v:%v... ", timestamp, requestURL, requestURL.Hostname(), fakeURLPort(requestURL)); err != nil {
+			return 1, err
+		}
+	}
+	if response == nil {
+		time.Sleep(time.Second)
+		if net.ParseIP(requestURL.Hostname()) == nil {
+			_, err := fmt.Fprintf(context.stderr, "failed: Name or service not known.\nwget: unable to resolve host address '%v'\n", requestURL.Hostname())
+			return 4, err
+		}
+		_, err := fmt.Fprintln(context.stderr, "failed: Connection refused.")
+		return 4, err
+	}
+	if !quiet {
+		if _, err := fmt.Fprintf(context.stderr, "connected.\nHTTP request sent, awaiting response... %v %v\n", response.status, http.StatusText(response.status)); err != nil {
+			return 1, err
+		}
+	}
+	if response.status >= 400 {
+		if !quiet {
+			_, err := fmt.Fprintf(context.stderr, "%v ERROR %v: %v.\n\n", timestamp, response.status, http.StatusText(response.status))
+			return 8, err
+		}
+		return 8, nil
+	}
+	if output == "-" {
+		_, err := fmt.Fprint(context.stdout, response.body.String())
+		return 0, err
+	}
+	if output == "" {
+		output = path.Base(requestURL.Path)
+		if output == "/" || output == "." {
+			output = "index.html"
+		}
+	}
+	if !quiet {
+		if _, err := fmt.Fprintf(context.stderr, "Length: %v [%v]\nSaving to: '%v'\n\n%v saved [%v/%v]\n\n", response.body.Len(), response.header.Get("Content-Type"), output, output, response.body.Len(), response.body.Len()); err != nil {
+			return 1, err
+		}
+	}
+	return 0, nil
+}
+
 // main function (example for standalone execution)
 // func main() {
 //  // ... (setup code as before, but useless(maybe), so I deleted it) ...
@@ -6,14 +6,20 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/big"
+	"net/http"
 	"os"
 	"path"
+	"slices"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v2"
@@ -26,12 +32,18 @@ type serverConfig struct {
 }
 
 type loggingConfig struct {
-	File           string `yaml:"file"`
-	JSON           bool   `yaml:"json"`
-	Timestamps     bool   `yaml:"timestamps"`
-	MetricsAddress string `yaml:"metrics_address"`
-	Debug          bool   `yaml:"debug"`
-	SplitHostPort  bool   `yaml:"split_host_port"`
+	File            string            `yaml:"file"`
+	JSON            bool              `yaml:"json"`
+	Timestamps      bool              `yaml:"timestamps"`
+	MetricsAddress  string            `yaml:"metrics_address"`
+	Debug           bool              `yaml:"debug"`
+	SplitHostPort   bool              `yaml:"split_host_port"`
+	SessionSummary  bool              `yaml:"session_summary"`
+	PayloadEncoding string            `yaml:"payload_encoding"`
+	Rotation        logRotationConfig `yaml:"rotation"`
+	Store           eventStoreConfig  `yaml:"store"`
+	Recordings      recordingConfig   `yaml:"recordings"`
+	Sinks           []logSinkConfig   `yaml:"sinks"`
 }
 
 type commonAuthConfig struct {
@@ -67,25 +79,60 @@ type sshProtoConfig struct {
 	MACs           []string `yaml:"macs"`
 }
 
+type smtpServiceConfig struct {
+	Hostname       string `yaml:"hostname"`
+	MaxMessageSize int    `yaml:"max_message_size"`
+	StartTLS       bool   `yaml:"starttls"`
+	AuthAccepted   bool   `yaml:"auth_accepted"`
+}
+
+type servicesConfig struct {
+	SMTP     smtpServiceConfig                `yaml:"smtp"`
+	HTTP     httpServiceConfig                `yaml:"http"`
+	IMDS     imdsServiceConfig                `yaml:"imds"`
+	Scripted map[string]scriptedServiceConfig `yaml:"scripted"`
+}
+
 type config struct {
 	Server   serverConfig   `yaml:"server"`
 	Logging  loggingConfig  `yaml:"logging"`
 	Auth     authConfig     `yaml:"auth"`
 	SSHProto sshProtoConfig `yaml:"ssh_proto"`
+	Services servicesConfig `yaml:"services"`
+	Admin    adminConfig    `yaml:"admin"`
 
-	parsedHostKeys []ssh.Signer
-	sshConfig      *ssh.ServerConfig
-	logFileHandle  io.WriteCloser
+	parsedHostKeys  []ssh.Signer
+	sshConfig       *ssh.ServerConfig
+	tlsConfig       *tls.Config
+	httpMux         *http.ServeMux
+	scriptedServers map[string]tcpipServer
+	artifacts       *artifactStore
+	logFileHandle   io.WriteCloser
+	logSinks        *logDispatcher
+	eventStore      *eventStore
+	dashboard       *dashboard
+	asns            *asnDatabase
 }
 
 func (cfg *config) setDefaults() {
 	cfg.Server.ListenAddress = "127.0.0.1:2022"
 	cfg.Logging.Timestamps = true
+	cfg.Logging.PayloadEncoding = "text"
+	cfg.Logging.Recordings.MaxSize = 10485760
+	cfg.Logging.Store.Retention = 720 * time.Hour
+	cfg.Admin.TranscriptLines = 10000
 	cfg.Auth.PasswordAuth.Enabled = true
 	cfg.Auth.PasswordAuth.Accepted = true
 	cfg.Auth.PublicKeyAuth.Enabled = true
 	cfg.SSHProto.Version = "SSH-2.0-sshesame-pro"
 	cfg.SSHProto.Banner = "This is an SSH honeypot. Everything is logged and monitored."
+	cfg.Services.SMTP.Hostname = "localhost"
+	cfg.Services.SMTP.MaxMessageSize = 10485760
+	cfg.Services.SMTP.StartTLS = true
+	cfg.Services.SMTP.AuthAccepted = true
+	cfg.Services.IMDS.Provider = "aws"
+	cfg.Services.IMDS.Region = "us-east-1"
+	cfg.Services.IMDS.RoleName = "ec2-admin-role"
 }
 
 var defaultTCPIPServices = map[uint32]string{
@@ -183,7 +230,31 @@ func (cfg *config) parseHostKeys() error {
 	return nil
 }
 
+// checkAlgorithms checks that the configured algorithms are supported, as x/crypto/ssh silently ignores the others.
+func (cfg *config) checkAlgorithms() error {
+	supported := ssh.Config{KeyExchanges: cfg.SSHProto.KeyExchanges, Ciphers: cfg.SSHProto.Ciphers, MACs: cfg.SSHProto.MACs}
+	supported.SetDefaults()
+	for _, algorithms := range []struct {
+		kind                  string
+		configured, supported []string
+	}{
+		{"key exchange", cfg.SSHProto.KeyExchanges, supported.KeyExchanges},
+		{"cipher", cfg.SSHProto.Ciphers, supported.Ciphers},
+		{"MAC", cfg.SSHProto.MACs, supported.MACs},
+	} {
+		for _, algorithm := range algorithms.configured {
+			if !slices.Contains(algorithms.supported, algorithm) {
+				return fmt.Errorf("unsupported %v algorithm %q", algorithms.kind, algorithm)
+			}
+		}
+	}
+	return nil
+}
+
 func (cfg *config) setupSSHConfig() error {
+	if err := cfg.checkAlgorithms(); err != nil {
+		return err
+	}
 	sshConfig := &ssh.ServerConfig{
 		Config: ssh.Config{
 			RekeyThreshold: cfg.SSHProto.RekeyThreshold,
@@ -210,15 +281,64 @@ func (cfg *config) setupSSHConfig() error {
 	return nil
 }
 
+// setupTLSConfig creates a self-signed certificate for the fake services that support TLS.
+func (cfg *config) setupTLSConfig() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: cfg.Services.SMTP.Hostname},
+		DNSNames:     []string{cfg.Services.SMTP.Hostname},
+		NotBefore:    time.Now().Add(-24 * time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	cfg.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certificate}, PrivateKey: key}},
+	}
+	return nil
+}
+
 func (cfg *config) setupLogging() error {
-	var logFile io.WriteCloser
-	if cfg.Logging.File != "" {
-		var err error
-		logFile, err = os.OpenFile(cfg.Logging.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			return err
-		}
+	logSinks, logFile, err := cfg.openLogOutputs()
+	if err != nil {
+		return err
 	}
+	cfg.useLogOutputs(logSinks, logFile)
+	return nil
+}
+
+// openLogOutputs opens the log file and sinks of the config, without using them yet.
+func (cfg *config) openLogOutputs() (*logDispatcher, io.WriteCloser, error) {
+	logSinks, err := newLogDispatcher(cfg.Logging.Sinks)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.Logging.File == "" {
+		return logSinks, nil, nil
+	}
+	file, err := openRotatingFile(cfg.Logging.File, cfg.Logging.Rotation)
+	if err != nil {
+		logSinks.close()
+		return nil, nil, err
+	}
+	return logSinks, file, nil
+}
+
+// useLogOutputs switches logging over to opened outputs, closing the previous ones.
+// The sinks dispatcher is shared with the previous configs, so their remaining connections log to the new sinks too.
+func (cfg *config) useLogOutputs(logSinks *logDispatcher, logFile io.WriteCloser) {
 	if logFile == nil {
 		log.SetOutput(os.Stdout)
 	} else {
@@ -228,46 +348,168 @@ func (cfg *config) setupLogging() error {
 		cfg.logFileHandle.Close()
 	}
 	cfg.logFileHandle = logFile
+	if cfg.logSinks == nil {
+		cfg.logSinks = logSinks
+	} else {
+		cfg.logSinks.replace(logSinks)
+	}
 	if !cfg.Logging.JSON && cfg.Logging.Timestamps {
 		log.SetFlags(log.LstdFlags)
 	} else {
 		log.SetFlags(0)
 	}
+}
+
+// setupEventStore opens the event store if it's enabled, keeping the open one if it's in the same directory.
+// A store that's no longer used is released, so it stays open for the connections still using it.
+func (cfg *config) setupEventStore(dir string) error {
+	previous := cfg.eventStore
+	if previous != nil && cfg.Logging.Store.Enabled && previous.dir == dir {
+		previous.setRetention(cfg.Logging.Store.Retention)
+		return nil
+	}
+	cfg.eventStore = nil
+	if cfg.Logging.Store.Enabled {
+		store, err := openEventStore(dir, cfg.Logging.Store.Retention)
+		if err != nil {
+			return err
+		}
+		cfg.eventStore = store
+	}
+	if previous != nil {
+		previous.release()
+	}
 	return nil
 }
 
-func (cfg *config) load(configString string, dataDir string) error {
-	*cfg = config{}
+// acquire keeps the outputs of the config open for a connection until a matching release, even if it's reloaded meanwhile.
+func (cfg *config) acquire() {
+	if cfg.eventStore != nil {
+		cfg.eventStore.acquire()
+	}
+}
+
+func (cfg *config) release() {
+	if cfg.eventStore != nil {
+		cfg.eventStore.release()
+	}
+}
+
+// reopenLogs reopens the log files without reloading the rest of the config.
+func (cfg *config) reopenLogs() {
+	if file, ok := cfg.logFileHandle.(*rotatingFile); ok {
+		if err := file.reopen(); err != nil {
+			warningLogger.Printf("Failed to reopen log file: %v", err)
+		}
+	}
+	cfg.logSinks.reopen()
+}
 
+// parseConfig parses and validates a config, without opening its log outputs or event store.
+func parseConfig(configString string, dataDir string) (*config, error) {
+	cfg := &config{}
 	cfg.setDefaults()
 
 	if err := yaml.UnmarshalStrict([]byte(configString), cfg); err != nil {
-		return err
+		return nil, err
 	}
 
 	if cfg.Server.TCPIPServices == nil {
 		cfg.Server.TCPIPServices = defaultTCPIPServices
 	}
 
+	scriptedServers, err := newScriptedServers(cfg.Services.Scripted)
+	if err != nil {
+		return nil, err
+	}
+	cfg.scriptedServers = scriptedServers
+
 	for _, service := range cfg.Server.TCPIPServices {
-		if _, ok := servers[service]; !ok {
-			return fmt.Errorf("unknown service %q", service)
+		if _, ok := servers[service]; ok {
+			continue
 		}
+		if _, ok := cfg.scriptedServers[service]; !ok {
+			return nil, fmt.Errorf("unknown service %q", service)
+		}
+	}
+
+	if _, ok := payloadEncoders[cfg.Logging.PayloadEncoding]; !ok {
+		return nil, fmt.Errorf("unknown payload encoding %q", cfg.Logging.PayloadEncoding)
+	}
+
+	if cfg.Admin.Address != "" && cfg.Admin.Token == "" {
+		return nil, errors.New("the admin API needs a token")
+	}
+
+	if !imdsProviders[cfg.Services.IMDS.Provider] {
+		return nil, fmt.Errorf("unknown IMDS provider %q", cfg.Services.IMDS.Provider)
+	}
+
+	if cfg.Services.HTTP.Routes == nil {
+		cfg.Services.HTTP.Routes = defaultHTTPRoutes
+	}
+
+	httpMux, err := newHTTPMux(cfg.Services.HTTP.Routes)
+	if err != nil {
+		return nil, err
 	}
+	cfg.httpMux = httpMux
 
 	if len(cfg.Server.HostKeys) == 0 {
-		infoLogger.Printf("ĬԿδ趨ʹ %q ĹԿ", dataDir)
+		infoLogger.Printf("默认主机公钥未设定，使用 %q 的公钥", dataDir)
 		if err := cfg.setDefaultHostKeys(dataDir, []keySignature{rsa_key, ecdsa_key, ed25519_key}); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	if err := cfg.setupSSHConfig(); err != nil {
-		return err
+		return nil, err
 	}
-	if err := cfg.setupLogging(); err != nil {
-		return err
+	if err := cfg.setupTLSConfig(); err != nil {
+		return nil, err
+	}
+	if err := checkLogSinks(cfg.Logging.Sinks); err != nil {
+		return nil, err
 	}
+	cfg.artifacts = &artifactStore{path.Join(dataDir, "artifacts")}
+	asns, err := cfg.loadASNDatabase()
+	if err != nil {
+		return nil, err
+	}
+	cfg.asns = asns
 
-	return nil
+	return cfg, nil
+}
+
+// loadConfig loads a new config, taking over the log outputs, event store and dashboard of the previous one if it's not nil.
+// A config isn't modified once it's loaded. If loading fails, the previous config keeps working as before.
+func loadConfig(configString string, dataDir string, previous *config) (*config, error) {
+	cfg, err := parseConfig(configString, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		// Take over the open outputs, so they can be replaced once the new config is ready
+		cfg.logFileHandle, cfg.logSinks, cfg.eventStore, cfg.dashboard = previous.logFileHandle, previous.logSinks, previous.eventStore, previous.dashboard
+	}
+
+	// Everything that can fail is done before the previous config's outputs are replaced
+	logSinks, logFile, err := cfg.openLogOutputs()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.setupEventStore(path.Join(dataDir, "events")); err != nil {
+		logSinks.close()
+		if logFile != nil {
+			logFile.Close()
+		}
+		return nil, err
+	}
+	cfg.setupDashboard()
+	if cfg.eventStore != nil || cfg.dashboard != nil {
+		logSinks.queues = append(logSinks.queues, newStoredEventQueue(cfg.eventStore, cfg.dashboard))
+	}
+	cfg.useLogOutputs(logSinks, logFile)
+
+	return cfg, nil
 }
@@ -7,7 +7,9 @@ import (
 	"os"
 	"path"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v2"
@@ -142,8 +144,7 @@ func verifyDefaultKeys(t *testing.T, dataDir string) {
 
 func TestDefaultConfig(t *testing.T) {
 	dataDir := t.TempDir()
-	cfg := &config{}
-	err := cfg.load("", dataDir)
+	cfg, err := loadConfig("", dataDir, nil)
 	if err != nil {
 		t.Fatalf("Failed to get config: %v", err)
 	}
@@ -162,6 +163,10 @@ func TestDefaultConfig(t *testing.T) {
 		8080: "HTTP",
 	}
 	expectedConfig.Logging.Timestamps = true
+	expectedConfig.Logging.PayloadEncoding = "text"
+	expectedConfig.Logging.Recordings.MaxSize = 10485760
+	expectedConfig.Logging.Store.Retention = 720 * time.Hour
+	expectedConfig.Admin.TranscriptLines = 10000
 	expectedConfig.Auth.PasswordAuth.Enabled = true
 	expectedConfig.Auth.PasswordAuth.Accepted = true
 	expectedConfig.Auth.PublicKeyAuth.Enabled = true
@@ -205,14 +210,13 @@ ssh_proto:
   version: SSH-2.0-test
   banner:
   rekey_threshold: 123
-  key_exchanges: [kex]
-  ciphers: [cipher]
-  macs: [mac]
+  key_exchanges: [curve25519-sha256]
+  ciphers: [aes128-ctr]
+  macs: [hmac-sha2-256]
 `, logFile)
 	dataDir := t.TempDir()
 	writeTestKeys(t, dataDir)
-	cfg := &config{}
-	err := cfg.load(cfgString, dataDir)
+	cfg, err := loadConfig(cfgString, dataDir, nil)
 	if err != nil {
 		t.Fatalf("Failed to get config: %v", err)
 	}
@@ -232,6 +236,10 @@ ssh_proto:
 	expectedConfig.Logging.Timestamps = false
 	expectedConfig.Logging.MetricsAddress = "0.0.0.0:2112"
 	expectedConfig.Logging.SplitHostPort = true
+	expectedConfig.Logging.PayloadEncoding = "text"
+	expectedConfig.Logging.Recordings.MaxSize = 10485760
+	expectedConfig.Logging.Store.Retention = 720 * time.Hour
+	expectedConfig.Admin.TranscriptLines = 10000
 	expectedConfig.Auth.MaxTries = 234
 	expectedConfig.Auth.NoAuth = true
 	expectedConfig.Auth.PublicKeyAuth.Accepted = true
@@ -244,9 +252,9 @@ ssh_proto:
 	}
 	expectedConfig.SSHProto.Version = "SSH-2.0-test"
 	expectedConfig.SSHProto.RekeyThreshold = 123
-	expectedConfig.SSHProto.KeyExchanges = []string{"kex"}
-	expectedConfig.SSHProto.Ciphers = []string{"cipher"}
-	expectedConfig.SSHProto.MACs = []string{"mac"}
+	expectedConfig.SSHProto.KeyExchanges = []string{"curve25519-sha256"}
+	expectedConfig.SSHProto.Ciphers = []string{"aes128-ctr"}
+	expectedConfig.SSHProto.MACs = []string{"hmac-sha2-256"}
 	verifyConfig(t, cfg, expectedConfig)
 	verifyDefaultKeys(t, dataDir)
 }
@@ -263,8 +271,7 @@ server:
   tcpip_services:
     8080: HTTP
 `, keyFile)
-	cfg := &config{}
-	err = cfg.load(cfgString, dataDir)
+	cfg, err := loadConfig(cfgString, dataDir, nil)
 	if err != nil {
 		t.Fatalf("Failed to get config: %v", err)
 	}
@@ -275,6 +282,10 @@ server:
 		8080: "HTTP",
 	}
 	expectedConfig.Logging.Timestamps = true
+	expectedConfig.Logging.PayloadEncoding = "text"
+	expectedConfig.Logging.Recordings.MaxSize = 10485760
+	expectedConfig.Logging.Store.Retention = 720 * time.Hour
+	expectedConfig.Admin.TranscriptLines = 10000
 	expectedConfig.Auth.PasswordAuth.Enabled = true
 	expectedConfig.Auth.PasswordAuth.Accepted = true
 	expectedConfig.Auth.PublicKeyAuth.Enabled = true
@@ -410,8 +421,7 @@ func TestDefaultConfigFile(t *testing.T) {
 	cfg.Auth.KeyboardInteractiveAuth.Questions = nil
 
 	writeTestKeys(t, dataDir)
-	defaultCfg := &config{}
-	err = defaultCfg.load("", dataDir)
+	defaultCfg, err := loadConfig("", dataDir, nil)
 	if err != nil {
 		t.Fatalf("Failed to get default config: %v", err)
 	}
@@ -425,8 +435,8 @@ server:
 `
 	dataDir := t.TempDir()
 	writeTestKeys(t, dataDir)
-	cfg := &config{}
-	if err := cfg.load(cfgString, dataDir); err != nil {
+	cfg, err := loadConfig(cfgString, dataDir, nil)
+	if err != nil {
 		t.Fatalf("Failed to get config: %v", err)
 	}
 	if len(cfg.parsedHostKeys) != 3 {
@@ -441,8 +451,8 @@ server:
 `
 	dataDir := t.TempDir()
 	writeTestKeys(t, dataDir)
-	cfg := &config{}
-	if err := cfg.load(cfgString, dataDir); err != nil {
+	cfg, err := loadConfig(cfgString, dataDir, nil)
+	if err != nil {
 		t.Fatalf("Failed to get config: %v", err)
 	}
 	if len(cfg.parsedHostKeys) != 3 {
@@ -457,8 +467,8 @@ server:
 `
 	dataDir := t.TempDir()
 	writeTestKeys(t, dataDir)
-	cfg := &config{}
-	if err := cfg.load(cfgString, dataDir); err != nil {
+	cfg, err := loadConfig(cfgString, dataDir, nil)
+	if err != nil {
 		t.Fatalf("Failed to get config: %v", err)
 	}
 	if len(cfg.Server.TCPIPServices) == 0 {
@@ -473,11 +483,49 @@ server:
 `
 	dataDir := t.TempDir()
 	writeTestKeys(t, dataDir)
-	cfg := &config{}
-	if err := cfg.load(cfgString, dataDir); err != nil {
+	cfg, err := loadConfig(cfgString, dataDir, nil)
+	if err != nil {
 		t.Fatalf("Failed to get config: %v", err)
 	}
 	if len(cfg.Server.TCPIPServices) != 0 {
 		t.Errorf("len(cfg.Server.TCPIPServices)=%d, want 0", len(cfg.Server.TCPIPServices))
 	}
 }
+
+func TestScriptedTCPIPServices(t *testing.T) {
+	cfgString := `
+server:
+  tcpip_services:
+    11211: MEMCACHED
+services:
+  scripted:
+    MEMCACHED:
+      default: "ERROR\r\n"
+`
+	dataDir := t.TempDir()
+	writeTestKeys(t, dataDir)
+	cfg, err := loadConfig(cfgString, dataDir, nil)
+	if err != nil {
+		t.Fatalf("Failed to get config: %v", err)
+	}
+	if _, ok := cfg.scriptedServers["MEMCACHED"]; !ok {
+		t.Errorf("MEMCACHED not in scriptedServers")
+	}
+	if _, err := loadConfig(strings.Replace(cfgString, "11211: MEMCACHED", "11211: MEMCACHE", 1), dataDir, cfg); err == nil {
+		t.Errorf("Loading config with unknown service succeeded, want error")
+	}
+}
+
+func TestUnsupportedAlgorithms(t *testing.T) {
+	dataDir := t.TempDir()
+	writeTestKeys(t, dataDir)
+	for _, cfgString := range []string{
+		"ssh_proto:\n  key_exchanges: [kex]\n",
+		"ssh_proto:\n  ciphers: [aes128-ctr, cipher]\n",
+		"ssh_proto:\n  macs: [mac]\n",
+	} {
+		if _, err := parseConfig(cfgString, dataDir); err == nil {
+			t.Errorf("Loading config %q succeeded, want error", cfgString)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configEnvPrefix is the prefix of the environment variables overriding settings,
+// e.g. SSHESAME_SERVER_LISTEN_ADDRESS for server.listen_address.
+const configEnvPrefix = "SSHESAME_"
+
+// configFilesFlag is a flag that can be given multiple times, collecting config files and directories.
+type configFilesFlag []string
+
+func (files *configFilesFlag) String() string {
+	return strings.Join(*files, ",")
+}
+
+func (files *configFilesFlag) Set(file string) error {
+	*files = append(*files, file)
+	return nil
+}
+
+// configSources maps the dotted keys of the settings that aren't defaults to the file or environment variable setting them.
+type configSources map[string]string
+
+// set records the source of a setting, which replaces what was set for the settings in it, or the section it's in.
+func (sources configSources) set(key string, source string) {
+	for existing := range sources {
+		if strings.HasPrefix(existing, key+".") || strings.HasPrefix(key, existing+".") {
+			delete(sources, existing)
+		}
+	}
+	sources[key] = source
+}
+
+// add records the source of the settings in a YAML document.
+func (sources configSources) add(document map[interface{}]interface{}, source string) {
+	keys := map[string]interface{}{}
+	flattenConfig("", document, keys)
+	for key := range keys {
+		sources.set(key, source)
+	}
+}
+
+// log logs the source of each setting.
+func (sources configSources) log() {
+	keys := make([]string, 0, len(sources))
+	for key := range sources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		infoLogger.Printf("Config setting %v is set by %v", key, sources[key])
+	}
+	infoLogger.Printf("The other config settings use their defaults")
+}
+
+// mergeConfig merges a YAML document into another one. Sections are merged, other values are replaced.
+func mergeConfig(document map[interface{}]interface{}, overlay map[interface{}]interface{}) {
+	for key, value := range overlay {
+		if section, ok := value.(map[interface{}]interface{}); ok {
+			if documentSection, ok := document[key].(map[interface{}]interface{}); ok {
+				mergeConfig(documentSection, section)
+				continue
+			}
+		}
+		document[key] = value
+	}
+}
+
+// configFiles lists the files of a config file or directory. Directories are read like conf.d directories,
+// taking the YAML files in them in the order of their names.
+func configFiles(file string) ([]string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if !info.IsDir() {
+		return []string{file}, nil
+	}
+	entries, err := os.ReadDir(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config directory: %w", err)
+	}
+	files := []string{}
+	for _, entry := range entries {
+		if extension := filepath.Ext(entry.Name()); !entry.IsDir() && (extension == ".yaml" || extension == ".yml") {
+			files = append(files, filepath.Join(file, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+// readConfigDocument reads a config file as a YAML document, checking its settings on their own so errors point to the file.
+func readConfigDocument(file string) (map[interface{}]interface{}, error) {
+	configBytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(configBytes, &config{}); err != nil {
+		return nil, fmt.Errorf("%v: %w", file, err)
+	}
+	document := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal(configBytes, &document); err != nil {
+		return nil, fmt.Errorf("%v: %w", file, err)
+	}
+	return document, nil
+}
+
+// addConfigEnvKeys maps the names of the environment variables overriding the settings of a config type to their keys.
+func addConfigEnvKeys(t reflect.Type, prefix []string, keys map[string][]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if options == "inline" {
+			addConfigEnvKeys(field.Type, prefix, keys)
+			continue
+		}
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		key := append(append([]string{}, prefix...), name)
+		keys[configEnvPrefix+strings.ToUpper(strings.Join(key, "_"))] = key
+		if field.Type.Kind() == reflect.Struct {
+			addConfigEnvKeys(field.Type, key, keys)
+		}
+	}
+}
+
+// setConfigValue sets a setting in a YAML document, adding the sections it's in if needed.
+func setConfigValue(document map[interface{}]interface{}, key []string, value interface{}) {
+	for _, name := range key[:len(key)-1] {
+		section, ok := document[name].(map[interface{}]interface{})
+		if !ok {
+			section = map[interface{}]interface{}{}
+			document[name] = section
+		}
+		document = section
+	}
+	document[key[len(key)-1]] = value
+}
+
+// applyConfigEnv overrides settings of a YAML document with SSHESAME_* environment variables, whose values are parsed as YAML.
+// A variable replaces the whole setting, including a section or map set by the files.
+func applyConfigEnv(document map[interface{}]interface{}, environ []string, sources configSources) error {
+	envKeys := map[string][]string{}
+	addConfigEnvKeys(reflect.TypeOf(config{}), nil, envKeys)
+	sort.Strings(environ)
+	for _, variable := range environ {
+		name, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(name, configEnvPrefix) {
+			continue
+		}
+		key, ok := envKeys[name]
+		if !ok {
+			warningLogger.Printf("Ignoring environment variable %v, which doesn't match a config setting", name)
+			continue
+		}
+		var parsed interface{}
+		if err := yaml.Unmarshal([]byte(value), &parsed); err != nil {
+			return fmt.Errorf("%v: %w", name, err)
+		}
+		override := map[interface{}]interface{}{}
+		setConfigValue(override, key, parsed)
+		overrideBytes, err := yaml.Marshal(override)
+		if err != nil {
+			return fmt.Errorf("%v: %w", name, err)
+		}
+		if err := yaml.UnmarshalStrict(overrideBytes, &config{}); err != nil {
+			return fmt.Errorf("%v: %w", name, err)
+		}
+		setConfigValue(document, key, parsed)
+		sources.set(strings.Join(key, "."), name)
+	}
+	return nil
+}
+
+// readConfig reads a layered config: the config files, and the YAML files in config directories, merged in order,
+// then the SSHESAME_* environment variables. The defaults apply to the settings none of them set.
+func readConfig(files []string) (string, configSources, error) {
+	document := map[interface{}]interface{}{}
+	sources := configSources{}
+	for _, file := range files {
+		layerFiles, err := configFiles(file)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, layerFile := range layerFiles {
+			layer, err := readConfigDocument(layerFile)
+			if err != nil {
+				return "", nil, err
+			}
+			mergeConfig(document, layer)
+			sources.add(layer, layerFile)
+		}
+	}
+	if err := applyConfigEnv(document, os.Environ(), sources); err != nil {
+		return "", nil, err
+	}
+	configBytes, err := yaml.Marshal(document)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(configBytes), sources, nil
+}
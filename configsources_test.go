@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfigLayer(t *testing.T, file string, content string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLayeredConfig(t *testing.T) {
+	confDir := t.TempDir()
+	writeConfigLayer(t, path.Join(confDir, "10-base.yaml"), `
+server:
+  listen_address: 0.0.0.0:22
+  tcpip_services:
+    25: SMTP
+auth:
+  password_auth:
+    accepted: false
+`)
+	writeConfigLayer(t, path.Join(confDir, "20-auth.yml"), `
+auth:
+  password_auth:
+    enabled: false
+    accepted: true
+`)
+	writeConfigLayer(t, path.Join(confDir, "README"), "not a config")
+	localFile := path.Join(t.TempDir(), "local.yaml")
+	writeConfigLayer(t, localFile, "logging:\n  json: true\n")
+	t.Setenv("SSHESAME_SERVER_LISTEN_ADDRESS", "127.0.0.1:2222")
+	t.Setenv("SSHESAME_SERVER_TCPIP_SERVICES", "{80: HTTP}")
+
+	configString, sources, err := readConfig([]string{confDir, localFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataDir := t.TempDir()
+	writeTestKeys(t, dataDir)
+	cfg, err := parseConfig(configString, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to parse the merged config: %v\n%v", err, configString)
+	}
+	if cfg.Server.ListenAddress != "127.0.0.1:2222" {
+		t.Errorf("listen_address=%v, want the environment variable's", cfg.Server.ListenAddress)
+	}
+	if !reflect.DeepEqual(cfg.Server.TCPIPServices, map[uint32]string{80: "HTTP"}) {
+		t.Errorf("tcpip_services=%v, want them replaced by the environment variable", cfg.Server.TCPIPServices)
+	}
+	if cfg.Auth.PasswordAuth.Enabled || !cfg.Auth.PasswordAuth.Accepted || !cfg.Auth.PublicKeyAuth.Enabled {
+		t.Errorf("auth=%+v, want the later file merged over the earlier one and the defaults", cfg.Auth)
+	}
+	if !cfg.Logging.JSON || !cfg.Logging.Timestamps {
+		t.Errorf("logging=%+v, want the local file merged over the defaults", cfg.Logging)
+	}
+
+	expectedSources := configSources{
+		"server.listen_address":       "SSHESAME_SERVER_LISTEN_ADDRESS",
+		"server.tcpip_services":       "SSHESAME_SERVER_TCPIP_SERVICES",
+		"auth.password_auth.enabled":  path.Join(confDir, "20-auth.yml"),
+		"auth.password_auth.accepted": path.Join(confDir, "20-auth.yml"),
+		"logging.json":                localFile,
+	}
+	if !reflect.DeepEqual(sources, expectedSources) {
+		t.Errorf("sources=%v, want %v", sources, expectedSources)
+	}
+}
+
+func TestLayeredConfigErrors(t *testing.T) {
+	badFile := path.Join(t.TempDir(), "bad.yaml")
+	writeConfigLayer(t, badFile, "server:\n  listen_adress: 0.0.0.0:22\n")
+	if _, _, err := readConfig([]string{badFile}); err == nil || !strings.Contains(err.Error(), badFile) {
+		t.Errorf("err=%v, want an error about %v", err, badFile)
+	}
+	if _, _, err := readConfig([]string{path.Join(t.TempDir(), "missing.yaml")}); err == nil {
+		t.Error("reading a missing config file succeeded, want error")
+	}
+	t.Setenv("SSHESAME_AUTH_MAX_TRIES", "many")
+	if _, _, err := readConfig(nil); err == nil || !strings.Contains(err.Error(), "SSHESAME_AUTH_MAX_TRIES") {
+		t.Errorf("err=%v, want an error about SSHESAME_AUTH_MAX_TRIES", err)
+	}
+}
+
+func TestConfigEnvKeys(t *testing.T) {
+	keys := map[string][]string{}
+	addConfigEnvKeys(reflect.TypeOf(config{}), nil, keys)
+	for name, expected := range map[string][]string{
+		"SSHESAME_SERVER_LISTEN_ADDRESS":                  {"server", "listen_address"},
+		"SSHESAME_ADMIN_TOKEN":                            {"admin", "token"},
+		"SSHESAME_AUTH_KEYBOARD_INTERACTIVE_AUTH_ENABLED": {"auth", "keyboard_interactive_auth", "enabled"},
+		"SSHESAME_LOGGING_STORE":                          {"logging", "store"},
+		"SSHESAME_LOGGING_STORE_RETENTION":                {"logging", "store", "retention"},
+	} {
+		if !reflect.DeepEqual(keys[name], expected) {
+			t.Errorf("keys[%v]=%v, want %v", name, keys[name], expected)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/hex"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/jaksi/sshutils"
 	"github.com/prometheus/client_golang/prometheus"
@@ -20,6 +23,33 @@ type channelContext struct {
 	channelID int
 }
 
+// connectionIDLength is the number of session ID bytes used as the connection ID.
+const connectionIDLength = 8
+
+// connectionID identifies the connection in events, metrics and artifacts.
+// It's derived from the SSH session ID, which is unique to each key exchange, so it's known during authentication too.
+func (context connContext) connectionID() string {
+	sessionID := context.SessionID()
+	if len(sessionID) > connectionIDLength {
+		sessionID = sessionID[:connectionIDLength]
+	}
+	return hex.EncodeToString(sessionID)
+}
+
+// uniqueChannelID identifies a channel across connections.
+func uniqueChannelID(connectionID string, channelID int) string {
+	return fmt.Sprintf("%v-%v", connectionID, channelID)
+}
+
+// incWithExemplar increments a counter, linking the sample to the connection that caused it.
+func incWithExemplar(counter prometheus.Counter, connectionID string) {
+	if exemplarAdder, ok := counter.(prometheus.ExemplarAdder); ok {
+		exemplarAdder.AddWithExemplar(1, prometheus.Labels{"connection_id": connectionID})
+		return
+	}
+	counter.Inc()
+}
+
 var channelHandlers = map[string]func(newChannel ssh.NewChannel, context channelContext) error{
 	"session":      handleSessionChannel,
 	"direct-tcpip": handleDirectTCPIPChannel,
@@ -41,15 +71,39 @@ var (
 )
 
 func handleConnection(conn *sshutils.Conn, cfg *config) {
-	sshConnectionsMetric.Inc()
+	context := connContext{ConnMetadata: conn, cfg: cfg}
+	// Connections are only tracked live for the admin API
+	var live *liveConnection
+	if cfg.Admin.Address != "" {
+		live = registerLiveConnection(conn, context.connectionID(), cfg.Admin.TranscriptLines)
+	}
+	defer live.unregister()
+	incWithExemplar(sshConnectionsMetric, context.connectionID())
 	activeSSHConnectionsMetric.Inc()
 	defer activeSSHConnectionsMetric.Dec()
 	var channels sync.WaitGroup
-	context := connContext{ConnMetadata: conn, cfg: cfg}
+	start := time.Now()
+	// The summary is only available for connections accepted by a trackingListener
+	summary := getConnectionSummary(conn.RemoteAddr())
 	defer func() {
 		conn.Close()
 		channels.Wait()
-		context.logEvent(connectionCloseLog{})
+		context.logEvent(connectionCloseLog{duration: time.Since(start)})
+		if summary != nil && cfg.Logging.SessionSummary {
+			entry := summary.logEntry()
+			if cfg.eventStore != nil {
+				sourceIP, _ := splitLoggedAddress(conn.RemoteAddr().String())
+				previousConnections := 0
+				if err := cfg.eventStore.query(eventFilter{until: start, sourceIP: sourceIP, eventTypes: map[string]bool{"connection": true}}, func(event loggedEvent) error {
+					previousConnections++
+					return nil
+				}); err != nil {
+					warningLogger.Printf("Failed to count previous connections: %v", err)
+				}
+				entry.PreviousConnections = &previousConnections
+			}
+			context.logEvent(entry)
+		}
 	}()
 
 	context.logEvent(connectionLog{
@@ -62,6 +116,9 @@ func handleConnection(conn *sshutils.Conn, cfg *config) {
 	}
 	if _, _, err := conn.SendRequest("hostkeys-00@openssh.com", false, marshalBytes(hostKeysPayload)); err != nil {
 		warningLogger.Printf("Failed to send hostkeys-00@openssh.com request: %v", err)
+		if summary != nil {
+			summary.setDisconnectReason(disconnectReason(err))
+		}
 		return
 	}
 
@@ -73,10 +130,13 @@ func handleConnection(conn *sshutils.Conn, cfg *config) {
 				conn.Requests = nil
 				continue
 			}
+			payload, encoding := encodePayload(request.Payload, cfg.Logging.PayloadEncoding)
 			context.logEvent(debugGlobalRequestLog{
 				RequestType: request.Type,
 				WantReply:   request.WantReply,
-				Payload:     string(request.Payload),
+				Payload:     payload,
+				Encoding:    encoding,
+				Decoded:     decodeGlobalRequest(request.Type, request.Payload),
 			})
 			if err := handleGlobalRequest(request, &context); err != nil {
 				warningLogger.Printf("Failed to handle global request: %v", err)
@@ -88,12 +148,18 @@ func handleConnection(conn *sshutils.Conn, cfg *config) {
 				conn.NewChannels = nil
 				continue
 			}
+			extraData, encoding := encodePayload(newChannel.ExtraData(), cfg.Logging.PayloadEncoding)
 			context.logEvent(debugChannelLog{
 				channelLog:  channelLog{ChannelID: channelID},
 				ChannelType: newChannel.ChannelType(),
-				ExtraData:   string(newChannel.ExtraData()),
+				ExtraData:   extraData,
+				Encoding:    encoding,
+				Decoded:     channelDecoders.decode(newChannel.ChannelType(), newChannel.ExtraData()),
 			})
 			channelType := newChannel.ChannelType()
+			if summary != nil {
+				summary.addChannel(channelType)
+			}
 			handler := channelHandlers[channelType]
 			if handler == nil {
 				unknownChannelsMetric.Inc()
@@ -106,14 +172,22 @@ func handleConnection(conn *sshutils.Conn, cfg *config) {
 				continue
 			}
 			channels.Add(1)
+			live.addChannel(channelID, channelType)
 			go func(context channelContext) {
 				defer channels.Done()
+				defer live.removeChannel(context.channelID)
 				if err := handler(newChannel, context); err != nil {
 					warningLogger.Printf("Failed to handle new channel: %v", err)
+					if summary != nil {
+						summary.setDisconnectReason(fmt.Sprintf("failed to handle %v channel: %v", newChannel.ChannelType(), err))
+					}
 					conn.Close()
 				}
 			}(channelContext{context, channelID})
 			channelID++
 		}
 	}
+	if summary != nil {
+		summary.setDisconnectReason(disconnectReason(conn.Wait()))
+	}
 }
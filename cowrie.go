@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// cowrieSensor identifies this honeypot in Cowrie events.
+var cowrieSensor, _ = os.Hostname()
+
+// cowrieRecordFields are set from the record and can't be overridden by an event.
+var cowrieRecordFields = map[string]bool{
+	"eventid":   true,
+	"timestamp": true,
+	"src_ip":    true,
+	"src_port":  true,
+	"session":   true,
+	"sensor":    true,
+}
+
+func cowrieLoginEvent(accepted authAccepted) string {
+	if accepted {
+		return "cowrie.login.success"
+	}
+	return "cowrie.login.failed"
+}
+
+// cowrieEvent maps an entry to the equivalent Cowrie event ID and fields.
+// Entries Cowrie has no equivalent for are kept with an sshesame event ID and their own fields.
+func cowrieEvent(entry logEntry) (string, map[string]interface{}, error) {
+	switch entry := entry.(type) {
+	case noAuthLog:
+		return cowrieLoginEvent(entry.Accepted), map[string]interface{}{"username": entry.User, "password": ""}, nil
+	case passwordAuthLog:
+		return cowrieLoginEvent(entry.Accepted), map[string]interface{}{"username": entry.User, "password": entry.Password}, nil
+	case keyboardInteractiveAuthLog:
+		return cowrieLoginEvent(entry.Accepted), map[string]interface{}{"username": entry.User, "password": strings.Join(entry.Answers, "\n")}, nil
+	case publicKeyAuthLog:
+		return "cowrie.client.fingerprint", map[string]interface{}{"username": entry.User, "fingerprint": entry.PublicKeyFingerprint, "accepted": bool(entry.Accepted)}, nil
+	case tcpipAuthLog:
+		return cowrieLoginEvent(entry.Accepted), map[string]interface{}{"username": entry.Username, "password": entry.Password, "protocol": entry.Service}, nil
+	case smtpAuthLog:
+		return cowrieLoginEvent(entry.Accepted), map[string]interface{}{"username": entry.Username, "password": entry.Password, "protocol": "smtp"}, nil
+	case connectionLog:
+		// The client version follows as a separate cowrie.client.version event
+		return "cowrie.session.connect", map[string]interface{}{}, nil
+	case connectionCloseLog:
+		return "cowrie.session.closed", map[string]interface{}{"duration": entry.duration.Seconds()}, nil
+	case sessionInputLog:
+		return "cowrie.command.input", map[string]interface{}{"input": decodedText(entry.Input, entry.Encoding)}, nil
+	case execLog:
+		return "cowrie.command.input", map[string]interface{}{"input": entry.Command}, nil
+	case ptyLog:
+		return "cowrie.client.size", map[string]interface{}{"width": entry.Width, "height": entry.Height, "term": entry.Terminal}, nil
+	case windowChangeLog:
+		return "cowrie.client.size", map[string]interface{}{"width": entry.Width, "height": entry.Height}, nil
+	case envLog:
+		return "cowrie.client.var", map[string]interface{}{"name": entry.Name, "value": entry.Value}, nil
+	case directTCPIPLog:
+		host, port := splitLoggedAddress(entry.To)
+		return "cowrie.direct-tcpip.request", map[string]interface{}{"dst_ip": host, "dst_port": port}, nil
+	case directTCPIPInputLog:
+		return "cowrie.direct-tcpip.data", map[string]interface{}{"data": decodedText(entry.Input, entry.Encoding)}, nil
+	case ftpUploadLog:
+		return "cowrie.session.file_upload", map[string]interface{}{"filename": entry.Filename, "outfile": entry.File, "shasum": entry.SHA256, "protocol": "ftp"}, nil
+	}
+	fields := map[string]interface{}{}
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := json.Unmarshal(entryJSON, &fields); err != nil {
+		return "", nil, err
+	}
+	return "sshesame." + entry.eventType(), fields, nil
+}
+
+// cowrie formats the record as Cowrie JSON log events.
+// Like Cowrie, a connection is logged as cowrie.session.connect followed by cowrie.client.version.
+func (record logRecord) cowrie(timestamps bool) ([][]byte, error) {
+	eventID, event, err := cowrieEvent(record.entry)
+	if err != nil {
+		return nil, err
+	}
+	document, err := record.cowrieDocument(eventID, event, timestamps)
+	if err != nil {
+		return nil, err
+	}
+	documents := [][]byte{document}
+	if entry, ok := record.entry.(connectionLog); ok {
+		document, err := record.cowrieDocument("cowrie.client.version", map[string]interface{}{"version": entry.ClientVersion}, timestamps)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+	return documents, nil
+}
+
+func (record logRecord) cowrieDocument(eventID string, event map[string]interface{}, timestamps bool) ([]byte, error) {
+	srcIP, srcPort := splitLoggedAddress(record.remoteAddr.String())
+	dstIP, dstPort := splitLoggedAddress(record.localAddr.String())
+	fields := map[string]interface{}{
+		"eventid":  eventID,
+		"src_ip":   srcIP,
+		"src_port": srcPort,
+		"dst_ip":   dstIP,
+		"dst_port": dstPort,
+		"session":  record.connectionID,
+		"protocol": "ssh",
+		"sensor":   cowrieSensor,
+		"message":  record.entry.String(),
+	}
+	if timestamps {
+		fields["timestamp"] = record.time.UTC().Format("2006-01-02T15:04:05.000000Z")
+	}
+	// Other event fields take precedence, e.g. the protocol of the fake TCP/IP services
+	for name, value := range event {
+		if !cowrieRecordFields[name] {
+			fields[name] = value
+		}
+	}
+	return json.Marshal(fields)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCowrieEvents(t *testing.T) {
+	tests := []struct {
+		entry          logEntry
+		expectedFields map[string]interface{}
+	}{
+		{
+			passwordAuthLog{authLog: authLog{User: "root", Accepted: true}, Password: "hunter2"},
+			map[string]interface{}{"eventid": "cowrie.login.success", "username": "root", "password": "hunter2"},
+		},
+		{
+			keyboardInteractiveAuthLog{authLog: authLog{User: "root"}, Answers: []string{"a", "b"}},
+			map[string]interface{}{"eventid": "cowrie.login.failed", "username": "root", "password": "a\nb"},
+		},
+		{
+			tcpipAuthLog{Service: "telnet", Username: "admin", Password: "admin"},
+			map[string]interface{}{"eventid": "cowrie.login.failed", "username": "admin", "password": "admin", "protocol": "telnet"},
+		},
+		{
+			tcpipAuthLog{Service: "ftp", Username: "anonymous", Password: "guest", Accepted: true},
+			map[string]interface{}{"eventid": "cowrie.login.success", "username": "anonymous", "password": "guest", "protocol": "ftp"},
+		},
+		{
+			connectionLog{ClientVersion: "SSH-2.0-testclient"},
+			map[string]interface{}{"eventid": "cowrie.session.connect"},
+		},
+		{
+			connectionCloseLog{duration: 1500 * time.Millisecond},
+			map[string]interface{}{"eventid": "cowrie.session.closed", "duration": 1.5},
+		},
+		{
+			sessionInputLog{Input: "uname -a"},
+			map[string]interface{}{"eventid": "cowrie.command.input", "input": "uname -a"},
+		},
+		{
+			execLog{Command: "cat /etc/passwd"},
+			map[string]interface{}{"eventid": "cowrie.command.input", "input": "cat /etc/passwd"},
+		},
+		{
+			directTCPIPLog{From: "10.0.0.1:4321", To: addressLog{"example.com", 80}},
+			map[string]interface{}{"eventid": "cowrie.direct-tcpip.request", "dst_ip": "example.com", "dst_port": 80.0},
+		},
+		{
+			ftpUploadLog{Filename: "/x.sh", SHA256: "abc", File: "/data/ftp/x"},
+			map[string]interface{}{"eventid": "cowrie.session.file_upload", "filename": "/x.sh", "shasum": "abc", "outfile": "/data/ftp/x", "protocol": "ftp"},
+		},
+		{
+			subsystemLog{Subsystem: "sftp"},
+			map[string]interface{}{"eventid": "sshesame.subsystem", "channel_id": 0.0, "subsystem": "sftp"},
+		},
+	}
+	for _, test := range tests {
+		record := logRecord{
+			remoteAddr:   &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+			localAddr:    &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2022},
+			sessionID:    "736f6d6573657373696f6e",
+			connectionID: "736f6d6573657373",
+			entry:        test.entry,
+		}
+		documents, err := record.cowrie(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal(documents[0], &fields); err != nil {
+			t.Fatal(err)
+		}
+		expectedFields := map[string]interface{}{
+			"src_ip":   "127.0.0.1",
+			"src_port": 1234.0,
+			"dst_ip":   "127.0.0.1",
+			"dst_port": 2022.0,
+			"session":  "736f6d6573657373",
+			"protocol": "ssh",
+			"sensor":   cowrieSensor,
+			"message":  test.entry.String(),
+		}
+		for name, value := range test.expectedFields {
+			expectedFields[name] = value
+		}
+		if !reflect.DeepEqual(fields, expectedFields) {
+			t.Errorf("%T: fields=%v, want %v", test.entry, fields, expectedFields)
+		}
+	}
+}
+
+func TestCowrieClientVersion(t *testing.T) {
+	record := logRecord{
+		remoteAddr:   &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+		localAddr:    &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2022},
+		connectionID: "736f6d6573657373",
+		entry:        connectionLog{ClientVersion: "SSH-2.0-testclient"},
+	}
+	documents, err := record.cowrie(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(documents) != 2 {
+		t.Fatalf("documents=%q, want cowrie.session.connect and cowrie.client.version", documents)
+	}
+	events := make([]map[string]interface{}, len(documents))
+	for i, document := range documents {
+		if err := json.Unmarshal(document, &events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if events[0]["eventid"] != "cowrie.session.connect" || events[0]["version"] != nil {
+		t.Errorf("event=%v, want cowrie.session.connect without the version", events[0])
+	}
+	if events[1]["eventid"] != "cowrie.client.version" || events[1]["version"] != "SSH-2.0-testclient" || events[1]["session"] != "736f6d6573657373" {
+		t.Errorf("event=%v, want cowrie.client.version with the version", events[1])
+	}
+}
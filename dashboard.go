@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+const (
+	// maxDashboardSessions is how many sessions, live or ended, the dashboard keeps for browsing.
+	maxDashboardSessions = 500
+	// maxDashboardTranscriptLines caps the transcript kept for a single session.
+	maxDashboardTranscriptLines = 2000
+	// maxDashboardLogins is how many recent logins the dashboard shows.
+	maxDashboardLogins = 50
+	// dashboardTopLimit is how many of the most common values the dashboard shows.
+	dashboardTopLimit = 20
+)
+
+// asnRange is a range of IP addresses announced by an autonomous system.
+type asnRange struct {
+	start, end netip.Addr
+	asn        int
+	country    string
+	name       string
+}
+
+// asnDatabase looks up the autonomous system and country of IP addresses offline.
+type asnDatabase struct {
+	ranges []asnRange
+}
+
+// loadASNDatabase reads a tab separated file of range_start, range_end, AS_number, country_code and AS_description,
+// as published by iptoasn.com.
+func loadASNDatabase(file string) (*asnDatabase, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	database := &asnDatabase{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) == 1 && strings.TrimSpace(fields[0]) == "" {
+			continue
+		}
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("%v:%v: expected 5 fields, got %v", file, line, len(fields))
+		}
+		start, startErr := netip.ParseAddr(fields[0])
+		end, endErr := netip.ParseAddr(fields[1])
+		asn, asnErr := strconv.Atoi(fields[2])
+		if startErr != nil || endErr != nil || asnErr != nil {
+			return nil, fmt.Errorf("%v:%v: invalid range %q", file, line, scanner.Text())
+		}
+		if asn == 0 {
+			continue
+		}
+		database.ranges = append(database.ranges, asnRange{start, end, asn, fields[3], fields[4]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(database.ranges, func(i, j int) bool { return database.ranges[i].start.Less(database.ranges[j].start) })
+	return database, nil
+}
+
+// lookup returns the range an IP address is in, if it's announced.
+func (database *asnDatabase) lookup(ip string) (asnRange, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if database == nil || err != nil {
+		return asnRange{}, false
+	}
+	addr = addr.Unmap()
+	i := sort.Search(len(database.ranges), func(i int) bool { return addr.Less(database.ranges[i].start) })
+	if i == 0 {
+		return asnRange{}, false
+	}
+	announced := database.ranges[i-1]
+	if announced.end.Less(addr) || announced.start.Is4() != addr.Is4() {
+		return asnRange{}, false
+	}
+	return announced, true
+}
+
+type dashboardLogin struct {
+	Time         time.Time `json:"time"`
+	ConnectionID string    `json:"connection_id"`
+	Source       string    `json:"source"`
+	Method       string    `json:"method"`
+	User         string    `json:"user"`
+	Credential   string    `json:"credential"`
+}
+
+type dashboardSession struct {
+	ConnectionID  string     `json:"connection_id"`
+	Source        string     `json:"source"`
+	Country       string     `json:"country"`
+	ASN           string     `json:"asn"`
+	ClientVersion string     `json:"client_version"`
+	User          string     `json:"user"`
+	Start         time.Time  `json:"start"`
+	End           *time.Time `json:"end"`
+	Commands      int        `json:"commands"`
+	transcript    []string
+}
+
+// dashboard aggregates the logged events for the admin dashboard.
+type dashboard struct {
+	mutex    sync.Mutex
+	asns     *asnDatabase
+	stats    eventStats
+	totals   map[string]int
+	logins   []dashboardLogin
+	sessions []*dashboardSession
+	byID     map[string]*dashboardSession
+}
+
+func newDashboard(asns *asnDatabase) *dashboard {
+	return &dashboard{
+		asns:   asns,
+		stats:  eventStats{},
+		totals: map[string]int{},
+		byID:   map[string]*dashboardSession{},
+	}
+}
+
+func (dashboard *dashboard) setASNs(asns *asnDatabase) {
+	dashboard.mutex.Lock()
+	defer dashboard.mutex.Unlock()
+	dashboard.asns = asns
+}
+
+// credential returns the method and credential of an authentication attempt.
+func credential(event loggedEvent) (string, string) {
+	switch event.EventType {
+	case "password_auth":
+		return "password", event.field("password")
+	case "public_key_auth":
+		return "public_key", event.field("public_key")
+	case "keyboard_interactive_auth":
+		answers, _ := event.Event["answers"].([]interface{})
+		texts := make([]string, len(answers))
+		for i, answer := range answers {
+			texts[i] = fmt.Sprint(answer)
+		}
+		return "keyboard_interactive", strings.Join(texts, "\n")
+	}
+	return "none", ""
+}
+
+// add updates the dashboard with a stored event and the line showing it in the session transcript.
+func (dashboard *dashboard) add(event loggedEvent, transcriptLine string) error {
+	eventTime, err := time.Parse(time.RFC3339Nano, event.Time)
+	if err != nil {
+		return err
+	}
+	eventTime = eventTime.UTC()
+	sourceIP, _ := splitLoggedAddress(event.Source)
+	dashboard.mutex.Lock()
+	defer dashboard.mutex.Unlock()
+	dashboard.stats.addEvent(event)
+	if event.EventType == "exec" {
+		dashboard.stats.add("commands", event.field("command"))
+	}
+	session := dashboard.byID[event.ConnectionID]
+	switch event.EventType {
+	case "connection":
+		dashboard.totals["connections"]++
+		session = &dashboardSession{
+			ConnectionID:  event.ConnectionID,
+			Source:        sourceIP,
+			Country:       "unknown",
+			ASN:           "unknown",
+			ClientVersion: event.field("client_version"),
+			User:          event.User,
+			Start:         eventTime,
+		}
+		if announced, ok := dashboard.asns.lookup(sourceIP); ok {
+			session.Country = announced.country
+			session.ASN = fmt.Sprintf("AS%v %v", announced.asn, announced.name)
+		}
+		dashboard.stats.add("countries", session.Country)
+		dashboard.stats.add("asns", session.ASN)
+		dashboard.sessions = append(dashboard.sessions, session)
+		dashboard.byID[session.ConnectionID] = session
+		if len(dashboard.sessions) > maxDashboardSessions {
+			delete(dashboard.byID, dashboard.sessions[0].ConnectionID)
+			dashboard.sessions = dashboard.sessions[1:]
+		}
+	case "no_auth", "password_auth", "public_key_auth", "keyboard_interactive_auth":
+		dashboard.totals["auth_attempts"]++
+		if accepted, _ := event.Event["accepted"].(bool); accepted {
+			dashboard.totals["logins"]++
+			method, credential := credential(event)
+			dashboard.logins = append(dashboard.logins, dashboardLogin{eventTime, event.ConnectionID, sourceIP, method, event.field("user"), credential})
+			if len(dashboard.logins) > maxDashboardLogins {
+				dashboard.logins = dashboard.logins[1:]
+			}
+			if session != nil {
+				session.User = event.field("user")
+			}
+		}
+	case "session_input", "exec":
+		dashboard.totals["commands"]++
+		if session != nil {
+			session.Commands++
+		}
+	case "connection_close":
+		if session != nil {
+			session.End = &eventTime
+		}
+	}
+	if session != nil && len(session.transcript) < maxDashboardTranscriptLines {
+		session.transcript = append(session.transcript, transcriptLine)
+	}
+	return nil
+}
+
+// seed fills a new dashboard with the events kept in the event store.
+// Their transcript lines show the stored events, as their log messages aren't stored.
+func (dashboard *dashboard) seed(store *eventStore) error {
+	return store.query(eventFilter{}, func(event loggedEvent) error {
+		eventTime, _ := time.Parse(time.RFC3339Nano, event.Time)
+		host, port := splitLoggedAddress(event.Source)
+		eventJSON, _ := json.Marshal(event.Event)
+		transcriptLine := fmt.Sprintf("%v [%v:%v %v] %v %s", eventTime.Local().Format("2006/01/02 15:04:05"), host, port, event.ConnectionID, event.EventType, eventJSON)
+		return dashboard.add(event, transcriptLine)
+	})
+}
+
+type dashboardSummary struct {
+	LiveConnections int                `json:"live_connections"`
+	Totals          map[string]int     `json:"totals"`
+	RecentLogins    []dashboardLogin   `json:"recent_logins"`
+	TopCredentials  []statsCount       `json:"top_credentials"`
+	TopUsernames    []statsCount       `json:"top_usernames"`
+	TopCommands     []statsCount       `json:"top_commands"`
+	Countries       []statsCount       `json:"countries"`
+	ASNs            []statsCount       `json:"asns"`
+	Sessions        []dashboardSession `json:"sessions"`
+}
+
+func (dashboard *dashboard) summary() dashboardSummary {
+	liveConnectionsMutex.Lock()
+	live := len(liveConnections)
+	liveConnectionsMutex.Unlock()
+	dashboard.mutex.Lock()
+	defer dashboard.mutex.Unlock()
+	summary := dashboardSummary{
+		LiveConnections: live,
+		Totals:          map[string]int{},
+		RecentLogins:    make([]dashboardLogin, len(dashboard.logins)),
+		TopCredentials:  dashboard.stats.top("password_pairs", dashboardTopLimit),
+		TopUsernames:    dashboard.stats.top("usernames", dashboardTopLimit),
+		TopCommands:     dashboard.stats.top("commands", dashboardTopLimit),
+		Countries:       dashboard.stats.top("countries", 0),
+		ASNs:            dashboard.stats.top("asns", dashboardTopLimit),
+		Sessions:        make([]dashboardSession, len(dashboard.sessions)),
+	}
+	for _, total := range []string{"connections", "auth_attempts", "logins", "commands"} {
+		summary.Totals[total] = dashboard.totals[total]
+	}
+	// Newest first
+	for i, login := range dashboard.logins {
+		summary.RecentLogins[len(dashboard.logins)-1-i] = login
+	}
+	for i, session := range dashboard.sessions {
+		summary.Sessions[len(dashboard.sessions)-1-i] = *session
+	}
+	return summary
+}
+
+func (dashboard *dashboard) transcript(connectionID string) ([]string, bool) {
+	dashboard.mutex.Lock()
+	defer dashboard.mutex.Unlock()
+	session, ok := dashboard.byID[connectionID]
+	if !ok {
+		return nil, false
+	}
+	return append([]string{}, session.transcript...), true
+}
+
+// dashboardHandler serves the dashboard page. It holds no data, which is fetched from the admin API with the token.
+func dashboardHandler() http.Handler {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(files))
+}
+
+// loadASNDatabase loads the ASN database of the dashboard, if it's enabled and one is configured.
+func (cfg *config) loadASNDatabase() (*asnDatabase, error) {
+	if cfg.Admin.Address == "" || cfg.Admin.ASNFile == "" {
+		return nil, nil
+	}
+	return loadASNDatabase(cfg.Admin.ASNFile)
+}
+
+// setupDashboard keeps activity for the dashboard if the admin API is enabled, keeping what was collected on reloads.
+// A new dashboard starts with the events in the event store, if it's enabled.
+func (cfg *config) setupDashboard() {
+	if cfg.Admin.Address == "" {
+		cfg.dashboard = nil
+		return
+	}
+	if cfg.dashboard == nil {
+		cfg.dashboard = newDashboard(cfg.asns)
+		if cfg.eventStore != nil {
+			if err := cfg.dashboard.seed(cfg.eventStore); err != nil {
+				warningLogger.Printf("Failed to load the stored events into the dashboard: %v", err)
+			}
+		}
+	} else {
+		cfg.dashboard.setASNs(cfg.asns)
+	}
+}
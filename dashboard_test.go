@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeASNFile(t *testing.T) string {
+	t.Helper()
+	file := path.Join(t.TempDir(), "ip2asn-combined.tsv")
+	lines := []string{
+		"1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET",
+		"1.0.1.0\t1.0.3.255\t0\tNone\tNot routed",
+		"192.0.2.0\t192.0.2.255\t64500\tNL\tEXAMPLE-NET",
+		"2001:db8::\t2001:db8:ffff:ffff:ffff:ffff:ffff:ffff\t64501\tDE\tEXAMPLE-V6",
+	}
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestASNDatabase(t *testing.T) {
+	database, err := loadASNDatabase(writeASNFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, testCase := range []struct {
+		ip      string
+		asn     int
+		country string
+	}{
+		{"1.0.0.1", 13335, "US"},
+		{"1.0.2.1", 0, ""},
+		{"192.0.2.200", 64500, "NL"},
+		{"::ffff:192.0.2.1", 64500, "NL"},
+		{"2001:db8::1", 64501, "DE"},
+		{"198.51.100.1", 0, ""},
+		{"not an ip", 0, ""},
+	} {
+		announced, _ := database.lookup(testCase.ip)
+		if announced.asn != testCase.asn || announced.country != testCase.country {
+			t.Errorf("lookup(%v)=%+v, want AS%v in %q", testCase.ip, announced, testCase.asn, testCase.country)
+		}
+	}
+}
+
+func dashboardRecord(ip string, connectionID string, entry logEntry) logRecord {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	return logRecord{
+		time:         time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		remoteAddr:   addr,
+		source:       addr.String(),
+		connectionID: connectionID,
+		entry:        entry,
+	}
+}
+
+// addDashboardRecord adds a record to a dashboard as the event queue does.
+func addDashboardRecord(t *testing.T, dashboard *dashboard, record logRecord) {
+	t.Helper()
+	line, err := record.stored(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (storedEventSink{dashboard: dashboard}).write(record, line); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	database, err := loadASNDatabase(writeASNFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dashboard := newDashboard(database)
+	for _, record := range []logRecord{
+		dashboardRecord("192.0.2.1", "a", passwordAuthLog{authLog{"root", false}, "123456"}),
+		dashboardRecord("192.0.2.1", "a", passwordAuthLog{authLog{"root", true}, "hunter2"}),
+		dashboardRecord("192.0.2.1", "a", connectionLog{"SSH-2.0-Go"}),
+		dashboardRecord("192.0.2.1", "a", sessionInputLog{channelLog{0}, "uname -a", "utf8"}),
+		dashboardRecord("192.0.2.1", "a", execLog{channelLog{1}, "uname -a"}),
+		dashboardRecord("192.0.2.1", "a", connectionCloseLog{}),
+		dashboardRecord("198.51.100.1", "b", passwordAuthLog{authLog{"admin", true}, "admin"}),
+		dashboardRecord("198.51.100.1", "b", connectionLog{"SSH-2.0-libssh"}),
+	} {
+		addDashboardRecord(t, dashboard, record)
+	}
+
+	summary := dashboard.summary()
+	if !reflect.DeepEqual(summary.Totals, map[string]int{"connections": 2, "auth_attempts": 3, "logins": 2, "commands": 2}) {
+		t.Errorf("totals=%v", summary.Totals)
+	}
+	if len(summary.RecentLogins) != 2 || summary.RecentLogins[0].User != "admin" || summary.RecentLogins[1].Credential != "hunter2" {
+		t.Errorf("recent_logins=%+v, want the accepted logins, newest first", summary.RecentLogins)
+	}
+	if !reflect.DeepEqual(summary.TopCommands, []statsCount{{"uname -a", 2}}) {
+		t.Errorf("top_commands=%v", summary.TopCommands)
+	}
+	if !reflect.DeepEqual(summary.Countries, []statsCount{{"NL", 1}, {"unknown", 1}}) {
+		t.Errorf("countries=%v", summary.Countries)
+	}
+	if !reflect.DeepEqual(summary.ASNs, []statsCount{{"AS64500 EXAMPLE-NET", 1}, {"unknown", 1}}) {
+		t.Errorf("asns=%v", summary.ASNs)
+	}
+	if len(summary.Sessions) != 2 || summary.Sessions[0].ConnectionID != "b" || summary.Sessions[0].End != nil {
+		t.Fatalf("sessions=%+v, want the live session first", summary.Sessions)
+	}
+	if session := summary.Sessions[1]; session.Commands != 2 || session.End == nil || session.ClientVersion != "SSH-2.0-Go" {
+		t.Errorf("session=%+v, want the ended session with its commands", session)
+	}
+
+	transcript, ok := dashboard.transcript("a")
+	if !ok || len(transcript) != 4 || !strings.Contains(transcript[1], `输入："uname -a"`) {
+		t.Errorf("transcript=%v, want the session's events", transcript)
+	}
+	if _, ok := dashboard.transcript("unknown"); ok {
+		t.Error("transcript of an unknown session, want none")
+	}
+}
+
+func TestDashboardSeededFromEventStore(t *testing.T) {
+	store, err := openEventStore(path.Join(t.TempDir(), "events"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	addStoredRecord(t, store, dashboardRecord("192.0.2.1", "a", connectionLog{"SSH-2.0-Go"}))
+	addStoredRecord(t, store, dashboardRecord("192.0.2.1", "a", passwordAuthLog{authLog{"root", true}, "hunter2"}))
+	cfg := &config{eventStore: store}
+	cfg.Admin.Address = "127.0.0.1:0"
+	cfg.setupDashboard()
+
+	summary := cfg.dashboard.summary()
+	if !reflect.DeepEqual(summary.Totals, map[string]int{"connections": 1, "auth_attempts": 1, "logins": 1, "commands": 0}) {
+		t.Errorf("totals=%v, want the stored events", summary.Totals)
+	}
+	if len(summary.Sessions) != 1 || summary.Sessions[0].User != "root" || !summary.Sessions[0].Start.Equal(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("sessions=%+v, want the stored session", summary.Sessions)
+	}
+	if transcript, _ := cfg.dashboard.transcript("a"); len(transcript) != 2 || !strings.Contains(transcript[1], `[192.0.2.1:1234 a] password_auth {"accepted":true,"password":"hunter2","user":"root"}`) {
+		t.Errorf("transcript=%v, want the stored events", transcript)
+	}
+}
+
+func TestDashboardHandler(t *testing.T) {
+	cfg := &config{}
+	cfg.Admin.Token = "secret"
+	cfg.dashboard = newDashboard(nil)
+	addDashboardRecord(t, cfg.dashboard, dashboardRecord("192.0.2.1", "a", connectionLog{"SSH-2.0-Go"}))
+	server := httptest.NewServer(newAdminHandler(staticConfigs(cfg)))
+	defer server.Close()
+
+	response := adminRequest(t, "GET", server.URL+"/", "")
+	page, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || !strings.Contains(string(page), "sshesame 仪表盘") {
+		t.Errorf("status=%v page=%.100s, want the dashboard without a token", response.StatusCode, page)
+	}
+	if strings.Contains(string(page), "http://") || strings.Contains(string(page), "https://") {
+		t.Error("the dashboard loads external resources, want it to work offline")
+	}
+
+	if response := adminRequest(t, "GET", server.URL+"/api/dashboard", ""); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status=%v, want 401 without a token", response.StatusCode)
+	}
+	response = adminRequest(t, "GET", server.URL+"/api/dashboard", "secret")
+	summary := dashboardSummary{}
+	if err := json.NewDecoder(response.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if summary.Totals["connections"] != 1 || len(summary.Sessions) != 1 || summary.Sessions[0].Source != "192.0.2.1" {
+		t.Errorf("summary=%+v, want the connection", summary)
+	}
+
+	response = adminRequest(t, "GET", server.URL+"/api/sessions/a/transcript", "secret")
+	transcript := []string{}
+	if err := json.NewDecoder(response.Body).Decode(&transcript); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if len(transcript) != 1 {
+		t.Errorf("transcript=%v, want the connection", transcript)
+	}
+}
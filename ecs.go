@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const ecsVersion = "8.11.0"
+
+// ecsMapping describes how an event type is represented in the Elastic Common Schema.
+type ecsMapping struct {
+	category []string
+	types    []string
+	// outcome is used if the event has no accepted field
+	outcome string
+	// fields maps event fields to ECS fields, using dots for nesting
+	fields map[string]string
+	// encoded lists the mapped fields holding payloads in the event's encoding, which are mapped as text
+	encoded map[string]bool
+	// addresses maps address fields to the ECS field set getting their address and port
+	addresses map[string]string
+	// protocol overrides the default ssh network protocol
+	protocol string
+}
+
+var authECSFields = map[string]string{"user": "user.name"}
+
+// ecsMappings maps event types to ECS. Event fields not mapped end up under sshesame.
+var ecsMappings = map[string]ecsMapping{
+	"no_auth":                   {category: []string{"authentication"}, types: []string{"start"}, fields: authECSFields},
+	"password_auth":             {category: []string{"authentication"}, types: []string{"start"}, fields: authECSFields},
+	"public_key_auth":           {category: []string{"authentication"}, types: []string{"start"}, fields: authECSFields},
+	"keyboard_interactive_auth": {category: []string{"authentication"}, types: []string{"start"}, fields: authECSFields},
+	"connection": {
+		category: []string{"network", "session"},
+		types:    []string{"connection", "start"},
+		fields:   map[string]string{"client_version": "user_agent.original"},
+	},
+	"connection_close": {category: []string{"network", "session"}, types: []string{"connection", "end"}},
+	"session_summary": {
+		category: []string{"network", "session"},
+		types:    []string{"connection", "end"},
+		fields:   map[string]string{"bytes_in": "source.bytes", "bytes_out": "destination.bytes"},
+	},
+	"tcpip_forward": {
+		category:  []string{"network"},
+		types:     []string{"start"},
+		addresses: map[string]string{"address": "server"},
+	},
+	"cancel_tcpip_forward": {
+		category:  []string{"network"},
+		types:     []string{"end"},
+		addresses: map[string]string{"address": "server"},
+	},
+	"no_more_sessions": {category: []string{"session"}, types: []string{"info"}},
+	"host_keys_prove":  {category: []string{"session"}, types: []string{"info"}},
+	"session":          {category: []string{"session"}, types: []string{"start"}},
+	"session_close":    {category: []string{"session"}, types: []string{"end"}},
+	"session_input": {
+		category: []string{"process"},
+		types:    []string{"start"},
+		fields:   map[string]string{"input": "process.command_line"},
+		encoded:  map[string]bool{"input": true},
+	},
+	"direct_tcpip": {
+		category:  []string{"network"},
+		types:     []string{"connection", "start"},
+		addresses: map[string]string{"to": "destination"},
+	},
+	"direct_tcpip_close": {category: []string{"network"}, types: []string{"connection", "end"}},
+	"direct_tcpip_input": {category: []string{"network"}, types: []string{"info"}},
+	"smtp_auth": {
+		category: []string{"authentication", "email"},
+		types:    []string{"start"},
+		fields:   map[string]string{"username": "user.name"},
+		protocol: "smtp",
+	},
+	"smtp_message": {
+		category: []string{"email"},
+		types:    []string{"info"},
+		fields: map[string]string{
+			"from":    "email.from.address",
+			"to":      "email.to.address",
+			"subject": "email.subject",
+			"file":    "file.path",
+			"size":    "file.size",
+		},
+		protocol: "smtp",
+	},
+	"http_request": {
+		category: []string{"web"},
+		types:    []string{"access"},
+		fields: map[string]string{
+			"method":     "http.request.method",
+			"host":       "url.domain",
+			"uri":        "url.original",
+			"user_agent": "user_agent.original",
+			"body":       "http.request.body.content",
+			"username":   "user.name",
+			"status":     "http.response.status_code",
+		},
+		encoded:  map[string]bool{"body": true},
+		protocol: "http",
+	},
+	"imds_request": {
+		category: []string{"web"},
+		types:    []string{"access"},
+		fields: map[string]string{
+			"provider": "cloud.provider",
+			"method":   "http.request.method",
+			"path":     "url.path",
+			"status":   "http.response.status_code",
+		},
+		protocol: "http",
+	},
+	"imds_token": {
+		category: []string{"iam"},
+		types:    []string{"creation"},
+		fields:   map[string]string{"provider": "cloud.provider"},
+		protocol: "http",
+	},
+	"tcpip_auth": {
+		category: []string{"authentication"},
+		types:    []string{"start"},
+		fields:   map[string]string{"service": "network.protocol", "username": "user.name"},
+	},
+	"redis_command": {
+		category: []string{"database"},
+		types:    []string{"access"},
+		fields:   map[string]string{"command": "process.name", "args": "process.args"},
+		protocol: "redis",
+	},
+	"mysql_auth": {
+		category: []string{"authentication", "database"},
+		types:    []string{"start"},
+		fields:   map[string]string{"username": "user.name"},
+		protocol: "mysql",
+	},
+	"ftp_upload": {
+		category: []string{"file"},
+		types:    []string{"creation"},
+		fields: map[string]string{
+			"filename": "file.name",
+			"size":     "file.size",
+			"sha256":   "file.hash.sha256",
+			"file":     "file.path",
+		},
+		protocol: "ftp",
+	},
+	"pty":           {category: []string{"session"}, types: []string{"info"}},
+	"shell":         {category: []string{"process"}, types: []string{"start"}},
+	"exec":          {category: []string{"process"}, types: []string{"start"}, fields: map[string]string{"command": "process.command_line"}},
+	"x11":           {category: []string{"session"}, types: []string{"info"}},
+	"env":           {category: []string{"session"}, types: []string{"info"}},
+	"window_change": {category: []string{"session"}, types: []string{"info"}},
+	"subsystem": {
+		category: []string{"process"},
+		types:    []string{"start"},
+		fields:   map[string]string{"subsystem": "process.name"},
+	},
+	"debug_global_request":  {category: []string{"network"}, types: []string{"info"}},
+	"debug_channel":         {category: []string{"network"}, types: []string{"info"}},
+	"debug_channel_request": {category: []string{"network"}, types: []string{"info"}},
+}
+
+// setECSField sets a dotted field in a nested document.
+func setECSField(document map[string]interface{}, field string, value interface{}) {
+	names := strings.Split(field, ".")
+	for _, name := range names[:len(names)-1] {
+		child, ok := document[name].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			document[name] = child
+		}
+		document = child
+	}
+	document[names[len(names)-1]] = value
+}
+
+// ecsDocument maps an event, in its JSON form, to ECS.
+func ecsDocument(eventType string, event map[string]interface{}) map[string]interface{} {
+	mapping, ok := ecsMappings[eventType]
+	if !ok {
+		mapping = ecsMapping{category: []string{"session"}, types: []string{"info"}}
+	}
+	document := map[string]interface{}{
+		"ecs": map[string]interface{}{"version": ecsVersion},
+		"event": map[string]interface{}{
+			"kind":     "event",
+			"module":   "sshesame",
+			"action":   eventType,
+			"category": mapping.category,
+			"type":     mapping.types,
+		},
+		"network": map[string]interface{}{"transport": "tcp", "protocol": "ssh"},
+	}
+	if mapping.protocol != "" {
+		setECSField(document, "network.protocol", mapping.protocol)
+	}
+	if mapping.outcome != "" {
+		setECSField(document, "event.outcome", mapping.outcome)
+	}
+	for name, value := range event {
+		switch {
+		case name == "accepted":
+			if accepted, ok := value.(bool); ok && accepted {
+				setECSField(document, "event.outcome", "success")
+			} else {
+				setECSField(document, "event.outcome", "failure")
+			}
+		case mapping.fields[name] != "":
+			if text, ok := value.(string); ok && mapping.encoded[name] {
+				encoding, _ := event["encoding"].(string)
+				value = decodedText(text, encoding)
+			}
+			setECSField(document, mapping.fields[name], value)
+		case mapping.addresses[name] != "":
+			host, port := splitLoggedAddress(value)
+			setECSField(document, mapping.addresses[name]+".address", host)
+			setECSField(document, mapping.addresses[name]+".port", port)
+		default:
+			setECSField(document, "sshesame."+name, value)
+		}
+	}
+	return document
+}
+
+// ecs formats the record as an Elastic Common Schema document.
+func (record logRecord) ecs(timestamps bool) ([]byte, error) {
+	entryJSON, err := json.Marshal(record.entry)
+	if err != nil {
+		return nil, err
+	}
+	event := map[string]interface{}{}
+	if err := json.Unmarshal(entryJSON, &event); err != nil {
+		return nil, err
+	}
+	document := ecsDocument(record.entry.eventType(), event)
+	if timestamps {
+		document["@timestamp"] = record.time.UTC().Format(time.RFC3339Nano)
+	}
+	document["message"] = record.entry.String()
+	sourceIP, sourcePort := splitLoggedAddress(record.remoteAddr.String())
+	setECSField(document, "source.ip", sourceIP)
+	setECSField(document, "source.port", sourcePort)
+	if user, ok := document["user"].(map[string]interface{}); !ok || user["name"] == nil {
+		setECSField(document, "user.name", record.user)
+	}
+	setECSField(document, "sshesame.session_id", record.sessionID)
+	setECSField(document, "sshesame.connection_id", record.connectionID)
+	if record.channelID != "" {
+		setECSField(document, "sshesame.channel_id", record.channelID)
+	}
+	return json.Marshal(document)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReplayECS(t *testing.T) {
+	testFiles, err := filepath.Glob("replay_tests/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, testFile := range testFiles {
+		t.Run(strings.TrimSuffix(path.Base(testFile), path.Ext(testFile)), func(t *testing.T) {
+			testCaseBytes, err := os.ReadFile(testFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var testCase replayTest
+			if err := json.Unmarshal(testCaseBytes, &testCase); err != nil {
+				t.Fatal(err)
+			}
+			if len(testCase.ECSLogs) != len(testCase.JSONLogs) {
+				t.Fatalf("got %v ECS logs, want %v", len(testCase.ECSLogs), len(testCase.JSONLogs))
+			}
+			for i, jsonLog := range testCase.JSONLogs {
+				event, _ := jsonLog["event"].(map[string]interface{})
+				// Round trip through JSON so numbers and nested values compare equal
+				documentBytes, err := json.Marshal(ecsDocument(jsonLog["event_type"].(string), event))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var document map[string]interface{}
+				if err := json.Unmarshal(documentBytes, &document); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(document, testCase.ECSLogs[i]) {
+					t.Errorf("Log mismatch at line %d: got \n%v, want \n%v", i, document, testCase.ECSLogs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestECSRecord(t *testing.T) {
+	logFile := path.Join(t.TempDir(), "ecs.log")
+	cfg := &config{}
+	cfg.Logging.Sinks = []logSinkConfig{{Type: "file", Path: logFile, Format: "ecs", Timestamps: true}}
+	setupLogBuffer(t, cfg)
+	context := connContext{ConnMetadata: mockConnContext{}, cfg: cfg}
+	context.logEvent(execLog{Command: "cat /etc/passwd"})
+	context.logEvent(tcpipAuthLog{Service: "telnet", Username: "admin", Password: "hunter2"})
+	context.logEvent(tcpipAuthLog{Service: "ftp", Username: "anonymous", Password: "guest", Accepted: true})
+	cfg.logSinks.close()
+
+	logs := parseJSONLogs(t, readLogFile(t, logFile))
+	if len(logs) != 3 {
+		t.Fatalf("logs=%v, want 3", logs)
+	}
+	for _, field := range []string{"@timestamp", "message", "source", "sshesame"} {
+		if _, ok := logs[0][field]; !ok {
+			t.Errorf("log=%v, want %v", logs[0], field)
+		}
+	}
+	if source := logs[0]["source"].(map[string]interface{}); source["ip"] != "127.0.0.1" || source["port"] != 1234.0 {
+		t.Errorf("source=%v, want 127.0.0.1:1234", source)
+	}
+	if process := logs[0]["process"].(map[string]interface{}); process["command_line"] != "cat /etc/passwd" {
+		t.Errorf("process=%v, want the command", process)
+	}
+	if user := logs[0]["user"].(map[string]interface{}); user["name"] != "root" {
+		t.Errorf("user=%v, want the SSH user", user)
+	}
+	if user := logs[1]["user"].(map[string]interface{}); user["name"] != "admin" {
+		t.Errorf("user=%v, want the service user", user)
+	}
+	event := logs[1]["event"].(map[string]interface{})
+	network := logs[1]["network"].(map[string]interface{})
+	if event["outcome"] != "failure" || network["protocol"] != "telnet" {
+		t.Errorf("event=%v, network=%v, want a failed telnet login", event, network)
+	}
+	event = logs[2]["event"].(map[string]interface{})
+	if event["outcome"] != "success" {
+		t.Errorf("event=%v, want an accepted ftp login", event)
+	}
+}
+
+func TestECSDecodesPayloads(t *testing.T) {
+	for _, encoding := range []string{"base64", "hex", "text"} {
+		input, inputEncoding := encodePayload([]byte("cat /etc/passwd\r"), encoding)
+		document := ecsDocument("session_input", map[string]interface{}{"channel_id": 0.0, "input": input, "encoding": inputEncoding})
+		if process := document["process"].(map[string]interface{}); process["command_line"] != "cat /etc/passwd\r" {
+			t.Errorf("encoding=%v: process=%v, want the decoded input", encoding, process)
+		}
+		body, bodyEncoding := encodePayload([]byte("user=admin\xff"), encoding)
+		document = ecsDocument("http_request", map[string]interface{}{"channel_id": 0.0, "body": body, "encoding": bodyEncoding})
+		if request := document["http"].(map[string]interface{})["request"].(map[string]interface{}); request["body"].(map[string]interface{})["content"] != "user=admin\xff" {
+			t.Errorf("encoding=%v: request=%v, want the decoded body", encoding, request)
+		}
+	}
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type eventStoreConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Retention time.Duration `yaml:"retention"`
+}
+
+// eventStoreSegmentFormat names the segments of the store, one per UTC day.
+const eventStoreSegmentFormat = "2006-01-02"
+
+// eventStoreCompactionInterval is how often segments past the retention are removed.
+const eventStoreCompactionInterval = time.Hour
+
+// storedEvent is a line of an event store segment. It's the JSON log format plus the SSH user.
+type storedEvent struct {
+	Time         string      `json:"time"`
+	Source       string      `json:"source"`
+	User         string      `json:"user"`
+	ConnectionID string      `json:"connection_id"`
+	ChannelID    string      `json:"channel_id,omitempty"`
+	EventType    string      `json:"event_type"`
+	Event        interface{} `json:"event"`
+}
+
+// eventRef locates an event in the store.
+type eventRef struct {
+	segment string
+	offset  int64
+}
+
+// eventStoreIndexes are the fields events are indexed by, along with how to get them from a stored event.
+var eventStoreIndexes = map[string]func(event loggedEvent) string{
+	"source_ip": func(event loggedEvent) string {
+		host, _ := splitLoggedAddress(event.Source)
+		return host
+	},
+	"user":          func(event loggedEvent) string { return event.user() },
+	"event_type":    func(event loggedEvent) string { return event.EventType },
+	"connection_id": func(event loggedEvent) string { return event.ConnectionID },
+}
+
+// segmentIndex is the index of a segment as it's saved next to it.
+type segmentIndex struct {
+	// Size is how much of the segment is indexed. The events written after it are indexed when the store is opened.
+	Size    int64                         `json:"size"`
+	Indexes map[string]map[string][]int64 `json:"indexes"`
+}
+
+// eventStore persists events in daily append-only JSON segments in the data directory.
+// Events are indexed by the eventStoreIndexes fields and by time through their segment.
+// The index of each segment is saved next to it, so opening the store only reads the events written since.
+type eventStore struct {
+	dir       string
+	retention time.Duration
+
+	mutex   sync.Mutex
+	segment string
+	file    *os.File
+	indexes map[string]map[string][]eventRef
+	// indexed is how much of each segment is indexed, up to the end of its last complete event.
+	indexed map[string]int64
+	done    chan struct{}
+	// users counts the configs in effect and the connections using the store, which is closed once they're all done.
+	users int
+}
+
+// openEventStore opens the event store in a directory, loading the indexes of the events already stored.
+func openEventStore(dir string, retention time.Duration) (*eventStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	store := &eventStore{
+		dir:       dir,
+		retention: retention,
+		indexes:   map[string]map[string][]eventRef{},
+		indexed:   map[string]int64{},
+		done:      make(chan struct{}),
+		users:     1,
+	}
+	if err := store.compact(time.Now()); err != nil {
+		return nil, err
+	}
+	segments, err := store.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		if err := store.loadSegment(segment); err != nil {
+			return nil, err
+		}
+	}
+	done := store.done
+	go func() {
+		ticker := time.NewTicker(eventStoreCompactionInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if err := store.compact(now); err != nil {
+					warningLogger.Printf("Failed to compact event store: %v", err)
+				}
+				if err := store.checkpoint(); err != nil {
+					warningLogger.Printf("Failed to save event store index: %v", err)
+				}
+			}
+		}
+	}()
+	return store, nil
+}
+
+// segments lists the stored segments, oldest first.
+func (store *eventStore) segments() ([]string, error) {
+	files, err := filepath.Glob(path.Join(store.dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	segments := []string{}
+	for _, file := range files {
+		segment := strings.TrimSuffix(path.Base(file), ".jsonl")
+		if _, err := time.Parse(eventStoreSegmentFormat, segment); err == nil {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+func (store *eventStore) segmentFile(segment string) string {
+	return path.Join(store.dir, segment+".jsonl")
+}
+
+func (store *eventStore) indexFile(segment string) string {
+	return path.Join(store.dir, segment+".idx")
+}
+
+// scanSegment reads every event in a segment from an offset on, along with its offset.
+func (store *eventStore) scanSegment(segment string, offset int64, handle func(event loggedEvent, offset int64) error) error {
+	file, err := os.Open(store.segmentFile(segment))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) != 0 && line[len(line)-1] == '\n' {
+			event := loggedEvent{}
+			if jsonErr := json.Unmarshal(line, &event); jsonErr == nil {
+				event.line = line[:len(line)-1]
+				if err := handle(event, offset); err != nil {
+					return err
+				}
+			} else {
+				warningLogger.Printf("Skipping invalid event in %v at offset %v: %v", segment, offset, jsonErr)
+			}
+		}
+		// A partially written last line is ignored, and overwritten by the next event
+		offset += int64(len(line))
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func (store *eventStore) index(event loggedEvent, ref eventRef) {
+	for name, key := range eventStoreIndexes {
+		if value := key(event); value != "" {
+			store.addRef(name, value, ref)
+		}
+	}
+}
+
+func (store *eventStore) addRef(name string, value string, ref eventRef) {
+	if store.indexes[name] == nil {
+		store.indexes[name] = map[string][]eventRef{}
+	}
+	store.indexes[name][value] = append(store.indexes[name][value], ref)
+}
+
+// loadSegment indexes a segment from its saved index and the events written after it, saving the index if it changed.
+func (store *eventStore) loadSegment(segment string) error {
+	size := store.readIndex(segment)
+	indexed := size
+	if err := store.scanSegment(segment, size, func(event loggedEvent, offset int64) error {
+		store.index(event, eventRef{segment, offset})
+		indexed = offset + int64(len(event.line)) + 1
+		return nil
+	}); err != nil {
+		return err
+	}
+	store.indexed[segment] = indexed
+	if indexed != size {
+		// The store is also opened by the log subcommands, which may not be able to write to it
+		if err := store.saveIndex(segment); err != nil {
+			warningLogger.Printf("Failed to save the index of event store segment %v: %v", segment, err)
+		}
+	}
+	return nil
+}
+
+// readIndex adds the saved index of a segment to the indexes, returning how much of the segment it covers.
+// A missing or invalid index is ignored, so the whole segment is indexed again.
+func (store *eventStore) readIndex(segment string) int64 {
+	data, err := os.ReadFile(store.indexFile(segment))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			warningLogger.Printf("Failed to read the index of event store segment %v: %v", segment, err)
+		}
+		return 0
+	}
+	index := segmentIndex{}
+	if err := json.Unmarshal(data, &index); err != nil {
+		warningLogger.Printf("Ignoring invalid index of event store segment %v: %v", segment, err)
+		return 0
+	}
+	if info, err := os.Stat(store.segmentFile(segment)); err != nil || info.Size() < index.Size {
+		warningLogger.Printf("Ignoring outdated index of event store segment %v", segment)
+		return 0
+	}
+	for name, values := range index.Indexes {
+		for value, offsets := range values {
+			for _, offset := range offsets {
+				store.addRef(name, value, eventRef{segment, offset})
+			}
+		}
+	}
+	return index.Size
+}
+
+// saveIndex saves the index of a segment next to it, replacing the previous one at once.
+func (store *eventStore) saveIndex(segment string) error {
+	index := segmentIndex{Size: store.indexed[segment], Indexes: map[string]map[string][]int64{}}
+	for name, values := range store.indexes {
+		for value, refs := range values {
+			for _, ref := range refs {
+				if ref.segment != segment {
+					continue
+				}
+				if index.Indexes[name] == nil {
+					index.Indexes[name] = map[string][]int64{}
+				}
+				index.Indexes[name][value] = append(index.Indexes[name][value], ref.offset)
+			}
+		}
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	file := store.indexFile(segment)
+	if err := os.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// checkpoint saves the index of the segment being written.
+func (store *eventStore) checkpoint() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.file == nil {
+		return nil
+	}
+	return store.saveIndex(store.segment)
+}
+
+// stored returns the line storing a logged event.
+func (record logRecord) stored(timestamps bool) ([]byte, error) {
+	return json.Marshal(storedEvent{
+		Time:         record.time.UTC().Format(time.RFC3339Nano),
+		Source:       record.remoteAddr.String(),
+		User:         record.user,
+		ConnectionID: record.connectionID,
+		ChannelID:    record.channelID,
+		EventType:    record.entry.eventType(),
+		Event:        record.entry,
+	})
+}
+
+// parseStoredEvent reads back a stored event.
+func parseStoredEvent(line []byte) (loggedEvent, error) {
+	event := loggedEvent{}
+	if err := json.Unmarshal(line, &event); err != nil {
+		return loggedEvent{}, err
+	}
+	event.line = line
+	return event, nil
+}
+
+// add stores an event given as its stored line.
+func (store *eventStore) add(line []byte, event loggedEvent) error {
+	eventTime, err := time.Parse(time.RFC3339Nano, event.Time)
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.done == nil {
+		return errors.New("event store closed")
+	}
+	segment := eventTime.UTC().Format(eventStoreSegmentFormat)
+	if store.file == nil || segment != store.segment {
+		if err := store.openSegment(segment); err != nil {
+			return err
+		}
+	}
+	offset := store.indexed[segment]
+	if _, err := store.file.WriteAt(append(line, '\n'), offset); err != nil {
+		return err
+	}
+	store.index(event, eventRef{segment, offset})
+	store.indexed[segment] = offset + int64(len(line)) + 1
+	return nil
+}
+
+// openSegment switches writing to a segment, appending after its last complete event.
+func (store *eventStore) openSegment(segment string) error {
+	if store.file != nil {
+		store.file.Close()
+		store.file = nil
+		if err := store.saveIndex(store.segment); err != nil {
+			warningLogger.Printf("Failed to save the index of event store segment %v: %v", store.segment, err)
+		}
+	}
+	file, err := os.OpenFile(store.segmentFile(segment), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(store.indexed[segment]); err != nil {
+		file.Close()
+		return err
+	}
+	store.segment = segment
+	store.file = file
+	return nil
+}
+
+// compact removes the segments entirely past the retention, if any.
+func (store *eventStore) compact(now time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.retention <= 0 {
+		return nil
+	}
+	segments, err := store.segments()
+	if err != nil {
+		return err
+	}
+	removed := map[string]bool{}
+	for _, segment := range segments {
+		day, _ := time.Parse(eventStoreSegmentFormat, segment)
+		if !day.Add(24 * time.Hour).Before(now.Add(-store.retention)) {
+			continue
+		}
+		if segment == store.segment && store.file != nil {
+			store.file.Close()
+			store.file = nil
+		}
+		if err := os.Remove(store.segmentFile(segment)); err != nil {
+			return err
+		}
+		if err := os.Remove(store.indexFile(segment)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(store.indexed, segment)
+		removed[segment] = true
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	for _, index := range store.indexes {
+		for value, refs := range index {
+			kept := refs[:0]
+			for _, ref := range refs {
+				if !removed[ref.segment] {
+					kept = append(kept, ref)
+				}
+			}
+			if len(kept) == 0 {
+				delete(index, value)
+			} else {
+				index[value] = kept
+			}
+		}
+	}
+	return nil
+}
+
+// indexKeys returns the indexed values a filter requires.
+func (filter eventFilter) indexKeys() map[string]string {
+	keys := map[string]string{}
+	if filter.sourceIP != "" {
+		keys["source_ip"] = filter.sourceIP
+	}
+	if filter.user != "" {
+		keys["user"] = filter.user
+	}
+	if filter.connectionID != "" {
+		keys["connection_id"] = filter.connectionID
+	}
+	if len(filter.eventTypes) == 1 {
+		for eventType := range filter.eventTypes {
+			keys["event_type"] = eventType
+		}
+	}
+	return keys
+}
+
+// candidates returns the events matching the indexed values of a filter, or false if it has none.
+func (store *eventStore) candidates(filter eventFilter) ([]eventRef, bool) {
+	keys := filter.indexKeys()
+	if len(keys) == 0 {
+		return nil, false
+	}
+	var candidates []eventRef
+	first := true
+	for name, value := range keys {
+		refs := store.indexes[name][value]
+		if first {
+			candidates = append([]eventRef{}, refs...)
+			first = false
+			continue
+		}
+		matching := map[eventRef]bool{}
+		for _, ref := range refs {
+			matching[ref] = true
+		}
+		kept := candidates[:0]
+		for _, ref := range candidates {
+			if matching[ref] {
+				kept = append(kept, ref)
+			}
+		}
+		candidates = kept
+	}
+	return candidates, true
+}
+
+// query reads the stored events matching a filter, oldest first.
+func (store *eventStore) query(filter eventFilter, handle func(event loggedEvent) error) error {
+	store.mutex.Lock()
+	candidates, indexed := store.candidates(filter)
+	store.mutex.Unlock()
+	if !indexed {
+		segments, err := store.segments()
+		if err != nil {
+			return err
+		}
+		for _, segment := range segments {
+			if !filter.includesDay(segment) {
+				continue
+			}
+			if err := store.scanSegment(segment, 0, func(event loggedEvent, offset int64) error {
+				if !filter.matches(event) {
+					return nil
+				}
+				return handle(event)
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	files := map[string]*os.File{}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, ref := range candidates {
+		if !filter.includesDay(ref.segment) {
+			continue
+		}
+		file, ok := files[ref.segment]
+		if !ok {
+			var err error
+			if file, err = os.Open(store.segmentFile(ref.segment)); err != nil {
+				return err
+			}
+			files[ref.segment] = file
+		}
+		if _, err := file.Seek(ref.offset, io.SeekStart); err != nil {
+			return err
+		}
+		line, err := bufio.NewReader(file).ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		event := loggedEvent{}
+		if err := json.Unmarshal(line, &event); err != nil {
+			return err
+		}
+		event.line = line[:len(line)-1]
+		if !filter.matches(event) {
+			continue
+		}
+		if err := handle(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// includesDay returns whether the time range of the filter overlaps a segment's day.
+func (filter eventFilter) includesDay(segment string) bool {
+	day, err := time.Parse(eventStoreSegmentFormat, segment)
+	if err != nil {
+		return false
+	}
+	return (filter.since.IsZero() || day.Add(24*time.Hour).After(filter.since)) && (filter.until.IsZero() || day.Before(filter.until))
+}
+
+func (store *eventStore) setRetention(retention time.Duration) {
+	store.mutex.Lock()
+	store.retention = retention
+	store.mutex.Unlock()
+	if err := store.compact(time.Now()); err != nil {
+		warningLogger.Printf("Failed to compact event store: %v", err)
+	}
+}
+
+// storedEventSink writes the events queued for the event store and the dashboard, which share the stored line of each event.
+// It keeps the store open until the queue is closed, so the queued events are written even if a reload releases the store.
+type storedEventSink struct {
+	store     *eventStore
+	dashboard *dashboard
+}
+
+func newStoredEventQueue(store *eventStore, dashboard *dashboard) *logSinkQueue {
+	if store != nil {
+		store.acquire()
+	}
+	queue := newLogSinkQueue("events", storedEventSink{store, dashboard}, singleLogDocument(logRecord.stored), false, defaultLogSinkQueueSize)
+	go queue.run()
+	return queue
+}
+
+func (sink storedEventSink) write(record logRecord, data []byte) error {
+	event, err := parseStoredEvent(data)
+	if err != nil {
+		return err
+	}
+	if sink.store != nil {
+		if err := sink.store.add(data, event); err != nil {
+			return err
+		}
+	}
+	if sink.dashboard != nil {
+		return sink.dashboard.add(event, string(record.plain(true)))
+	}
+	return nil
+}
+
+func (sink storedEventSink) close() error {
+	if sink.store != nil {
+		sink.store.release()
+	}
+	return nil
+}
+
+// acquire keeps the store open until a matching release.
+func (store *eventStore) acquire() {
+	store.mutex.Lock()
+	store.users++
+	store.mutex.Unlock()
+}
+
+// release closes the store once it's no longer used.
+func (store *eventStore) release() {
+	store.mutex.Lock()
+	store.users--
+	unused := store.users == 0
+	store.mutex.Unlock()
+	if unused {
+		if err := store.close(); err != nil {
+			warningLogger.Printf("Failed to close event store: %v", err)
+		}
+	}
+}
+
+func (store *eventStore) close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.done != nil {
+		close(store.done)
+		store.done = nil
+	}
+	if store.file == nil {
+		return nil
+	}
+	err := store.file.Close()
+	store.file = nil
+	if indexErr := store.saveIndex(store.segment); err == nil {
+		err = indexErr
+	}
+	return err
+}
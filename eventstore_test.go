@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testStoredRecord(eventTime time.Time, ip string, user string, connectionID string, entry logEntry) logRecord {
+	return logRecord{
+		time:         eventTime,
+		remoteAddr:   &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234},
+		user:         user,
+		connectionID: connectionID,
+		entry:        entry,
+	}
+}
+
+// addStoredRecord stores a record as the event queue does.
+func addStoredRecord(t *testing.T, store *eventStore, record logRecord) {
+	t.Helper()
+	line, err := record.stored(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (storedEventSink{store: store}).write(record, line); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func queryStore(t *testing.T, store *eventStore, filter eventFilter) []string {
+	t.Helper()
+	events := []string{}
+	if err := store.query(filter, func(event loggedEvent) error {
+		events = append(events, event.ConnectionID+" "+event.EventType)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestEventStore(t *testing.T) {
+	dir := path.Join(t.TempDir(), "events")
+	store, err := openEventStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day1 := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	for _, record := range []logRecord{
+		testStoredRecord(day1, "192.0.2.1", "root", "a", connectionLog{ClientVersion: "SSH-2.0-Go"}),
+		testStoredRecord(day1.Add(time.Second), "192.0.2.1", "root", "a", passwordAuthLog{authLog: authLog{User: "root"}, Password: "123456"}),
+		testStoredRecord(day2, "192.0.2.1", "admin", "b", connectionLog{ClientVersion: "SSH-2.0-Go"}),
+		testStoredRecord(day2.Add(time.Second), "192.0.2.1", "admin", "b", execLog{Command: "uname -a"}),
+		testStoredRecord(day2.Add(2*time.Second), "198.51.100.7", "root", "c", connectionLog{ClientVersion: "SSH-2.0-Go"}),
+	} {
+		addStoredRecord(t, store, record)
+	}
+
+	tests := []struct {
+		filter         eventFilter
+		expectedEvents []string
+	}{
+		{eventFilter{sourceIP: "192.0.2.1", eventTypes: map[string]bool{"connection": true}}, []string{"a connection", "b connection"}},
+		{eventFilter{user: "root"}, []string{"a connection", "a password_auth", "c connection"}},
+		{eventFilter{connectionID: "b"}, []string{"b connection", "b exec"}},
+		{eventFilter{since: day2}, []string{"b connection", "b exec", "c connection"}},
+		{eventFilter{eventTypes: map[string]bool{"exec": true, "password_auth": true}}, []string{"a password_auth", "b exec"}},
+	}
+	for _, test := range tests {
+		if events := queryStore(t, store, test.filter); !reflect.DeepEqual(events, test.expectedEvents) {
+			t.Errorf("query(%+v)=%v, want %v", test.filter, events, test.expectedEvents)
+		}
+	}
+	if err := store.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The indexes are saved next to the segments
+	index := segmentIndex{}
+	indexData, err := os.ReadFile(path.Join(dir, "2026-01-02.idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(indexData, &index); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path.Join(dir, "2026-01-02.jsonl")); err != nil || info.Size() != index.Size {
+		t.Errorf("index size=%v, want the size of the segment", index.Size)
+	}
+
+	// Events written after the saved index are indexed and a partially written event is dropped when reopening
+	segmentFile, err := os.OpenFile(path.Join(dir, "2026-01-02.jsonl"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segmentFile.WriteString(`{"time":"2026-01-02T10:30:00Z","source":"198.51.100.7:1234","user":"root","connection_id":"e","event_type":"connection","event":{}}` + "\n")
+	segmentFile.WriteString(`{"time":"2026-01-02T11:00:00Z","sou`)
+	segmentFile.Close()
+	store, err = openEventStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	addStoredRecord(t, store, testStoredRecord(day2.Add(time.Hour), "198.51.100.7", "root", "d", connectionLog{}))
+	if events := queryStore(t, store, eventFilter{user: "root"}); !reflect.DeepEqual(events, []string{"a connection", "a password_auth", "c connection", "e connection", "d connection"}) {
+		t.Errorf("events=%v, want the stored root events", events)
+	}
+
+	store.retention = 48 * time.Hour
+	if err := store.compact(day2.Add(60 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if events := queryStore(t, store, eventFilter{}); !reflect.DeepEqual(events, []string{"b connection", "b exec", "c connection", "e connection", "d connection"}) {
+		t.Errorf("events=%v, want the first day compacted", events)
+	}
+	if events := queryStore(t, store, eventFilter{connectionID: "a"}); len(events) != 0 {
+		t.Errorf("events=%v, want the first day removed from the indexes", events)
+	}
+	if _, err := os.Stat(path.Join(dir, "2026-01-01.idx")); !os.IsNotExist(err) {
+		t.Errorf("the index of the first day wasn't removed: %v", err)
+	}
+}
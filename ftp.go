@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ftpMaxUploadSize   = 10 << 20
+	ftpMaxLineLength   = 4096
+	ftpDataConnTimeout = 10 * time.Second
+)
+
+// ftpDataConn is a data connection handed over by the direct-tcpip channel that opened it.
+type ftpDataConn struct {
+	readWriter io.ReadWriter
+	done       chan<- struct{}
+}
+
+// ftpPassiveListener waits for a data connection on a port announced with PASV or EPSV.
+type ftpPassiveListener struct {
+	conns  chan ftpDataConn
+	closed chan struct{}
+}
+
+var (
+	ftpPassiveListeners      = map[string]*ftpPassiveListener{}
+	ftpPassiveListenersMutex sync.Mutex
+)
+
+func ftpPassiveListenerKey(context channelContext, port uint32) string {
+	return fmt.Sprintf("%x:%v", context.SessionID(), port)
+}
+
+// getFTPPassiveListener returns the listener a direct-tcpip channel to the given port should be handed to, if any.
+func getFTPPassiveListener(context channelContext, port uint32) *ftpPassiveListener {
+	ftpPassiveListenersMutex.Lock()
+	defer ftpPassiveListenersMutex.Unlock()
+	return ftpPassiveListeners[ftpPassiveListenerKey(context, port)]
+}
+
+// ftpDataServer serves a direct-tcpip channel by handing it over to the FTP session waiting for it.
+type ftpDataServer struct {
+	listener *ftpPassiveListener
+}
+
+func (server ftpDataServer) serve(context channelContext, readWriter io.ReadWriter, input chan<- string) {
+	done := make(chan struct{})
+	select {
+	case server.listener.conns <- ftpDataConn{readWriter, done}:
+		<-done
+	case <-server.listener.closed:
+	}
+}
+
+type ftpSession struct {
+	context  channelContext
+	writer   io.Writer
+	username string
+	loggedIn bool
+	cwd      string
+	listener *ftpPassiveListener
+	port     uint32
+}
+
+func (session *ftpSession) reply(code int, message string) error {
+	_, err := fmt.Fprintf(session.writer, "%d %s\r\n", code, message)
+	return err
+}
+
+func (session *ftpSession) closeListener() {
+	if session.listener == nil {
+		return
+	}
+	ftpPassiveListenersMutex.Lock()
+	delete(ftpPassiveListeners, ftpPassiveListenerKey(session.context, session.port))
+	ftpPassiveListenersMutex.Unlock()
+	close(session.listener.closed)
+	session.listener = nil
+}
+
+func (session *ftpSession) listen() uint32 {
+	session.closeListener()
+	session.listener = &ftpPassiveListener{make(chan ftpDataConn), make(chan struct{})}
+	ftpPassiveListenersMutex.Lock()
+	defer ftpPassiveListenersMutex.Unlock()
+	for {
+		session.port = uint32(30000 + rand.Intn(10000))
+		key := ftpPassiveListenerKey(session.context, session.port)
+		if _, ok := ftpPassiveListeners[key]; !ok {
+			ftpPassiveListeners[key] = session.listener
+			return session.port
+		}
+	}
+}
+
+// dataConn waits for the client to open the data connection announced by the last PASV or EPSV.
+func (session *ftpSession) dataConn() (ftpDataConn, bool) {
+	if session.listener == nil {
+		return ftpDataConn{}, false
+	}
+	defer session.closeListener()
+	select {
+	case conn := <-session.listener.conns:
+		return conn, true
+	case <-time.After(ftpDataConnTimeout):
+		return ftpDataConn{}, false
+	}
+}
+
+func (session *ftpSession) store(filename string) error {
+	conn, ok := session.dataConn()
+	if !ok {
+		return session.reply(425, "Use PORT or PASV first.")
+	}
+	if err := session.reply(150, "Ok to send data."); err != nil {
+		close(conn.done)
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(conn.readWriter, ftpMaxUploadSize))
+	close(conn.done)
+	if err != nil {
+		warningLogger.Printf("Error reading upload: %v", err)
+		return session.reply(426, "Failure reading network stream.")
+	}
+	file := ""
+	if session.context.cfg.artifacts != nil {
+		file, err = session.context.cfg.artifacts.save("ftp", session.context.connectionID(), "", data)
+		if err != nil {
+			warningLogger.Printf("Error saving upload: %v", err)
+		}
+	}
+	session.context.logEvent(ftpUploadLog{
+		channelLog: channelLog{ChannelID: session.context.channelID},
+		Filename:   path.Join(session.cwd, filename),
+		Size:       len(data),
+		SHA256:     fmt.Sprintf("%x", sha256.Sum256(data)),
+		File:       file,
+	})
+	return session.reply(226, "Transfer complete.")
+}
+
+func (session *ftpSession) list() error {
+	conn, ok := session.dataConn()
+	if !ok {
+		return session.reply(425, "Use PORT or PASV first.")
+	}
+	close(conn.done)
+	if err := session.reply(150, "Here comes the directory listing."); err != nil {
+		return err
+	}
+	return session.reply(226, "Directory send OK.")
+}
+
+func (session *ftpSession) handle(command string, arg string) (bool, error) {
+	if !session.loggedIn && command != "USER" && command != "PASS" && command != "QUIT" && command != "FEAT" && command != "AUTH" {
+		return false, session.reply(530, "Please login with USER and PASS.")
+	}
+	switch command {
+	case "USER":
+		session.username = arg
+		session.loggedIn = false
+		return false, session.reply(331, "Please specify the password.")
+	case "PASS":
+		if session.username == "" {
+			return false, session.reply(503, "Login with USER first.")
+		}
+		session.loggedIn = true
+		session.context.logEvent(tcpipAuthLog{
+			channelLog: channelLog{ChannelID: session.context.channelID},
+			Service:    "ftp",
+			Username:   session.username,
+			Password:   arg,
+			Accepted:   true,
+		})
+		return false, session.reply(230, "Login successful.")
+	case "AUTH":
+		return false, session.reply(530, "Please login with USER and PASS.")
+	case "FEAT":
+		_, err := fmt.Fprint(session.writer, "211-Features:\r\n EPSV\r\n PASV\r\n SIZE\r\n UTF8\r\n211 End\r\n")
+		return false, err
+	case "SYST":
+		return false, session.reply(215, "UNIX Type: L8")
+	case "PWD", "XPWD":
+		return false, session.reply(257, fmt.Sprintf("%q is the current directory", session.cwd))
+	case "CWD", "XCWD":
+		session.cwd = path.Join(session.cwd, arg)
+		if path.IsAbs(arg) {
+			session.cwd = path.Clean(arg)
+		}
+		return false, session.reply(250, "Directory successfully changed.")
+	case "CDUP":
+		session.cwd = path.Dir(session.cwd)
+		return false, session.reply(250, "Directory successfully changed.")
+	case "TYPE":
+		return false, session.reply(200, "Switching to Binary mode.")
+	case "MODE", "STRU", "OPTS", "MKD", "DELE", "RMD", "SITE":
+		return false, session.reply(200, "Command okay.")
+	case "NOOP":
+		return false, session.reply(200, "NOOP ok.")
+	case "PASV":
+		port := session.listen()
+		return false, session.reply(227, fmt.Sprintf("Entering Passive Mode (127,0,0,1,%d,%d).", port>>8, port&0xff))
+	case "EPSV":
+		port := session.listen()
+		return false, session.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+	case "PORT", "EPRT":
+		// Active mode would need the server to connect back to the client, which a forwarded port cannot do
+		session.closeListener()
+		return false, session.reply(200, "PORT command successful. Consider using PASV.")
+	case "STOR", "STOU", "APPE":
+		return false, session.store(arg)
+	case "LIST", "NLST", "MLSD":
+		return false, session.list()
+	case "RETR", "SIZE", "MDTM":
+		return false, session.reply(550, "Failed to open file.")
+	case "QUIT":
+		return true, session.reply(221, "Goodbye.")
+	default:
+		warningLogger.Printf("Unknown FTP command: %v", command)
+		return false, session.reply(500, "Unknown command.")
+	}
+}
+
+type ftpServer struct{}
+
+func (ftpServer) serve(context channelContext, readWriter io.ReadWriter, input chan<- string) {
+	session := &ftpSession{context: context, writer: readWriter, cwd: "/"}
+	defer session.closeListener()
+	if err := session.reply(220, "(vsFTPd 3.0.3)"); err != nil {
+		warningLogger.Printf("Error writing greeting: %v", err)
+		return
+	}
+	reader := bufio.NewReader(readWriter)
+	for {
+		line, err := readLimitedLine(reader, ftpMaxLineLength)
+		if errors.Is(err, errLineTooLong) {
+			if err := session.reply(500, "Input line too long."); err != nil {
+				warningLogger.Printf("Error writing reply: %v", err)
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				warningLogger.Printf("Error reading command: %v", err)
+			}
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+		input <- line
+		command, arg, _ := strings.Cut(line, " ")
+		quit, err := session.handle(strings.ToUpper(command), arg)
+		if err != nil {
+			warningLogger.Printf("Error writing reply: %v", err)
+			return
+		}
+		if quit {
+			return
+		}
+	}
+}
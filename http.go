@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+)
+
+const httpMaxBodySize = 1 << 20
+
+// httpMaxDiscardSize caps how much of a body past httpMaxBodySize is skipped to keep the connection alive.
+const httpMaxDiscardSize = 4 << 20
+
+type httpRouteConfig struct {
+	Method   string            `yaml:"method"`
+	Host     string            `yaml:"host"`
+	Path     string            `yaml:"path"`
+	Status   int               `yaml:"status"`
+	Headers  map[string]string `yaml:"headers"`
+	Body     string            `yaml:"body"`
+	BodyFile string            `yaml:"body_file"`
+	Template bool              `yaml:"template"`
+	App      string            `yaml:"app"`
+}
+
+type httpServiceConfig struct {
+	Routes []httpRouteConfig `yaml:"routes"`
+}
+
+var defaultHTTPRoutes = []httpRouteConfig{
+	{Path: "/admin/", App: "admin_login"},
+	{Path: "/cgi-bin/luci/", App: "router"},
+	{Host: "169.254.169.254", Path: "/", App: "cloud_metadata"},
+}
+
+// httpApps are the built-in fake web applications routes can point to.
+var httpApps = map[string]http.Handler{
+	"admin_login":    http.HandlerFunc(adminLoginApp),
+	"router":         http.HandlerFunc(routerApp),
+	"cloud_metadata": imdsHandler{},
+}
+
+type httpTemplateData struct {
+	Request  *http.Request
+	Hostname string
+}
+
+// httpRoute serves a static or templated response defined in the config.
+type httpRoute struct {
+	status   int
+	headers  map[string]string
+	body     []byte
+	template *template.Template
+}
+
+func newHTTPRoute(routeConfig httpRouteConfig) (http.Handler, error) {
+	if routeConfig.App != "" {
+		app := httpApps[routeConfig.App]
+		if app == nil {
+			return nil, fmt.Errorf("unknown HTTP app %q", routeConfig.App)
+		}
+		return app, nil
+	}
+	route := httpRoute{
+		status:  routeConfig.Status,
+		headers: routeConfig.Headers,
+		body:    []byte(routeConfig.Body),
+	}
+	if route.status == 0 {
+		route.status = http.StatusOK
+	}
+	if routeConfig.BodyFile != "" {
+		body, err := os.ReadFile(routeConfig.BodyFile)
+		if err != nil {
+			return nil, err
+		}
+		route.body = body
+	}
+	if routeConfig.Template {
+		var err error
+		route.template, err = template.New(routeConfig.Path).Parse(string(route.body))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return route, nil
+}
+
+func (route httpRoute) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	for name, value := range route.headers {
+		writer.Header().Set(name, value)
+	}
+	body := route.body
+	if route.template != nil {
+		buffer := &bytes.Buffer{}
+		if err := route.template.Execute(buffer, httpTemplateData{request, globalHostname}); err != nil {
+			warningLogger.Printf("Error executing template: %v", err)
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body = buffer.Bytes()
+	}
+	writer.WriteHeader(route.status)
+	writer.Write(body)
+}
+
+// newHTTPMux builds the router for the configured routes, turning pattern conflicts into errors.
+func newHTTPMux(routes []httpRouteConfig) (mux *http.ServeMux, err error) {
+	mux = http.NewServeMux()
+	defer func() {
+		if r := recover(); r != nil {
+			mux, err = nil, fmt.Errorf("invalid HTTP route: %v", r)
+		}
+	}()
+	for _, routeConfig := range routes {
+		handler, err := newHTTPRoute(routeConfig)
+		if err != nil {
+			return nil, err
+		}
+		pattern := routeConfig.Path
+		if pattern == "" {
+			pattern = "/"
+		}
+		pattern = routeConfig.Host + pattern
+		if routeConfig.Method != "" {
+			pattern = fmt.Sprintf("%v %v", strings.ToUpper(routeConfig.Method), pattern)
+		}
+		mux.Handle(pattern, handler)
+	}
+	return mux, nil
+}
+
+// httpResponseRecorder collects the response of a handler so it can be written to the channel.
+type httpResponseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (recorder *httpResponseRecorder) Header() http.Header {
+	return recorder.header
+}
+
+func (recorder *httpResponseRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return recorder.body.Write(data)
+}
+
+func (recorder *httpResponseRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+}
+
+var (
+	httpUsernameFields = []string{"username", "user", "login", "email", "uname", "name", "user_name", "usr"}
+	httpPasswordFields = []string{"password", "pass", "passwd", "pwd", "secret", "user_password"}
+)
+
+// extractCredentials looks for credentials in basic auth and in form or JSON bodies.
+func (httpServer) extractCredentials(request *http.Request, body []byte) (string, string) {
+	if username, password, ok := request.BasicAuth(); ok {
+		return username, password
+	}
+	fields := url.Values{}
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		fields, _ = url.ParseQuery(string(body))
+	case "application/json":
+		var jsonFields map[string]interface{}
+		if err := json.Unmarshal(body, &jsonFields); err == nil {
+			for name, value := range jsonFields {
+				if stringValue, ok := value.(string); ok {
+					fields.Set(name, stringValue)
+				}
+			}
+		}
+	}
+	for name, values := range request.URL.Query() {
+		if _, ok := fields[name]; !ok {
+			fields[name] = values
+		}
+	}
+	find := func(names []string) string {
+		for _, name := range names {
+			for field := range fields {
+				if strings.EqualFold(field, name) {
+					return fields.Get(field)
+				}
+			}
+		}
+		return ""
+	}
+	return find(httpUsernameFields), find(httpPasswordFields)
+}
+
+func (server httpServer) logRequest(context channelContext, request *http.Request, body []byte, status int) {
+	headers := map[string]string{}
+	for name, values := range request.Header {
+		headers[name] = strings.Join(values, ", ")
+	}
+	cookies := map[string]string{}
+	for _, cookie := range request.Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+	username, password := server.extractCredentials(request, body)
+	encodedBody, encoding := encodePayload(body, context.cfg.Logging.PayloadEncoding)
+	context.logEvent(httpRequestLog{
+		channelLog: channelLog{ChannelID: context.channelID},
+		Method:     request.Method,
+		Host:       request.Host,
+		URI:        request.RequestURI,
+		UserAgent:  request.UserAgent(),
+		Headers:    headers,
+		Cookies:    cookies,
+		Body:       encodedBody,
+		Encoding:   encoding,
+		Username:   username,
+		Password:   password,
+		Status:     status,
+	})
+}
+
+// channelContextKey attaches the channelContext to requests, so handlers can log events.
+type channelContextKey struct{}
+
+// routesHandler serves requests matching one of the configured routes and leaves the rest to the default 404.
+type routesHandler struct {
+	mux *http.ServeMux
+}
+
+func (handler routesHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if _, pattern := handler.mux.Handler(request); pattern != "" {
+		handler.mux.ServeHTTP(writer, request)
+	}
+}
+
+type httpServer struct{}
+
+func (server httpServer) serve(context channelContext, readWriter io.ReadWriter, input chan<- string) {
+	var handler http.Handler
+	if context.cfg.httpMux != nil {
+		handler = routesHandler{context.cfg.httpMux}
+	}
+	server.serveHandler(context, readWriter, handler)
+}
+
+func (server httpServer) serveHandler(context channelContext, readWriter io.ReadWriter, handler http.Handler) {
+	reader := bufio.NewReader(readWriter)
+	for {
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF {
+				warningLogger.Printf("读取请求时出错:%v", err)
+			}
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(request.Body, httpMaxBodySize))
+		if err != nil {
+			warningLogger.Printf("读取请求正文时出错:%v", err)
+			return
+		}
+		// The rest of a larger body is skipped so the next request is read from its start
+		discarded, err := io.Copy(io.Discard, io.LimitReader(request.Body, httpMaxDiscardSize+1))
+		if err != nil {
+			warningLogger.Printf("读取请求正文时出错:%v", err)
+			return
+		}
+		closeConn := discarded > httpMaxDiscardSize
+		request.Body = io.NopCloser(bytes.NewReader(body))
+		request = request.WithContext(gocontext.WithValue(request.Context(), channelContextKey{}, context))
+		recorder := &httpResponseRecorder{header: http.Header{}}
+		if handler != nil {
+			handler.ServeHTTP(recorder, request)
+		}
+		if recorder.status == 0 {
+			recorder.status = http.StatusNotFound
+		}
+		server.logRequest(context, request, body, recorder.status)
+		response := &http.Response{
+			StatusCode:    recorder.status,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        recorder.header,
+			Body:          io.NopCloser(&recorder.body),
+			ContentLength: int64(recorder.body.Len()),
+			Close:         closeConn,
+		}
+		responseBytes, err := httputil.DumpResponse(response, request.Method != http.MethodHead)
+		if err != nil {
+			warningLogger.Printf("转储请求时出错:%v", err)
+			return
+		}
+		_, err = readWriter.Write(responseBytes)
+		if err != nil {
+			warningLogger.Printf("写请求时出错:%v", err)
+			return
+		}
+		if request.Close || closeConn {
+			return
+		}
+	}
+}
+
+const adminLoginPage = `<!DOCTYPE html>
+<html>
+<head><title>Administration</title></head>
+<body>
+<h2>Administrator Login</h2>
+%v<form method="POST">
+<p>Username: <input type="text" name="username"></p>
+<p>Password: <input type="password" name="password"></p>
+<p><input type="submit" value="Login"></p>
+</form>
+</body>
+</html>
+`
+
+func adminLoginApp(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Header().Set("Server", "Apache/2.4.41 (Ubuntu)")
+	if request.Method == http.MethodPost {
+		writer.WriteHeader(http.StatusOK)
+		fmt.Fprintf(writer, adminLoginPage, "<p style=\"color:red\">Invalid username or password.</p>\n")
+		return
+	}
+	fmt.Fprintf(writer, adminLoginPage, "")
+}
+
+func routerApp(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Server", "httpd")
+	if _, _, ok := request.BasicAuth(); !ok {
+		writer.Header().Set("WWW-Authenticate", `Basic realm="Wireless Router"`)
+		writer.Header().Set("Content-Type", "text/html")
+		writer.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(writer, "<html><head><title>401 Unauthorized</title></head><body><h1>401 Unauthorized</h1></body></html>\n")
+		return
+	}
+	writer.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(writer, `<html>
+<head><title>Wireless Router</title></head>
+<body>
+<h3>Status</h3>
+<table>
+<tr><td>Firmware Version:</td><td>3.16.9 Build 150310 Rel.52653n</td></tr>
+<tr><td>Hardware Version:</td><td>WR841N v9 00000000</td></tr>
+<tr><td>Device Name:</td><td>%v</td></tr>
+<tr><td>WAN IP Address:</td><td>0.0.0.0</td></tr>
+</table>
+</body>
+</html>
+`, globalHostname)
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type imdsServiceConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	Provider        string `yaml:"provider"`
+	Region          string `yaml:"region"`
+	RoleName        string `yaml:"role_name"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	RequireToken    bool   `yaml:"require_token"`
+}
+
+var imdsProviders = map[string]bool{
+	"aws":   true,
+	"gcp":   true,
+	"azure": true,
+}
+
+// imdsHosts are the addresses attackers use to reach the instance metadata service.
+var imdsHosts = map[string]bool{
+	"169.254.169.254":          true,
+	"metadata.google.internal": true,
+	"metadata":                 true,
+}
+
+// imdsPersona is the fake instance described by the metadata service.
+// All values are derived from the hostname, so they stay consistent across connections and restarts with the same hostname.
+type imdsPersona struct {
+	provider        string
+	hostname        string
+	region          string
+	zone            string
+	instanceID      string
+	instanceType    string
+	imageID         string
+	accountID       string
+	localIPv4       string
+	publicIPv4      string
+	mac             string
+	roleName        string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	projectID       string
+	vmID            string
+	requireToken    bool
+}
+
+func newIMDSPersona(cfg imdsServiceConfig) imdsPersona {
+	provider := cfg.Provider
+	if provider == "" {
+		provider = "aws"
+	}
+	seed := sha256.Sum256([]byte(globalHostname))
+	random := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(seed[:8]))))
+	randomString := func(alphabet string, length int) string {
+		result := make([]byte, length)
+		for i := range result {
+			result[i] = alphabet[random.Intn(len(alphabet))]
+		}
+		return string(result)
+	}
+	const (
+		digits      = "0123456789"
+		hexDigits   = "0123456789abcdef"
+		upper       = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+		base64Chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+	)
+	persona := imdsPersona{
+		provider:        provider,
+		hostname:        globalHostname,
+		region:          cfg.Region,
+		instanceID:      "i-0" + randomString(hexDigits, 16),
+		instanceType:    "t2.micro",
+		imageID:         "ami-0" + randomString(hexDigits, 16),
+		accountID:       randomString(digits, 12),
+		localIPv4:       fmt.Sprintf("172.31.%d.%d", random.Intn(64), 2+random.Intn(250)),
+		publicIPv4:      fmt.Sprintf("54.%d.%d.%d", 144+random.Intn(100), random.Intn(256), 1+random.Intn(254)),
+		mac:             fmt.Sprintf("0a:%v:%v:%v:%v:%v", randomString(hexDigits, 2), randomString(hexDigits, 2), randomString(hexDigits, 2), randomString(hexDigits, 2), randomString(hexDigits, 2)),
+		roleName:        cfg.RoleName,
+		accessKeyID:     cfg.AccessKeyID,
+		secretAccessKey: cfg.SecretAccessKey,
+		sessionToken:    "IQoJb3JpZ2luX2VjE" + randomString(base64Chars, 300),
+		projectID:       "prod-" + randomString(hexDigits, 6),
+		requireToken:    cfg.RequireToken,
+	}
+	vmID := randomString(hexDigits, 32)
+	persona.vmID = fmt.Sprintf("%v-%v-%v-%v-%v", vmID[:8], vmID[8:12], vmID[12:16], vmID[16:20], vmID[20:])
+	if persona.region == "" {
+		persona.region = "us-east-1"
+	}
+	persona.zone = persona.region + "a"
+	if persona.roleName == "" {
+		persona.roleName = "ec2-admin-role"
+	}
+	if persona.accessKeyID == "" {
+		persona.accessKeyID = "ASIA" + randomString(upper, 16)
+	}
+	if persona.secretAccessKey == "" {
+		persona.secretAccessKey = randomString(base64Chars, 40)
+	}
+	return persona
+}
+
+type imdsResponse struct {
+	status      int
+	contentType string
+	body        string
+	// tokenType and token are set when the response hands out a credential
+	tokenType string
+	token     string
+}
+
+func imdsText(body string) imdsResponse {
+	return imdsResponse{status: http.StatusOK, contentType: "text/plain", body: body}
+}
+
+func imdsJSON(value interface{}) imdsResponse {
+	body, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return imdsResponse{status: http.StatusInternalServerError}
+	}
+	return imdsResponse{status: http.StatusOK, contentType: "application/json", body: string(body)}
+}
+
+var imdsNotFound = imdsResponse{
+	status:      http.StatusNotFound,
+	contentType: "text/html",
+	body:        "<?xml version=\"1.0\" encoding=\"iso-8859-1\"?>\n<html><head><title>404 - Not Found</title></head><body><h1>404 - Not Found</h1></body></html>\n",
+}
+
+func (persona imdsPersona) aws(request *http.Request) imdsResponse {
+	path := strings.TrimSuffix(request.URL.Path, "/")
+	if path == "/latest/api/token" {
+		if request.Method != http.MethodPut {
+			return imdsResponse{status: http.StatusMethodNotAllowed}
+		}
+		if request.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+			return imdsResponse{status: http.StatusBadRequest}
+		}
+		token := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%v:%v", persona.instanceID, time.Now().UnixNano())))
+		response := imdsText(token)
+		response.tokenType, response.token = "imdsv2_token", token
+		return response
+	}
+	if persona.requireToken && request.Header.Get("X-aws-ec2-metadata-token") == "" {
+		return imdsResponse{status: http.StatusUnauthorized}
+	}
+	expiration := time.Now().UTC().Add(6 * time.Hour).Truncate(time.Second)
+	switch path {
+	case "":
+		return imdsText("1.0\n2009-04-04\nlatest")
+	case "/latest":
+		return imdsText("dynamic\nmeta-data\nuser-data")
+	case "/latest/meta-data":
+		return imdsText("ami-id\nhostname\niam/\ninstance-id\ninstance-type\nlocal-hostname\nlocal-ipv4\nmac\nplacement/\npublic-ipv4")
+	case "/latest/meta-data/ami-id":
+		return imdsText(persona.imageID)
+	case "/latest/meta-data/hostname", "/latest/meta-data/local-hostname":
+		return imdsText(persona.hostname)
+	case "/latest/meta-data/instance-id":
+		return imdsText(persona.instanceID)
+	case "/latest/meta-data/instance-type":
+		return imdsText(persona.instanceType)
+	case "/latest/meta-data/local-ipv4":
+		return imdsText(persona.localIPv4)
+	case "/latest/meta-data/public-ipv4":
+		return imdsText(persona.publicIPv4)
+	case "/latest/meta-data/mac":
+		return imdsText(persona.mac)
+	case "/latest/meta-data/placement":
+		return imdsText("availability-zone\nregion")
+	case "/latest/meta-data/placement/availability-zone":
+		return imdsText(persona.zone)
+	case "/latest/meta-data/placement/region":
+		return imdsText(persona.region)
+	case "/latest/meta-data/iam":
+		return imdsText("info\nsecurity-credentials/")
+	case "/latest/meta-data/iam/info":
+		return imdsJSON(map[string]string{
+			"Code":               "Success",
+			"LastUpdated":        time.Now().UTC().Format(time.RFC3339),
+			"InstanceProfileArn": fmt.Sprintf("arn:aws:iam::%v:instance-profile/%v", persona.accountID, persona.roleName),
+			"InstanceProfileId":  "AIPA" + strings.ToUpper(persona.instanceID[2:18]),
+		})
+	case "/latest/meta-data/iam/security-credentials":
+		return imdsText(persona.roleName)
+	case "/latest/meta-data/iam/security-credentials/" + persona.roleName:
+		response := imdsJSON(map[string]string{
+			"Code":            "Success",
+			"LastUpdated":     time.Now().UTC().Format(time.RFC3339),
+			"Type":            "AWS-HMAC",
+			"AccessKeyId":     persona.accessKeyID,
+			"SecretAccessKey": persona.secretAccessKey,
+			"Token":           persona.sessionToken,
+			"Expiration":      expiration.Format(time.RFC3339),
+		})
+		response.tokenType, response.token = "iam_credentials", persona.accessKeyID
+		return response
+	case "/latest/dynamic":
+		return imdsText("instance-identity/")
+	case "/latest/dynamic/instance-identity":
+		return imdsText("document\npkcs7\nsignature")
+	case "/latest/dynamic/instance-identity/document":
+		return imdsJSON(map[string]interface{}{
+			"accountId":        persona.accountID,
+			"architecture":     "x86_64",
+			"availabilityZone": persona.zone,
+			"imageId":          persona.imageID,
+			"instanceId":       persona.instanceID,
+			"instanceType":     persona.instanceType,
+			"privateIp":        persona.localIPv4,
+			"region":           persona.region,
+			"version":          "2017-09-30",
+		})
+	default:
+		return imdsNotFound
+	}
+}
+
+func (persona imdsPersona) gcp(request *http.Request) imdsResponse {
+	if request.Header.Get("Metadata-Flavor") != "Google" {
+		return imdsResponse{
+			status:      http.StatusForbidden,
+			contentType: "text/html; charset=UTF-8",
+			body:        "Your client does not have permission to get URL from this server. Missing Metadata-Flavor:Google header.\n",
+		}
+	}
+	instanceHash := sha256.Sum256([]byte(persona.instanceID))
+	numericID := fmt.Sprint(binary.BigEndian.Uint64(instanceHash[:8]) >> 1)
+	email := fmt.Sprintf("%v-compute@developer.gserviceaccount.com", persona.accountID)
+	switch strings.TrimSuffix(request.URL.Path, "/") {
+	case "/computeMetadata/v1":
+		return imdsText("instance/\nproject/")
+	case "/computeMetadata/v1/instance":
+		return imdsText("hostname\nid\nmachine-type\nname\nnetwork-interfaces/\nservice-accounts/\nzone")
+	case "/computeMetadata/v1/instance/hostname":
+		return imdsText(fmt.Sprintf("%v.c.%v.internal", persona.hostname, persona.projectID))
+	case "/computeMetadata/v1/instance/id":
+		return imdsText(numericID)
+	case "/computeMetadata/v1/instance/name":
+		return imdsText(persona.hostname)
+	case "/computeMetadata/v1/instance/machine-type":
+		return imdsText(fmt.Sprintf("projects/%v/machineTypes/e2-medium", persona.accountID))
+	case "/computeMetadata/v1/instance/zone":
+		return imdsText(fmt.Sprintf("projects/%v/zones/%v", persona.accountID, persona.zone))
+	case "/computeMetadata/v1/instance/network-interfaces/0/ip":
+		return imdsText(persona.localIPv4)
+	case "/computeMetadata/v1/instance/service-accounts":
+		return imdsText(fmt.Sprintf("default/\n%v/", email))
+	case "/computeMetadata/v1/instance/service-accounts/default/email":
+		return imdsText(email)
+	case "/computeMetadata/v1/instance/service-accounts/default/scopes":
+		return imdsText("https://www.googleapis.com/auth/cloud-platform")
+	case "/computeMetadata/v1/instance/service-accounts/default/token":
+		token := "ya29.c." + persona.sessionToken[17:200]
+		response := imdsJSON(map[string]interface{}{
+			"access_token": token,
+			"expires_in":   3599,
+			"token_type":   "Bearer",
+		})
+		response.tokenType, response.token = "access_token", token
+		return response
+	case "/computeMetadata/v1/project/project-id":
+		return imdsText(persona.projectID)
+	case "/computeMetadata/v1/project/numeric-project-id":
+		return imdsText(persona.accountID)
+	default:
+		return imdsNotFound
+	}
+}
+
+func (persona imdsPersona) azure(request *http.Request) imdsResponse {
+	if request.Header.Get("Metadata") != "true" {
+		return imdsJSON(map[string]string{
+			"error": "Bad request. Required metadata header not specified",
+		})
+	}
+	if request.URL.Query().Get("api-version") == "" {
+		return imdsJSON(map[string]string{
+			"error": "Bad request. api-version was not specified in the request",
+		})
+	}
+	switch strings.TrimSuffix(request.URL.Path, "/") {
+	case "/metadata/instance":
+		return imdsJSON(map[string]interface{}{
+			"compute": map[string]string{
+				"location":          strings.ReplaceAll(persona.region, "-", ""),
+				"name":              persona.hostname,
+				"osType":            "Linux",
+				"subscriptionId":    persona.vmID,
+				"vmId":              persona.vmID,
+				"vmSize":            "Standard_B1s",
+				"resourceGroupName": "prod-rg",
+			},
+			"network": map[string]interface{}{
+				"interface": []map[string]interface{}{{
+					"macAddress": strings.ToUpper(strings.ReplaceAll(persona.mac, ":", "")),
+					"ipv4": map[string]interface{}{
+						"ipAddress": []map[string]string{{
+							"privateIpAddress": persona.localIPv4,
+							"publicIpAddress":  persona.publicIPv4,
+						}},
+					},
+				}},
+			},
+		})
+	case "/metadata/identity/oauth2/token":
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"RS256"}`))
+		claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"aud":%q,"oid":%q}`, request.URL.Query().Get("resource"), persona.vmID)))
+		signature := hex.EncodeToString([]byte(persona.sessionToken[17:81]))
+		token := fmt.Sprintf("%v.%v.%v", header, claims, signature)
+		response := imdsJSON(map[string]string{
+			"access_token": token,
+			"expires_in":   "86399",
+			"resource":     request.URL.Query().Get("resource"),
+			"token_type":   "Bearer",
+		})
+		response.tokenType, response.token = "access_token", token
+		return response
+	default:
+		return imdsJSON(map[string]string{
+			"error": "Not found",
+		})
+	}
+}
+
+// imdsHandler emulates the instance metadata service of the configured cloud provider.
+type imdsHandler struct{}
+
+func (imdsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	context, hasContext := request.Context().Value(channelContextKey{}).(channelContext)
+	var persona imdsPersona
+	if hasContext {
+		persona = newIMDSPersona(context.cfg.Services.IMDS)
+	} else {
+		persona = newIMDSPersona(imdsServiceConfig{})
+	}
+	var response imdsResponse
+	switch persona.provider {
+	case "gcp":
+		response = persona.gcp(request)
+		writer.Header().Set("Metadata-Flavor", "Google")
+	case "azure":
+		response = persona.azure(request)
+	default:
+		response = persona.aws(request)
+		writer.Header().Set("Server", "EC2ws")
+	}
+	if hasContext {
+		context.logEvent(imdsRequestLog{
+			channelLog: channelLog{ChannelID: context.channelID},
+			Provider:   persona.provider,
+			Method:     request.Method,
+			Path:       request.URL.RequestURI(),
+			Status:     response.status,
+		})
+		if response.token != "" {
+			context.logEvent(imdsTokenLog{
+				channelLog: channelLog{ChannelID: context.channelID},
+				Provider:   persona.provider,
+				TokenType:  response.tokenType,
+				Token:      response.token,
+			})
+		}
+	}
+	if response.contentType != "" {
+		writer.Header().Set("Content-Type", response.contentType)
+	}
+	writer.WriteHeader(response.status)
+	io.WriteString(writer, response.body)
+}
+
+// imdsServer serves the metadata service on direct TCP/IP channels to the metadata address, whatever the port.
+type imdsServer struct{}
+
+func (imdsServer) serve(context channelContext, readWriter io.ReadWriter, input chan<- string) {
+	httpServer{}.serveHandler(context, readWriter, imdsHandler{})
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -35,6 +37,26 @@ func getAddressLog(host string, port int, cfg *config) interface{} {
 	return entry.String()
 }
 
+// splitLoggedAddress splits an address logged as either a host:port string or an addressLog, possibly decoded from JSON.
+func splitLoggedAddress(address interface{}) (string, int) {
+	switch address := address.(type) {
+	case addressLog:
+		return address.Host, address.Port
+	case map[string]interface{}:
+		host, _ := address["host"].(string)
+		port, _ := address["port"].(float64)
+		return host, int(port)
+	case string:
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return address, 0
+		}
+		portNumber, _ := strconv.Atoi(port)
+		return host, portNumber
+	}
+	return "", 0
+}
+
 type authAccepted bool
 
 func (accepted authAccepted) String() string {
@@ -45,8 +67,8 @@ func (accepted authAccepted) String() string {
 }
 
 type authLog struct {
-	User     string       `json:"accepted"`
-	Accepted authAccepted `json:"rejected"`
+	User     string       `json:"user"`
+	Accepted authAccepted `json:"accepted"`
 }
 
 type noAuthLog struct {
@@ -108,6 +130,7 @@ func (entry connectionLog) eventType() string {
 }
 
 type connectionCloseLog struct {
+	duration time.Duration
 }
 
 func (entry connectionCloseLog) String() string {
@@ -117,6 +140,30 @@ func (entry connectionCloseLog) eventType() string {
 	return "connection_close"
 }
 
+type sessionSummaryLog struct {
+	Duration         float64             `json:"duration"`
+	BytesIn          int64               `json:"bytes_in"`
+	BytesOut         int64               `json:"bytes_out"`
+	AuthAttempts     map[string]int      `json:"auth_attempts"`
+	ServiceLogins    map[string]int      `json:"service_logins"`
+	Credentials      []summaryCredential `json:"credentials"`
+	Channels         map[string]int      `json:"channels"`
+	Commands         []string            `json:"commands"`
+	URLs             []string            `json:"urls"`
+	Files            []string            `json:"files"`
+	DisconnectReason string              `json:"disconnect_reason"`
+	// PreviousConnections counts the earlier connections from the same IP, if the event store is enabled
+	PreviousConnections *int `json:"previous_connections,omitempty"`
+}
+
+func (entry sessionSummaryLog) String() string {
+	return fmt.Sprintf("会话摘要：持续 %.1f 秒，接收 %v 字节，发送 %v 字节，认证尝试 %v，服务登录 %v，通道 %v，%v 条命令，%v 个 URL，%v 个文件，断开原因：%v",
+		entry.Duration, entry.BytesIn, entry.BytesOut, countSummary(entry.AuthAttempts), countSummary(entry.ServiceLogins), countSummary(entry.Channels), len(entry.Commands), len(entry.URLs), len(entry.Files), entry.DisconnectReason)
+}
+func (entry sessionSummaryLog) eventType() string {
+	return "session_summary"
+}
+
 type tcpipForwardLog struct {
 	Address interface{} `json:"address"`
 }
@@ -168,6 +215,15 @@ type channelLog struct {
 	ChannelID int `json:"channel_id"`
 }
 
+// channelEntry is implemented by the entries of events on a channel.
+type channelEntry interface {
+	channel() int
+}
+
+func (entry channelLog) channel() int {
+	return entry.ChannelID
+}
+
 type sessionLog struct {
 	channelLog
 }
@@ -192,16 +248,71 @@ func (entry sessionCloseLog) eventType() string {
 
 type sessionInputLog struct {
 	channelLog
-	Input string `json:"input"`
+	Input    string `json:"input"`
+	Encoding string `json:"encoding"`
 }
 
 func (entry sessionInputLog) String() string {
-	return fmt.Sprintf("[通道 %v] 输入：%q", entry.ChannelID, entry.Input)
+	return fmt.Sprintf("[通道 %v] 输入：%q", entry.ChannelID, decodedText(entry.Input, entry.Encoding))
 }
 func (entry sessionInputLog) eventType() string {
 	return "session_input"
 }
 
+type operatorTakeoverLog struct {
+	channelLog
+}
+
+func (entry operatorTakeoverLog) String() string {
+	return fmt.Sprintf("[通道 %v] 操作员接管了会话", entry.ChannelID)
+}
+func (entry operatorTakeoverLog) eventType() string {
+	return "operator_takeover"
+}
+
+type operatorReleaseLog struct {
+	channelLog
+}
+
+func (entry operatorReleaseLog) String() string {
+	return fmt.Sprintf("[通道 %v] 操作员交还了会话", entry.ChannelID)
+}
+func (entry operatorReleaseLog) eventType() string {
+	return "operator_release"
+}
+
+type operatorOutputLog struct {
+	channelLog
+	Output   string `json:"output"`
+	Encoding string `json:"encoding"`
+}
+
+func (entry operatorOutputLog) String() string {
+	return fmt.Sprintf("[通道 %v] 操作员输出：%q", entry.ChannelID, decodedText(entry.Output, entry.Encoding))
+}
+func (entry operatorOutputLog) eventType() string {
+	return "operator_output"
+}
+
+type configReloadLog struct {
+	Success bool     `json:"success"`
+	Error   string   `json:"error,omitempty"`
+	Changed []string `json:"changed"`
+}
+
+func (entry configReloadLog) String() string {
+	if !entry.Success {
+		return fmt.Sprintf("重新加载配置失败：%v", entry.Error)
+	}
+	if len(entry.Changed) == 0 {
+		return "已重新加载配置，没有更改"
+	}
+	return fmt.Sprintf("已重新加载配置，更改了 %v", strings.Join(entry.Changed, ", "))
+}
+func (entry configReloadLog) eventType() string {
+	return "config_reload"
+}
+
 type directTCPIPLog struct {
 	channelLog
 	From interface{} `json:"from"`
@@ -228,16 +339,163 @@ func (entry directTCPIPCloseLog) eventType() string {
 
 type directTCPIPInputLog struct {
 	channelLog
-	Input string `json:"input"`
+	Input    string `json:"input"`
+	Encoding string `json:"encoding"`
 }
 
 func (entry directTCPIPInputLog) String() string {
-	return fmt.Sprintf("[通道 %v] 输入（直接 TCP/IP）：%q", entry.ChannelID, entry.Input)
+	return fmt.Sprintf("[通道 %v] 输入（直接 TCP/IP）：%q", entry.ChannelID, decodedText(entry.Input, entry.Encoding))
 }
 func (entry directTCPIPInputLog) eventType() string {
 	return "direct_tcpip_input"
 }
 
+type smtpAuthLog struct {
+	channelLog
+	Mechanism string       `json:"mechanism"`
+	Username  string       `json:"username"`
+	Password  string       `json:"password"`
+	Accepted  authAccepted `json:"accepted"`
+}
+
+func (entry smtpAuthLog) String() string {
+	return fmt.Sprintf("[通道 %v] SMTP 以用户名 %q 附带密码 %q 使用 %v 验证 %v", entry.ChannelID, entry.Username, entry.Password, entry.Mechanism, entry.Accepted)
+}
+func (entry smtpAuthLog) eventType() string {
+	return "smtp_auth"
+}
+
+type smtpMessageLog struct {
+	channelLog
+	From    string   `json:"from"`
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	Size    int      `json:"size"`
+	File    string   `json:"file"`
+}
+
+func (entry smtpMessageLog) String() string {
+	return fmt.Sprintf("[通道 %v] 收到从 %q 发往 %q 的邮件，主题 %q（%v 字节），已保存到 %q", entry.ChannelID, entry.From, entry.To, entry.Subject, entry.Size, entry.File)
+}
+func (entry smtpMessageLog) eventType() string {
+	return "smtp_message"
+}
+
+type httpRequestLog struct {
+	channelLog
+	Method    string            `json:"method"`
+	Host      string            `json:"host"`
+	URI       string            `json:"uri"`
+	UserAgent string            `json:"user_agent"`
+	Headers   map[string]string `json:"headers"`
+	Cookies   map[string]string `json:"cookies"`
+	Body      string            `json:"body"`
+	Encoding  string            `json:"encoding"`
+	Username  string            `json:"username"`
+	Password  string            `json:"password"`
+	Status    int               `json:"status"`
+}
+
+func (entry httpRequestLog) String() string {
+	credentials := ""
+	if entry.Username != "" || entry.Password != "" {
+		credentials = fmt.Sprintf("，附带用户名 %q 和密码 %q", entry.Username, entry.Password)
+	}
+	return fmt.Sprintf("[通道 %v] HTTP 请求 %v %q（主机 %q，User-Agent %q）%v，响应 %v", entry.ChannelID, entry.Method, entry.URI, entry.Host, entry.UserAgent, credentials, entry.Status)
+}
+func (entry httpRequestLog) eventType() string {
+	return "http_request"
+}
+
+type imdsRequestLog struct {
+	channelLog
+	Provider string `json:"provider"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Status   int    `json:"status"`
+}
+
+func (entry imdsRequestLog) String() string {
+	return fmt.Sprintf("[通道 %v] 请求 %v 实例元数据 %v %q，响应 %v", entry.ChannelID, entry.Provider, entry.Method, entry.Path, entry.Status)
+}
+func (entry imdsRequestLog) eventType() string {
+	return "imds_request"
+}
+
+type imdsTokenLog struct {
+	channelLog
+	Provider  string `json:"provider"`
+	TokenType string `json:"token_type"`
+	Token     string `json:"token"`
+}
+
+func (entry imdsTokenLog) String() string {
+	return fmt.Sprintf("[通道 %v] 从 %v 实例元数据获取了 %v %q", entry.ChannelID, entry.Provider, entry.TokenType, entry.Token)
+}
+func (entry imdsTokenLog) eventType() string {
+	return "imds_token"
+}
+
+type tcpipAuthLog struct {
+	channelLog
+	Service  string       `json:"service"`
+	Username string       `json:"username"`
+	Password string       `json:"password"`
+	Accepted authAccepted `json:"accepted"`
+}
+
+func (entry tcpipAuthLog) String() string {
+	return fmt.Sprintf("[通道 %v] %v 以用户名 %q 附带密码 %q 登录 %v", entry.ChannelID, entry.Service, entry.Username, entry.Password, entry.Accepted)
+}
+func (entry tcpipAuthLog) eventType() string {
+	return "tcpip_auth"
+}
+
+type redisCommandLog struct {
+	channelLog
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+func (entry redisCommandLog) String() string {
+	return fmt.Sprintf("[通道 %v] Redis 命令 %v %q", entry.ChannelID, entry.Command, entry.Args)
+}
+func (entry redisCommandLog) eventType() string {
+	return "redis_command"
+}
+
+type mysqlAuthLog struct {
+	channelLog
+	Username     string       `json:"username"`
+	Database     string       `json:"database"`
+	AuthPlugin   string       `json:"auth_plugin"`
+	Salt         string       `json:"salt"`
+	AuthResponse string       `json:"auth_response"`
+	Accepted     authAccepted `json:"accepted"`
+}
+
+func (entry mysqlAuthLog) String() string {
+	return fmt.Sprintf("[通道 %v] MySQL 以用户名 %q 登录数据库 %q（%v，盐 %v，响应 %v）%v", entry.ChannelID, entry.Username, entry.Database, entry.AuthPlugin, entry.Salt, entry.AuthResponse, entry.Accepted)
+}
+func (entry mysqlAuthLog) eventType() string {
+	return "mysql_auth"
+}
+
+type ftpUploadLog struct {
+	channelLog
+	Filename string `json:"filename"`
+	Size     int    `json:"size"`
+	SHA256   string `json:"sha256"`
+	File     string `json:"file"`
+}
+
+func (entry ftpUploadLog) String() string {
+	return fmt.Sprintf("[通道 %v] 通过 FTP 上传了文件 %q（%v 字节），已保存到 %q", entry.ChannelID, entry.Filename, entry.Size, entry.File)
+}
+func (entry ftpUploadLog) eventType() string {
+	return "ftp_upload"
+}
+
 type ptyLog struct {
 	channelLog
 	Terminal string `json:"terminal"`
@@ -326,9 +584,11 @@ func (entry windowChangeLog) eventType() string {
 }
 
 type debugGlobalRequestLog struct {
-	RequestType string `json:"request_type"`
-	WantReply   bool   `json:"want_reply"`
-	Payload     string `json:"payload"`
+	RequestType string      `json:"request_type"`
+	WantReply   bool        `json:"want_reply"`
+	Payload     string      `json:"payload"`
+	Encoding    string      `json:"encoding"`
+	Decoded     interface{} `json:"decoded,omitempty"`
 }
 
 func (entry debugGlobalRequestLog) String() string {
@@ -345,8 +605,10 @@ func (entry debugGlobalRequestLog) eventType() string {
 
 type debugChannelLog struct {
 	channelLog
-	ChannelType string `json:"channel_type"`
-	ExtraData   string `json:"extra_data"`
+	ChannelType string      `json:"channel_type"`
+	ExtraData   string      `json:"extra_data"`
+	Encoding    string      `json:"encoding"`
+	Decoded     interface{} `json:"decoded,omitempty"`
 }
 
 func (entry debugChannelLog) String() string {
@@ -363,9 +625,11 @@ func (entry debugChannelLog) eventType() string {
 
 type debugChannelRequestLog struct {
 	channelLog
-	RequestType string `json:"request_type"`
-	WantReply   bool   `json:"want_reply"`
-	Payload     string `json:"payload"`
+	RequestType string      `json:"request_type"`
+	WantReply   bool        `json:"want_reply"`
+	Payload     string      `json:"payload"`
+	Encoding    string      `json:"encoding"`
+	Decoded     interface{} `json:"decoded,omitempty"`
 }
 
 func (entry debugChannelRequestLog) String() string {
@@ -380,35 +644,106 @@ func (entry debugChannelRequestLog) eventType() string {
 	return "debug_channel_request"
 }
 
+// logRecord is a logged event along with the connection it belongs to, ready to be formatted by any output.
+type logRecord struct {
+	time       time.Time
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	source     interface{}
+	user       string
+	sessionID  string
+	// connectionID and channelID identify the connection and, for channel events, the channel across all connections
+	connectionID string
+	channelID    string
+	entry        logEntry
+}
+
+func (record logRecord) json(timestamps bool) ([]byte, error) {
+	var jsonEntry interface{}
+	if timestamps {
+		jsonEntry = struct {
+			Time         string      `json:"time"`
+			Source       interface{} `json:"source"`
+			ConnectionID string      `json:"connection_id"`
+			ChannelID    string      `json:"channel_id,omitempty"`
+			EventType    string      `json:"event_type"`
+			Event        logEntry    `json:"event"`
+		}{record.time.Format(time.RFC3339), record.source, record.connectionID, record.channelID, record.entry.eventType(), record.entry}
+	} else {
+		jsonEntry = struct {
+			Source       interface{} `json:"source"`
+			ConnectionID string      `json:"connection_id"`
+			ChannelID    string      `json:"channel_id,omitempty"`
+			EventType    string      `json:"event_type"`
+			Event        logEntry    `json:"event"`
+		}{record.source, record.connectionID, record.channelID, record.entry.eventType(), record.entry}
+	}
+	return json.Marshal(jsonEntry)
+}
+
+func (record logRecord) plain(timestamps bool) []byte {
+	line := fmt.Sprintf("[%v %v] %v", record.remoteAddr, record.connectionID, record.entry)
+	if timestamps {
+		line = record.time.Format("2006/01/02 15:04:05 ") + line
+	}
+	return []byte(line)
+}
+
 func (context connContext) logEvent(entry logEntry) {
 	if strings.HasPrefix(entry.eventType(), "debug_") && !context.cfg.Logging.Debug {
 		return
 	}
-	if context.cfg.Logging.JSON {
-		var jsonEntry interface{}
-		tcpSource := context.RemoteAddr().(*net.TCPAddr)
-		source := getAddressLog(tcpSource.IP.String(), tcpSource.Port, context.cfg)
-		if context.cfg.Logging.Timestamps {
-			jsonEntry = struct {
-				Time      string      `json:"time"`
-				Source    interface{} `json:"source"`
-				EventType string      `json:"event_type"`
-				Event     logEntry    `json:"event"`
-			}{time.Now().Format(time.RFC3339), source, entry.eventType(), entry}
-		} else {
-			jsonEntry = struct {
-				Source    interface{} `json:"source"`
-				EventType string      `json:"event_type"`
-				Event     logEntry    `json:"event"`
-			}{source, entry.eventType(), entry}
-		}
-		logBytes, err := json.Marshal(jsonEntry)
+	tcpSource := context.RemoteAddr().(*net.TCPAddr)
+	record := logRecord{
+		time:         time.Now(),
+		remoteAddr:   context.RemoteAddr(),
+		localAddr:    context.LocalAddr(),
+		source:       getAddressLog(tcpSource.IP.String(), tcpSource.Port, context.cfg),
+		user:         context.User(),
+		sessionID:    hex.EncodeToString(context.SessionID()),
+		connectionID: context.connectionID(),
+		entry:        entry,
+	}
+	if entry, ok := entry.(channelEntry); ok {
+		record.channelID = uniqueChannelID(record.connectionID, entry.channel())
+	}
+	if summary := getConnectionSummary(context.RemoteAddr()); summary != nil {
+		summary.add(entry)
+	}
+	if live := getLiveConnection(record.connectionID); live != nil {
+		live.add(record)
+	}
+	context.cfg.writeLogRecord(record)
+}
+
+// writeLogRecord writes an event to all the log outputs.
+func (cfg *config) writeLogRecord(record logRecord) {
+	if cfg.Logging.JSON {
+		logBytes, err := record.json(cfg.Logging.Timestamps)
 		if err != nil {
 			warningLogger.Printf("记录事件失败：%v", err)
 			return
 		}
 		log.Print(string(logBytes))
 	} else {
-		log.Printf("[%v] %v", context.RemoteAddr().String(), entry)
+		log.Print(string(record.plain(false)))
 	}
+	cfg.logSinks.dispatch(record)
+}
+
+// localAddr stands in for the addresses of events that aren't about a connection.
+type localAddr struct{}
+
+func (localAddr) Network() string { return "local" }
+func (localAddr) String() string  { return "local" }
+
+// logLocalEvent logs an event of sshesame itself, rather than of a connection.
+func (cfg *config) logLocalEvent(entry logEntry) {
+	cfg.writeLogRecord(logRecord{
+		time:       time.Now(),
+		remoteAddr: localAddr{},
+		localAddr:  localAddr{},
+		source:     localAddr{}.String(),
+		entry:      entry,
+	})
 }
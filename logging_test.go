@@ -37,54 +37,64 @@ func TestPlainWithTimestamps(t *testing.T) {
 	testLogging(t, &loggingConfig{
 		JSON:       false,
 		Timestamps: true,
-	}, mockLogEntry{"lorem"}, regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} \[127\.0\.0\.1:1234\] test lorem$`))
+	}, mockLogEntry{"lorem"}, regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} \[127\.0\.0\.1:1234 736f6d6573657373\] test lorem$`))
 }
 
 func TestJSONWithTimestamps(t *testing.T) {
 	testLogging(t, &loggingConfig{
 		JSON:       true,
 		Timestamps: true,
-	}, mockLogEntry{"ipsum"}, regexp.MustCompile(`^{"time":"[^"]+","source":"127\.0\.0\.1:1234","event_type":"test","event":{"content":"ipsum"}}$`))
+	}, mockLogEntry{"ipsum"}, regexp.MustCompile(`^{"time":"[^"]+","source":"127\.0\.0\.1:1234","connection_id":"736f6d6573657373","event_type":"test","event":{"content":"ipsum"}}$`))
 }
 
 func TestPlainWithoutTimestamps(t *testing.T) {
 	testLogging(t, &loggingConfig{
 		JSON:       false,
 		Timestamps: false,
-	}, mockLogEntry{"dolor"}, regexp.MustCompile(`^\[127\.0\.0\.1:1234\] test dolor$`))
+	}, mockLogEntry{"dolor"}, regexp.MustCompile(`^\[127\.0\.0\.1:1234 736f6d6573657373\] test dolor$`))
 }
 
 func TestJSONWithoutTimestamps(t *testing.T) {
 	testLogging(t, &loggingConfig{
 		JSON:       true,
 		Timestamps: false,
-	}, mockLogEntry{"sit"}, regexp.MustCompile(`^{"source":"127\.0\.0\.1:1234","event_type":"test","event":{"content":"sit"}}$`))
+	}, mockLogEntry{"sit"}, regexp.MustCompile(`^{"source":"127\.0\.0\.1:1234","connection_id":"736f6d6573657373","event_type":"test","event":{"content":"sit"}}$`))
 }
 
 func TestPlainWithAddressSplitting(t *testing.T) {
 	testLogging(t, &loggingConfig{
 		JSON:          false,
 		SplitHostPort: true,
-	}, mockLogEntry{"amet"}, regexp.MustCompile(`^\[127\.0\.0\.1:1234\] test amet$`))
+	}, mockLogEntry{"amet"}, regexp.MustCompile(`^\[127\.0\.0\.1:1234 736f6d6573657373\] test amet$`))
 }
 
 func TestJSONWithAddressSplitting(t *testing.T) {
 	testLogging(t, &loggingConfig{
 		JSON:          true,
 		SplitHostPort: true,
-	}, mockLogEntry{"consectetur"}, regexp.MustCompile(`^{"source":{"host":"127\.0\.0\.1","port":1234},"event_type":"test","event":{"content":"consectetur"}}$`))
+	}, mockLogEntry{"consectetur"}, regexp.MustCompile(`^{"source":{"host":"127\.0\.0\.1","port":1234},"connection_id":"736f6d6573657373","event_type":"test","event":{"content":"consectetur"}}$`))
 }
 
 func TestPlainWithoutAddressSplitting(t *testing.T) {
 	testLogging(t, &loggingConfig{
 		JSON:          false,
 		SplitHostPort: false,
-	}, mockLogEntry{"adipiscing"}, regexp.MustCompile(`^\[127\.0\.0\.1:1234\] test adipiscing$`))
+	}, mockLogEntry{"adipiscing"}, regexp.MustCompile(`^\[127\.0\.0\.1:1234 736f6d6573657373\] test adipiscing$`))
 }
 
 func TestJSONWithoutAddressSplitting(t *testing.T) {
 	testLogging(t, &loggingConfig{
 		JSON:          true,
 		SplitHostPort: false,
-	}, mockLogEntry{"elit"}, regexp.MustCompile(`^{"source":"127\.0\.0\.1:1234","event_type":"test","event":{"content":"elit"}}$`))
+	}, mockLogEntry{"elit"}, regexp.MustCompile(`^{"source":"127\.0\.0\.1:1234","connection_id":"736f6d6573657373","event_type":"test","event":{"content":"elit"}}$`))
+}
+
+func TestConnectionID(t *testing.T) {
+	context := connContext{ConnMetadata: mockConnContext{}}
+	if connectionID := context.connectionID(); connectionID != "736f6d6573657373" {
+		t.Errorf("connectionID=%v, want the first bytes of the session ID", connectionID)
+	}
+	testLogging(t, &loggingConfig{
+		JSON: true,
+	}, sessionLog{channelLog{ChannelID: 3}}, regexp.MustCompile(`^{"source":"127\.0\.0\.1:1234","connection_id":"736f6d6573657373","channel_id":"736f6d6573657373-3","event_type":"session",`))
 }
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const defaultLogSinkQueueSize = 1024
+
+type logSinkConfig struct {
+	Name              string            `yaml:"name"`
+	Type              string            `yaml:"type"`
+	Path              string            `yaml:"path"`
+	Network           string            `yaml:"network"`
+	Address           string            `yaml:"address"`
+	Facility          string            `yaml:"facility"`
+	AppName           string            `yaml:"app_name"`
+	CAFile            string            `yaml:"ca_file"`
+	URL               string            `yaml:"url"`
+	Mode              string            `yaml:"mode"`
+	Index             string            `yaml:"index"`
+	Headers           map[string]string `yaml:"headers"`
+	HMACSecret        string            `yaml:"hmac_secret"`
+	BatchSize         int               `yaml:"batch_size"`
+	FlushInterval     time.Duration     `yaml:"flush_interval"`
+	MaxRetries        int               `yaml:"max_retries"`
+	RetryBackoff      time.Duration     `yaml:"retry_backoff"`
+	SpoolDir          string            `yaml:"spool_dir"`
+	MaxSpoolSize      int64             `yaml:"max_spool_size"`
+	Format            string            `yaml:"format"`
+	Timestamps        bool              `yaml:"timestamps"`
+	EventTypes        []string          `yaml:"event_types"`
+	ExcludeEventTypes []string          `yaml:"exclude_event_types"`
+	QueueSize         int               `yaml:"queue_size"`
+	Rotation          logRotationConfig `yaml:"rotation"`
+}
+
+func (sinkConfig *logSinkConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain logSinkConfig
+	*sinkConfig = logSinkConfig{
+		Format:     "json",
+		Timestamps: true,
+		QueueSize:  defaultLogSinkQueueSize,
+	}
+	return unmarshal((*plain)(sinkConfig))
+}
+
+// logSink is an output activity logs are written to in addition to the main log.
+type logSink interface {
+	write(record logRecord, data []byte) error
+	close() error
+}
+
+// logReopener is implemented by sinks writing to files, which can be reopened after being moved away.
+type logReopener interface {
+	reopen() error
+}
+
+// logSinkTypes creates sinks of each type from their config.
+var logSinkTypes = map[string]func(sinkConfig logSinkConfig) (logSink, error){
+	"file":     newFileLogSink,
+	"unix":     newUnixLogSink,
+	"syslog":   newSyslogLogSink,
+	"journald": newJournaldLogSink,
+	"webhook":  newWebhookLogSink,
+}
+
+// logFormat formats a record for a sink, as the documents written for it. Most formats write one document per record.
+type logFormat func(record logRecord, timestamps bool) ([][]byte, error)
+
+// singleLogDocument adapts a format writing one document per record.
+func singleLogDocument(format func(record logRecord, timestamps bool) ([]byte, error)) logFormat {
+	return func(record logRecord, timestamps bool) ([][]byte, error) {
+		document, err := format(record, timestamps)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{document}, nil
+	}
+}
+
+// logFormats formats a record for a sink.
+var logFormats = map[string]logFormat{
+	"plain": func(record logRecord, timestamps bool) ([][]byte, error) {
+		return [][]byte{record.plain(timestamps)}, nil
+	},
+	"json":   singleLogDocument(logRecord.json),
+	"cowrie": logRecord.cowrie,
+	"ecs":    singleLogDocument(logRecord.ecs),
+}
+
+type fileLogSink struct {
+	file *rotatingFile
+}
+
+func newFileLogSink(sinkConfig logSinkConfig) (logSink, error) {
+	if sinkConfig.Path == "" {
+		return nil, fmt.Errorf("path not set")
+	}
+	file, err := openRotatingFile(sinkConfig.Path, sinkConfig.Rotation)
+	if err != nil {
+		return nil, err
+	}
+	return fileLogSink{file}, nil
+}
+
+func (sink fileLogSink) write(record logRecord, data []byte) error {
+	_, err := sink.file.Write(append(data, '\n'))
+	return err
+}
+
+func (sink fileLogSink) reopen() error {
+	return sink.file.reopen()
+}
+
+func (sink fileLogSink) close() error {
+	return sink.file.Close()
+}
+
+// unixLogSink writes to a Unix socket, reconnecting on the next write if the connection is lost.
+type unixLogSink struct {
+	network string
+	path    string
+	conn    net.Conn
+}
+
+func newUnixLogSink(sinkConfig logSinkConfig) (logSink, error) {
+	if sinkConfig.Path == "" {
+		return nil, fmt.Errorf("path not set")
+	}
+	network := sinkConfig.Network
+	switch network {
+	case "":
+		network = "unix"
+	case "unix", "unixgram":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	return &unixLogSink{network: network, path: sinkConfig.Path}, nil
+}
+
+func (sink *unixLogSink) write(record logRecord, data []byte) error {
+	if sink.conn == nil {
+		conn, err := net.Dial(sink.network, sink.path)
+		if err != nil {
+			return err
+		}
+		sink.conn = conn
+	}
+	if sink.network == "unix" {
+		data = append(data, '\n')
+	}
+	if _, err := sink.conn.Write(data); err != nil {
+		sink.conn.Close()
+		sink.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (sink *unixLogSink) close() error {
+	if sink.conn == nil {
+		return nil
+	}
+	return sink.conn.Close()
+}
+
+var droppedLogEventsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sshesame_dropped_log_events_total",
+	Help: "Total number of log events dropped because a log sink's queue was full",
+}, []string{"sink"})
+
+// logSinkQueue buffers records for a sink, which writes them from its own goroutine.
+type logSinkQueue struct {
+	name              string
+	sink              logSink
+	format            logFormat
+	timestamps        bool
+	eventTypes        map[string]bool
+	excludeEventTypes map[string]bool
+	records           chan logRecord
+	done              chan struct{}
+}
+
+func newLogSinkQueue(name string, sink logSink, format logFormat, timestamps bool, size int) *logSinkQueue {
+	return &logSinkQueue{
+		name:              name,
+		sink:              sink,
+		format:            format,
+		timestamps:        timestamps,
+		eventTypes:        map[string]bool{},
+		excludeEventTypes: map[string]bool{},
+		records:           make(chan logRecord, size),
+		done:              make(chan struct{}),
+	}
+}
+
+func (queue *logSinkQueue) accepts(eventType string) bool {
+	if len(queue.eventTypes) != 0 && !queue.eventTypes[eventType] {
+		return false
+	}
+	return !queue.excludeEventTypes[eventType]
+}
+
+func (queue *logSinkQueue) run() {
+	defer close(queue.done)
+	for record := range queue.records {
+		documents, err := queue.format(record, queue.timestamps)
+		if err != nil {
+			warningLogger.Printf("Failed to format event for log sink %v: %v", queue.name, err)
+			continue
+		}
+		for _, data := range documents {
+			if err := queue.sink.write(record, data); err != nil {
+				warningLogger.Printf("Failed to write event to log sink %v: %v", queue.name, err)
+			}
+		}
+	}
+	if err := queue.sink.close(); err != nil {
+		warningLogger.Printf("Failed to close log sink %v: %v", queue.name, err)
+	}
+}
+
+// logDispatcher fans records out to the sinks without ever blocking the caller.
+type logDispatcher struct {
+	mutex  sync.RWMutex
+	queues []*logSinkQueue
+	closed bool
+}
+
+// name returns the name of the i-th log sink, used in errors and metrics.
+func (sinkConfig logSinkConfig) name(i int) string {
+	if sinkConfig.Name != "" {
+		return sinkConfig.Name
+	}
+	return fmt.Sprintf("%v-%v", sinkConfig.Type, i)
+}
+
+// checkLogSinks checks the types and formats of log sinks, without setting them up.
+func checkLogSinks(sinkConfigs []logSinkConfig) error {
+	for i, sinkConfig := range sinkConfigs {
+		if logSinkTypes[sinkConfig.Type] == nil {
+			return fmt.Errorf("unknown type %q for log sink %v", sinkConfig.Type, sinkConfig.name(i))
+		}
+		if logFormats[sinkConfig.Format] == nil {
+			return fmt.Errorf("unknown format %q for log sink %v", sinkConfig.Format, sinkConfig.name(i))
+		}
+	}
+	return nil
+}
+
+func newLogDispatcher(sinkConfigs []logSinkConfig) (*logDispatcher, error) {
+	if err := checkLogSinks(sinkConfigs); err != nil {
+		return nil, err
+	}
+	dispatcher := &logDispatcher{}
+	for i, sinkConfig := range sinkConfigs {
+		name := sinkConfig.name(i)
+		newSink := logSinkTypes[sinkConfig.Type]
+		format := logFormats[sinkConfig.Format]
+		if sinkConfig.QueueSize <= 0 {
+			sinkConfig.QueueSize = defaultLogSinkQueueSize
+		}
+		sink, err := newSink(sinkConfig)
+		if err != nil {
+			dispatcher.close()
+			return nil, fmt.Errorf("failed to set up log sink %v: %w", name, err)
+		}
+		queue := newLogSinkQueue(name, sink, format, sinkConfig.Timestamps, sinkConfig.QueueSize)
+		for _, eventType := range sinkConfig.EventTypes {
+			queue.eventTypes[eventType] = true
+		}
+		for _, eventType := range sinkConfig.ExcludeEventTypes {
+			queue.excludeEventTypes[eventType] = true
+		}
+		go queue.run()
+		dispatcher.queues = append(dispatcher.queues, queue)
+	}
+	return dispatcher, nil
+}
+
+func (dispatcher *logDispatcher) dispatch(record logRecord) {
+	if dispatcher == nil {
+		return
+	}
+	dispatcher.mutex.RLock()
+	defer dispatcher.mutex.RUnlock()
+	if dispatcher.closed {
+		return
+	}
+	for _, queue := range dispatcher.queues {
+		if !queue.accepts(record.entry.eventType()) {
+			continue
+		}
+		select {
+		case queue.records <- record:
+		default:
+			droppedLogEventsMetric.WithLabelValues(queue.name).Inc()
+		}
+	}
+}
+
+func (dispatcher *logDispatcher) reopen() {
+	if dispatcher == nil {
+		return
+	}
+	dispatcher.mutex.RLock()
+	defer dispatcher.mutex.RUnlock()
+	for _, queue := range dispatcher.queues {
+		if reopener, ok := queue.sink.(logReopener); ok {
+			if err := reopener.reopen(); err != nil {
+				warningLogger.Printf("Failed to reopen log sink %v: %v", queue.name, err)
+			}
+		}
+	}
+}
+
+// replace switches the dispatcher over to the sinks of another one and closes its own,
+// so configs sharing the dispatcher all write to the current sinks.
+func (dispatcher *logDispatcher) replace(other *logDispatcher) {
+	dispatcher.mutex.Lock()
+	previous := &logDispatcher{queues: dispatcher.queues, closed: dispatcher.closed}
+	dispatcher.queues = other.queues
+	dispatcher.closed = false
+	dispatcher.mutex.Unlock()
+	previous.close()
+}
+
+// close stops accepting records and waits for the sinks to write the queued ones.
+func (dispatcher *logDispatcher) close() {
+	if dispatcher == nil {
+		return
+	}
+	dispatcher.mutex.Lock()
+	if dispatcher.closed {
+		dispatcher.mutex.Unlock()
+		return
+	}
+	dispatcher.closed = true
+	for _, queue := range dispatcher.queues {
+		close(queue.records)
+	}
+	dispatcher.mutex.Unlock()
+	for _, queue := range dispatcher.queues {
+		<-queue.done
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestLogSinks(t *testing.T) {
+	dir := t.TempDir()
+	sinksConfig := `
+- type: file
+  path: ` + path.Join(dir, "all.json") + `
+  timestamps: false
+- type: file
+  path: ` + path.Join(dir, "auth.log") + `
+  format: plain
+  event_types: [password_auth]
+- type: file
+  path: ` + path.Join(dir, "rest.json") + `
+  exclude_event_types: [password_auth]
+`
+	cfg := &config{}
+	if err := yaml.UnmarshalStrict([]byte(sinksConfig), &cfg.Logging.Sinks); err != nil {
+		t.Fatal(err)
+	}
+	setupLogBuffer(t, cfg)
+	context := connContext{ConnMetadata: mockConnContext{}, cfg: cfg}
+	context.logEvent(passwordAuthLog{authLog{"root", true}, "hunter2"})
+	context.logEvent(mockLogEntry{"lorem"})
+	cfg.logSinks.close()
+
+	for file, expectedLogs := range map[string]*regexp.Regexp{
+		"all.json":  regexp.MustCompile(`^{"source":"127\.0\.0\.1:1234","connection_id":"736f6d6573657373","event_type":"password_auth","event":{[^}]*"password":"hunter2"}}\n{"source":"127\.0\.0\.1:1234","connection_id":"736f6d6573657373","event_type":"test","event":{"content":"lorem"}}\n$`),
+		"auth.log":  regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} \[127\.0\.0\.1:1234 736f6d6573657373\] 以用户名 "root" 附带密码 "hunter2" 登录 已允许\n$`),
+		"rest.json": regexp.MustCompile(`^{"time":"[^"]+","source":"127\.0\.0\.1:1234","connection_id":"736f6d6573657373","event_type":"test","event":{"content":"lorem"}}\n$`),
+	} {
+		logs, err := os.ReadFile(path.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !expectedLogs.Match(logs) {
+			t.Errorf("%v: logs=%q, want match for %v", file, logs, expectedLogs)
+		}
+	}
+}
+
+func TestUnixLogSink(t *testing.T) {
+	socket := path.Join(t.TempDir(), "sink.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	cfg := &config{}
+	cfg.Logging.Sinks = []logSinkConfig{{Type: "unix", Path: socket, Format: "plain"}}
+	setupLogBuffer(t, cfg)
+	connContext{ConnMetadata: mockConnContext{}, cfg: cfg}.logEvent(mockLogEntry{"ipsum"})
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "[127.0.0.1:1234 736f6d6573657373] test ipsum\n" {
+		t.Errorf("line=%q, want %q", line, "[127.0.0.1:1234 736f6d6573657373] test ipsum\n")
+	}
+	cfg.logSinks.close()
+}
+
+type blockingLogSink struct {
+	unblock chan struct{}
+	writes  chan []byte
+}
+
+func (sink blockingLogSink) write(record logRecord, data []byte) error {
+	<-sink.unblock
+	sink.writes <- data
+	return nil
+}
+
+func (sink blockingLogSink) close() error {
+	return nil
+}
+
+func TestLogSinkQueueFull(t *testing.T) {
+	sink := blockingLogSink{make(chan struct{}), make(chan []byte, 10)}
+	logSinkTypes["blocking"] = func(logSinkConfig) (logSink, error) { return sink, nil }
+	defer delete(logSinkTypes, "blocking")
+	cfg := &config{}
+	cfg.Logging.Sinks = []logSinkConfig{{Name: "slow", Type: "blocking", Format: "json", QueueSize: 1}}
+	setupLogBuffer(t, cfg)
+	context := connContext{ConnMetadata: mockConnContext{}, cfg: cfg}
+	// The sink blocks on the first event, the second fills the queue, the rest are dropped
+	for i := 0; i < 5; i++ {
+		context.logEvent(mockLogEntry{"dolor"})
+	}
+	close(sink.unblock)
+	cfg.logSinks.close()
+	if len(sink.writes) > 2 {
+		t.Errorf("len(sink.writes)=%v, want at most 2", len(sink.writes))
+	}
+}
+
+func TestInvalidLogSinks(t *testing.T) {
+	for _, sinkConfigs := range [][]logSinkConfig{
+		{{Type: "nonexistent", Format: "json"}},
+		{{Type: "file", Path: path.Join(t.TempDir(), "test.log"), Format: "nonexistent"}},
+		{{Type: "file", Format: "json"}},
+		{{Type: "unix", Path: "/nonexistent", Network: "tcp", Format: "json"}},
+	} {
+		if _, err := newLogDispatcher(sinkConfigs); err == nil || !strings.Contains(err.Error(), "log sink") {
+			t.Errorf("newLogDispatcher(%v)=%v, want log sink error", sinkConfigs, err)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -10,7 +12,7 @@ import (
 	"syscall"
 
 	"github.com/adrg/xdg"
-	"github.com/jaksi/sshutils"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -26,52 +28,72 @@ func init() {
 	errorLogger = log.New(os.Stderr, "ERROR ", log.LstdFlags)
 }
 
+// subcommands are run instead of the honeypot when given as the first argument.
+var subcommands = map[string]func(args []string) error{
+	"replay":   replayCommand,
+	"stats":    statsCommand,
+	"query":    queryCommand,
+	"watch":    watchCommand,
+	"takeover": takeoverCommand,
+	"check":    checkCommand,
+}
+
 func main() {
-	configFile := flag.String("config", "", "optional config file")
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			if err := subcommand(os.Args[2:]); err != nil {
+				if errors.Is(err, flag.ErrHelp) {
+					return
+				}
+				errorLogger.Fatalf("%v: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
+
+	var configFiles configFilesFlag
+	flag.Var(&configFiles, "config", "optional config file, or directory of YAML config files; can be given multiple times to merge them in order")
 	dataDir := flag.String("data_dir", path.Join(xdg.DataHome, "sshesame"), "data directory to store automatically generated host keys in")
 	flag.Parse()
 
-	cfg := &config{}
-	configString := ""
-	if *configFile != "" {
-		configBytes, err := os.ReadFile(*configFile)
-		if err != nil {
-			errorLogger.Fatalf("Failed to read config file: %v", err)
-		}
-		configString = string(configBytes)
-	}
-	err := cfg.load(configString, *dataDir)
+	configs, err := newConfigReloader(configFiles, *dataDir)
 	if err != nil {
 		errorLogger.Fatalf("Failed to load config: %v", err)
 	}
+	cfg := configs.config()
 	reloadSignals := make(chan os.Signal, 1)
 	defer close(reloadSignals)
 	go func() {
 		for signal := range reloadSignals {
 			infoLogger.Printf("Reloading config due to %s", signal)
-			configBytes, err := os.ReadFile(*configFile)
-			if err != nil {
-				warningLogger.Printf("Failed to read config file: %v", err)
-			}
-			configString = string(configBytes)
-			err = cfg.load(configString, *dataDir)
-			if err != nil {
+			if err := configs.reload(); err != nil {
 				warningLogger.Printf("Failed to reload config: %v", err)
 			}
 		}
 	}()
 	signal.Notify(reloadSignals, syscall.SIGHUP)
+	reopenSignals := make(chan os.Signal, 1)
+	defer close(reopenSignals)
+	go func() {
+		for signal := range reopenSignals {
+			infoLogger.Printf("Reopening log files due to %s", signal)
+			configs.reopenLogs()
+		}
+	}()
+	signal.Notify(reopenSignals, syscall.SIGUSR1)
 
-	listener, err := sshutils.Listen(cfg.Server.ListenAddress, cfg.sshConfig)
+	netListener, err := net.Listen("tcp", cfg.Server.ListenAddress)
 	if err != nil {
 		errorLogger.Fatalf("Failed to listen for connections: %v", err)
 	}
-	defer listener.Close()
+	defer netListener.Close()
+	listener := configListener{trackingListener{netListener}, configs}
 
 	infoLogger.Printf("Listening on %v", listener.Addr())
 
 	if cfg.Logging.MetricsAddress != "" {
-		http.Handle("/metrics", promhttp.Handler())
+		// OpenMetrics is needed to expose the connection IDs attached to samples as exemplars
+		http.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
 		infoLogger.Printf("Serving metrics on %v", cfg.Logging.MetricsAddress)
 		go func() {
 			if err := http.ListenAndServe(cfg.Logging.MetricsAddress, nil); err != nil {
@@ -80,12 +102,16 @@ func main() {
 		}()
 	}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			warningLogger.Printf("Failed to accept connection: %v", err)
-			continue
-		}
-		go handleConnection(conn, cfg)
+	if cfg.Admin.Address != "" {
+		infoLogger.Printf("Serving the admin API on %v", cfg.Admin.Address)
+		go func() {
+			if err := http.ListenAndServe(cfg.Admin.Address, newAdminHandler(configs)); err != nil {
+				errorLogger.Fatalf("Failed to serve the admin API: %v", err)
+			}
+		}()
+	}
+
+	if err := listener.serve(); err != nil {
+		errorLogger.Fatalf("Failed to accept connections: %v", err)
 	}
 }
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	mysqlClientConnectWithDB        = 0x00000008
+	mysqlClientProtocol41           = 0x00000200
+	mysqlClientSecureConnection     = 0x00008000
+	mysqlClientPluginAuth           = 0x00080000
+	mysqlClientPluginAuthLenencData = 0x00200000
+	mysqlServerCapabilities         = 0x00000001 | 0x00000002 | 0x00000004 | mysqlClientConnectWithDB | mysqlClientProtocol41 | 0x00002000 | mysqlClientSecureConnection | mysqlClientPluginAuth | 0x00100000 | mysqlClientPluginAuthLenencData
+	mysqlServerVersion              = "8.0.36-0ubuntu0.22.04.1"
+	mysqlNativePassword             = "mysql_native_password"
+	mysqlAccessDeniedError          = 1045
+	mysqlMaxPacketSize              = 1 << 16
+)
+
+type mysqlServer struct{}
+
+func (mysqlServer) writePacket(writer io.Writer, sequence byte, payload []byte) error {
+	header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), sequence}
+	_, err := writer.Write(append(header, payload...))
+	return err
+}
+
+func (mysqlServer) readPacket(reader io.Reader) (byte, []byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if length > mysqlMaxPacketSize {
+		return 0, nil, fmt.Errorf("packet too large: %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[3], payload, nil
+}
+
+func (mysqlServer) handshake(connectionID uint32, salt []byte) []byte {
+	packet := bytes.Buffer{}
+	packet.WriteByte(10)
+	packet.WriteString(mysqlServerVersion)
+	packet.WriteByte(0)
+	binary.Write(&packet, binary.LittleEndian, connectionID)
+	packet.Write(salt[:8])
+	packet.WriteByte(0)
+	binary.Write(&packet, binary.LittleEndian, uint16(mysqlServerCapabilities&0xffff))
+	packet.WriteByte(0xff) // utf8mb4_0900_ai_ci
+	binary.Write(&packet, binary.LittleEndian, uint16(0x0002))
+	binary.Write(&packet, binary.LittleEndian, uint16(mysqlServerCapabilities>>16))
+	packet.WriteByte(byte(len(salt) + 1))
+	packet.Write(make([]byte, 10))
+	packet.Write(salt[8:])
+	packet.WriteByte(0)
+	packet.WriteString(mysqlNativePassword)
+	packet.WriteByte(0)
+	return packet.Bytes()
+}
+
+type mysqlHandshakeResponse struct {
+	username     string
+	authResponse []byte
+	database     string
+	authPlugin   string
+}
+
+var errMySQLMalformedPacket = errors.New("malformed packet")
+
+func (mysqlServer) parseHandshakeResponse(payload []byte) (mysqlHandshakeResponse, error) {
+	response := mysqlHandshakeResponse{}
+	if len(payload) < 32 {
+		return response, errMySQLMalformedPacket
+	}
+	capabilities := binary.LittleEndian.Uint32(payload[:4])
+	if capabilities&mysqlClientProtocol41 == 0 {
+		return response, errors.New("client does not support protocol 4.1")
+	}
+	reader := bytes.NewBuffer(payload[32:])
+	readString := func() (string, error) {
+		value, err := reader.ReadString(0)
+		if err != nil {
+			return "", errMySQLMalformedPacket
+		}
+		return value[:len(value)-1], nil
+	}
+	var err error
+	if response.username, err = readString(); err != nil {
+		return response, err
+	}
+	var length uint64
+	switch {
+	case capabilities&mysqlClientPluginAuthLenencData != 0:
+		first, err := reader.ReadByte()
+		if err != nil {
+			return response, errMySQLMalformedPacket
+		}
+		length = uint64(first)
+		switch first {
+		case 0xfc:
+			if reader.Len() < 2 {
+				return response, errMySQLMalformedPacket
+			}
+			length = uint64(binary.LittleEndian.Uint16(reader.Next(2)))
+		case 0xfd, 0xfe:
+			return response, errMySQLMalformedPacket
+		}
+	case capabilities&mysqlClientSecureConnection != 0:
+		first, err := reader.ReadByte()
+		if err != nil {
+			return response, errMySQLMalformedPacket
+		}
+		length = uint64(first)
+	default:
+		authResponse, err := readString()
+		if err != nil {
+			return response, err
+		}
+		length = 0
+		response.authResponse = []byte(authResponse)
+	}
+	if length > uint64(reader.Len()) {
+		return response, errMySQLMalformedPacket
+	}
+	if length > 0 {
+		response.authResponse = append([]byte{}, reader.Next(int(length))...)
+	}
+	if capabilities&mysqlClientConnectWithDB != 0 && reader.Len() > 0 {
+		if response.database, err = readString(); err != nil {
+			return response, err
+		}
+	}
+	if capabilities&mysqlClientPluginAuth != 0 && reader.Len() > 0 {
+		if response.authPlugin, err = readString(); err != nil {
+			return response, err
+		}
+	}
+	return response, nil
+}
+
+func (mysqlServer) errorPacket(code uint16, sqlState string, message string) []byte {
+	packet := bytes.Buffer{}
+	packet.WriteByte(0xff)
+	binary.Write(&packet, binary.LittleEndian, code)
+	packet.WriteByte('#')
+	packet.WriteString(sqlState)
+	packet.WriteString(message)
+	return packet.Bytes()
+}
+
+func (server mysqlServer) serve(context channelContext, readWriter io.ReadWriter, input chan<- string) {
+	salt := make([]byte, 20)
+	if _, err := rand.Read(salt); err != nil {
+		warningLogger.Printf("Error generating salt: %v", err)
+		return
+	}
+	// Scrambles are printable in real servers, and some clients rely on it
+	for i := range salt {
+		salt[i] = salt[i]%94 + 33
+	}
+	connectionIDBytes := make([]byte, 4)
+	rand.Read(connectionIDBytes)
+	connectionID := binary.LittleEndian.Uint32(connectionIDBytes) % 100000
+	if err := server.writePacket(readWriter, 0, server.handshake(connectionID, salt)); err != nil {
+		warningLogger.Printf("Error writing handshake: %v", err)
+		return
+	}
+	sequence, payload, err := server.readPacket(bufio.NewReader(readWriter))
+	if err != nil {
+		if err != io.EOF {
+			warningLogger.Printf("Error reading handshake response: %v", err)
+		}
+		return
+	}
+	response, err := server.parseHandshakeResponse(payload)
+	if err != nil {
+		warningLogger.Printf("Error parsing handshake response: %v", err)
+		server.writePacket(readWriter, sequence+1, server.errorPacket(1043, "08S01", "Bad handshake"))
+		return
+	}
+	input <- fmt.Sprintf("%v@%v", response.username, response.database)
+	context.logEvent(mysqlAuthLog{
+		channelLog:   channelLog{ChannelID: context.channelID},
+		Username:     response.username,
+		Database:     response.database,
+		AuthPlugin:   response.authPlugin,
+		Salt:         hex.EncodeToString(salt),
+		AuthResponse: hex.EncodeToString(response.authResponse),
+	})
+	usingPassword := "NO"
+	if len(response.authResponse) > 0 {
+		usingPassword = "YES"
+	}
+	// Forwarded connections come from the SSH server itself
+	message := fmt.Sprintf("Access denied for user '%v'@'localhost' (using password: %v)", response.username, usingPassword)
+	if err := server.writePacket(readWriter, sequence+1, server.errorPacket(mysqlAccessDeniedError, "28000", message)); err != nil {
+		warningLogger.Printf("Error writing error: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// payloadEncoders encode raw payloads for logging, returning the value and the encoding recorded next to it.
+var payloadEncoders = map[string]func(data []byte) (string, string){
+	"text": func(data []byte) (string, string) {
+		if utf8.Valid(data) {
+			return string(data), "utf8"
+		}
+		quoted := strconv.Quote(string(data))
+		return quoted[1 : len(quoted)-1], "escaped"
+	},
+	"base64": func(data []byte) (string, string) {
+		return base64.StdEncoding.EncodeToString(data), "base64"
+	},
+	"hex": func(data []byte) (string, string) {
+		return hex.EncodeToString(data), "hex"
+	},
+}
+
+// encodePayload encodes a payload with the given configured encoding, defaulting to text.
+func encodePayload(data []byte, encoding string) (string, string) {
+	encoder, ok := payloadEncoders[encoding]
+	if !ok {
+		encoder = payloadEncoders["text"]
+	}
+	return encoder(data)
+}
+
+// decodePayload reverses encodePayload, given the encoding recorded in the log.
+func decodePayload(value string, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", "utf8":
+		return []byte(value), nil
+	case "escaped":
+		unquoted, err := strconv.Unquote(`"` + value + `"`)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(unquoted), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(value)
+	case "hex":
+		return hex.DecodeString(value)
+	default:
+		return nil, fmt.Errorf("unknown payload encoding %q", encoding)
+	}
+}
+
+// decodedText is the text of a logged payload, falling back to the logged value if it can't be decoded.
+func decodedText(value string, encoding string) string {
+	data, err := decodePayload(value, encoding)
+	if err != nil {
+		return value
+	}
+	return string(data)
+}
+
+type tcpipForwardPayload struct {
+	Address string `json:"address"`
+	Port    uint32 `json:"port"`
+}
+
+type hostKeysProvePayload struct {
+	HostKeys []string `json:"host_keys"`
+}
+
+type directTCPIPPayload struct {
+	Address           string `json:"address"`
+	Port              uint32 `json:"port"`
+	OriginatorAddress string `json:"originator_address"`
+	OriginatorPort    uint32 `json:"originator_port"`
+}
+
+type ptyPayload struct {
+	Term        string `json:"term"`
+	Width       uint32 `json:"width"`
+	Height      uint32 `json:"height"`
+	PixelWidth  uint32 `json:"pixel_width"`
+	PixelHeight uint32 `json:"pixel_height"`
+	// Modes are binary encoded terminal modes, only kept in the raw payload
+	Modes string `json:"-"`
+}
+
+type x11Payload struct {
+	SingleConnection bool   `json:"single_connection"`
+	AuthProtocol     string `json:"auth_protocol"`
+	AuthCookie       string `json:"auth_cookie"`
+	ScreenNumber     uint32 `json:"screen_number"`
+}
+
+type envPayload struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type execPayload struct {
+	Command string `json:"command"`
+}
+
+type subsystemPayload struct {
+	Subsystem string `json:"subsystem"`
+}
+
+type windowChangePayload struct {
+	Width       uint32 `json:"width"`
+	Height      uint32 `json:"height"`
+	PixelWidth  uint32 `json:"pixel_width"`
+	PixelHeight uint32 `json:"pixel_height"`
+}
+
+type signalPayload struct {
+	Signal string `json:"signal"`
+}
+
+type exitStatusPayload struct {
+	ExitStatus uint32 `json:"exit_status"`
+}
+
+// payloadDecoders return a new value to unmarshal a known payload into for its decoded view.
+type payloadDecoders map[string]func() interface{}
+
+var globalRequestDecoders = payloadDecoders{
+	"tcpip-forward":        func() interface{} { return &tcpipForwardPayload{} },
+	"cancel-tcpip-forward": func() interface{} { return &tcpipForwardPayload{} },
+}
+
+var channelDecoders = payloadDecoders{
+	"direct-tcpip":    func() interface{} { return &directTCPIPPayload{} },
+	"forwarded-tcpip": func() interface{} { return &directTCPIPPayload{} },
+}
+
+var channelRequestDecoders = payloadDecoders{
+	"pty-req":       func() interface{} { return &ptyPayload{} },
+	"x11-req":       func() interface{} { return &x11Payload{} },
+	"env":           func() interface{} { return &envPayload{} },
+	"exec":          func() interface{} { return &execPayload{} },
+	"subsystem":     func() interface{} { return &subsystemPayload{} },
+	"window-change": func() interface{} { return &windowChangePayload{} },
+	"signal":        func() interface{} { return &signalPayload{} },
+	"exit-status":   func() interface{} { return &exitStatusPayload{} },
+}
+
+// decode returns the structured view of a payload of a known type, or nil.
+func (decoders payloadDecoders) decode(payloadType string, data []byte) interface{} {
+	newPayload, ok := decoders[payloadType]
+	if !ok {
+		return nil
+	}
+	payload := newPayload()
+	if err := ssh.Unmarshal(data, payload); err != nil {
+		return nil
+	}
+	return payload
+}
+
+// decodeGlobalRequest returns the structured view of a global request payload, or nil.
+func decodeGlobalRequest(requestType string, data []byte) interface{} {
+	if requestType != "hostkeys-prove-00@openssh.com" {
+		return globalRequestDecoders.decode(requestType, data)
+	}
+	hostKeys, err := unmarshalBytes(data)
+	if err != nil {
+		return nil
+	}
+	payload := &hostKeysProvePayload{HostKeys: make([]string, len(hostKeys))}
+	for i, hostKey := range hostKeys {
+		publicKey, err := ssh.ParsePublicKey(hostKey)
+		if err != nil {
+			return nil
+		}
+		payload.HostKeys[i] = ssh.FingerprintSHA256(publicKey)
+	}
+	return payload
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestEncodePayload(t *testing.T) {
+	tests := []struct {
+		data             []byte
+		encoding         string
+		expectedValue    string
+		expectedEncoding string
+	}{
+		{[]byte("uname -a\r\n"), "text", "uname -a\r\n", "utf8"},
+		{[]byte("héllo"), "", "héllo", "utf8"},
+		{[]byte("\x00\xff\"x\\"), "text", `\x00\xff\"x\\`, "escaped"},
+		{[]byte("\x00\xff"), "base64", "AP8=", "base64"},
+		{[]byte("\x00\xff"), "hex", "00ff", "hex"},
+	}
+	for _, test := range tests {
+		value, encoding := encodePayload(test.data, test.encoding)
+		if value != test.expectedValue || encoding != test.expectedEncoding {
+			t.Errorf("encodePayload(%q, %q)=%q, %q, want %q, %q", test.data, test.encoding, value, encoding, test.expectedValue, test.expectedEncoding)
+		}
+		data, err := decodePayload(value, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, test.data) {
+			t.Errorf("decodePayload(%q, %q)=%q, want %q", value, encoding, data, test.data)
+		}
+	}
+	if _, err := decodePayload("x", "rot13"); err == nil {
+		t.Errorf("decodePayload with an unknown encoding succeeded, want an error")
+	}
+}
+
+func TestDecodedPayloads(t *testing.T) {
+	ptyPayloadBytes := ssh.Marshal(ptyRequestPayload{Term: "xterm", Width: 80, Height: 24, Modes: "\x00"})
+	if decoded := channelRequestDecoders.decode("pty-req", ptyPayloadBytes); !reflect.DeepEqual(decoded, &ptyPayload{Term: "xterm", Width: 80, Height: 24, Modes: "\x00"}) {
+		t.Errorf("decoded=%v, want the pty request", decoded)
+	}
+	forwardPayloadBytes := ssh.Marshal(tcpipRequest{Address: "127.0.0.1", Port: 8080})
+	if decoded := decodeGlobalRequest("tcpip-forward", forwardPayloadBytes); !reflect.DeepEqual(decoded, &tcpipForwardPayload{Address: "127.0.0.1", Port: 8080}) {
+		t.Errorf("decoded=%v, want the forward request", decoded)
+	}
+	if decoded := channelRequestDecoders.decode("exec", []byte("\x00")); decoded != nil {
+		t.Errorf("decoded=%v, want nil for a malformed payload", decoded)
+	}
+	if decoded := channelRequestDecoders.decode("unknown", nil); decoded != nil {
+		t.Errorf("decoded=%v, want nil for an unknown request", decoded)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adrg/xdg"
+	"golang.org/x/term"
+)
+
+// asciicastEvent is a recorded event: elapsed seconds, event code and data.
+type asciicastEvent struct {
+	time float64
+	code string
+	data string
+}
+
+// asciicastReader reads the events of an asciicast v2 recording one at a time, as they come for live sessions.
+type asciicastReader struct {
+	scanner *bufio.Scanner
+}
+
+// newAsciicastReader reads the header of an asciicast v2 recording.
+func newAsciicastReader(reader io.Reader) (asciicastHeader, *asciicastReader, error) {
+	header := asciicastHeader{}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, 1<<24)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return header, nil, err
+		}
+		return header, nil, errors.New("empty recording")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return header, nil, err
+	}
+	if header.Version != 2 {
+		return header, nil, fmt.Errorf("unsupported asciicast version %v", header.Version)
+	}
+	return header, &asciicastReader{scanner}, nil
+}
+
+// next returns the next event, or io.EOF at the end of the recording.
+func (reader *asciicastReader) next() (asciicastEvent, error) {
+	if !reader.scanner.Scan() {
+		if err := reader.scanner.Err(); err != nil {
+			return asciicastEvent{}, err
+		}
+		return asciicastEvent{}, io.EOF
+	}
+	var fields []interface{}
+	if err := json.Unmarshal(reader.scanner.Bytes(), &fields); err != nil {
+		return asciicastEvent{}, err
+	}
+	if len(fields) != 3 {
+		return asciicastEvent{}, fmt.Errorf("invalid event %v", reader.scanner.Text())
+	}
+	eventTime, timeOK := fields[0].(float64)
+	code, codeOK := fields[1].(string)
+	data, dataOK := fields[2].(string)
+	if !timeOK || !codeOK || !dataOK {
+		return asciicastEvent{}, fmt.Errorf("invalid event %v", reader.scanner.Text())
+	}
+	return asciicastEvent{eventTime, code, data}, nil
+}
+
+// readAsciicast reads an asciicast v2 recording.
+func readAsciicast(reader io.Reader) (asciicastHeader, []asciicastEvent, error) {
+	header, events, err := newAsciicastReader(reader)
+	if err != nil {
+		return header, nil, err
+	}
+	all := []asciicastEvent{}
+	for {
+		event, err := events.next()
+		if err == io.EOF {
+			return header, all, nil
+		}
+		if err != nil {
+			return header, nil, err
+		}
+		all = append(all, event)
+	}
+}
+
+// findRecordings returns the recordings of a connection or a single channel, oldest first.
+func findRecordings(dataDir string, id string) ([]string, error) {
+	dir := path.Join(dataDir, "artifacts", "recordings")
+	files := []string{}
+	for _, pattern := range []string{"*-" + id + ".cast", "*-" + id + "-*.cast"} {
+		matches, err := filepath.Glob(path.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recordings of %q in %v", id, dir)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+var terminalControlRegexp = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)|[@-Z\\-_])`)
+
+// transcript renders the output of a recording as plain text, without terminal control sequences.
+func transcript(events []asciicastEvent) string {
+	output := strings.Builder{}
+	for _, event := range events {
+		if event.code == "o" {
+			output.WriteString(event.data)
+		}
+	}
+	lines := []string{}
+	for _, line := range strings.Split(terminalControlRegexp.ReplaceAllString(output.String(), ""), "\n") {
+		text := []rune{}
+		for _, r := range line {
+			switch {
+			case r == '\b':
+				if len(text) > 0 {
+					text = text[:len(text)-1]
+				}
+			case r == '\r', r < ' ' && r != '\t', r == 0x7f:
+			default:
+				text = append(text, r)
+			}
+		}
+		lines = append(lines, string(text))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Player controls, read from the terminal
+const (
+	playerPause    = ' '
+	playerForward  = 'l'
+	playerBackward = 'h'
+	playerQuit     = 'q'
+)
+
+// errPlayerQuit is returned by the player when asked to quit.
+var errPlayerQuit = errors.New("quit")
+
+// playerSeekStep is how far a single forward or backward control moves the playback.
+const playerSeekStep = 5 * time.Second
+
+// asciicastPlayer plays a recording back on a terminal.
+type asciicastPlayer struct {
+	events []asciicastEvent
+	output io.Writer
+	speed  float64
+	// position is the playback time within the recording, in seconds
+	position float64
+	// next is the index of the next event to play
+	next int
+}
+
+// seek moves the playback to the given time, redrawing the screen from the start when going back.
+func (player *asciicastPlayer) seek(position float64) error {
+	if position < 0 {
+		position = 0
+	}
+	if position < player.position {
+		if _, err := io.WriteString(player.output, "\x1b[H\x1b[2J"); err != nil {
+			return err
+		}
+		player.next = 0
+	}
+	for player.next < len(player.events) && player.events[player.next].time <= position {
+		if err := player.playEvent(player.events[player.next]); err != nil {
+			return err
+		}
+		player.next++
+	}
+	player.position = position
+	return nil
+}
+
+func (player *asciicastPlayer) playEvent(event asciicastEvent) error {
+	if event.code != "o" {
+		return nil
+	}
+	_, err := io.WriteString(player.output, event.data)
+	return err
+}
+
+// play plays the recording until its end, handling the controls received.
+func (player *asciicastPlayer) play(controls <-chan byte) error {
+	paused := false
+	for player.next < len(player.events) {
+		var timer <-chan time.Time
+		waitStart := time.Now()
+		if !paused {
+			wait := time.Duration((player.events[player.next].time - player.position) / player.speed * float64(time.Second))
+			timer = time.After(wait)
+		}
+		select {
+		case <-timer:
+			if err := player.seek(player.events[player.next].time); err != nil {
+				return err
+			}
+		case control, ok := <-controls:
+			if !ok {
+				controls = nil
+				continue
+			}
+			if !paused {
+				player.position += time.Since(waitStart).Seconds() * player.speed
+			}
+			var err error
+			switch control {
+			case playerPause:
+				paused = !paused
+			case playerForward:
+				err = player.seek(player.position + playerSeekStep.Seconds())
+			case playerBackward:
+				err = player.seek(player.position - playerSeekStep.Seconds())
+			case playerQuit, 3:
+				return errPlayerQuit
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readPlayerControls reads controls from a raw terminal, mapping the arrow keys to seeking.
+func readPlayerControls(input io.Reader, controls chan<- byte) {
+	defer close(controls)
+	buffer := make([]byte, 16)
+	for {
+		n, err := input.Read(buffer)
+		if err != nil {
+			return
+		}
+		switch keys := string(buffer[:n]); keys {
+		case "\x1b[C":
+			controls <- playerForward
+		case "\x1b[D":
+			controls <- playerBackward
+		default:
+			for _, key := range []byte(keys) {
+				controls <- key
+			}
+		}
+	}
+}
+
+func replayCommand(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	dataDir := flags.String("data_dir", path.Join(xdg.DataHome, "sshesame"), "data directory the recordings are stored in")
+	speed := flags.Float64("speed", 1, "playback speed, e.g. 2 for twice as fast")
+	start := flags.Duration("seek", 0, "start playing at this offset")
+	format := flags.String("format", "play", "play to replay in the terminal, or text to print a clean transcript")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v replay [flags] <connection or channel ID>\n\nWhile playing: space pauses, the left and right arrows (or h and l) seek by %v and q quits.\n\n", os.Args[0], playerSeekStep)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected a single connection or channel ID")
+	}
+	if *speed <= 0 {
+		return fmt.Errorf("invalid speed %v", *speed)
+	}
+	if *format != "play" && *format != "text" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	files, err := findRecordings(*dataDir, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	var controls chan byte
+	if *format == "play" && term.IsTerminal(int(os.Stdin.Fd())) {
+		state, err := term.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return err
+		}
+		defer term.Restore(int(os.Stdin.Fd()), state)
+		controls = make(chan byte)
+		go readPlayerControls(os.Stdin, controls)
+	}
+	for _, file := range files {
+		recordingFile, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		header, events, err := readAsciicast(recordingFile)
+		recordingFile.Close()
+		if err != nil {
+			return fmt.Errorf("%v: %w", file, err)
+		}
+		if *format == "text" {
+			fmt.Printf("=== %v (%vx%v, %v)\n%v\n", path.Base(file), header.Width, header.Height, time.Unix(header.Timestamp, 0).UTC().Format(time.RFC3339), transcript(events))
+			continue
+		}
+		player := &asciicastPlayer{events: events, output: os.Stdout, speed: *speed}
+		if err := player.seek(start.Seconds()); err != nil {
+			return err
+		}
+		if err := player.play(controls); err != nil {
+			if errors.Is(err, errPlayerQuit) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
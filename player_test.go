@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestReadRecordings(t *testing.T) {
+	dataDir := t.TempDir()
+	store := &artifactStore{path.Join(dataDir, "artifacts")}
+	for _, channelID := range []string{"736f6d6573657373-0", "736f6d6573657373-1", "6f74686572636f6e-0"} {
+		recording, err := newAsciicastRecording(store, channelID, ptyRequestPayload{Width: 80, Height: 24}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recording.event("o", []byte(channelID))
+		recording.close()
+	}
+
+	files, err := findRecordings(dataDir, "736f6d6573657373")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || !strings.HasSuffix(files[0], "-736f6d6573657373-0.cast") || !strings.HasSuffix(files[1], "-736f6d6573657373-1.cast") {
+		t.Fatalf("files=%v, want both channels of the connection", files)
+	}
+	if files, err := findRecordings(dataDir, "6f74686572636f6e-0"); err != nil || len(files) != 1 {
+		t.Errorf("files=%v, err=%v, want the single channel", files, err)
+	}
+	if _, err := findRecordings(dataDir, "unknown"); err == nil {
+		t.Errorf("findRecordings succeeded for an unknown ID, want an error")
+	}
+
+	recordingFile, err := os.Open(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recordingFile.Close()
+	header, events, err := readAsciicast(recordingFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Width != 80 || header.Height != 24 || len(events) != 1 || events[0].code != "o" || events[0].data != "736f6d6573657373-1" {
+		t.Errorf("header=%+v, events=%v, want the recorded output", header, events)
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	events := []asciicastEvent{
+		{0, "o", "\x1b[1;32mroot@host\x1b[0m:~# "},
+		{1, "i", "lss\x7f\r"},
+		{1, "o", "ls\b \b"},
+		{1.5, "o", "\r\nx.sh\r\n\x1b]0;title\x07done"},
+	}
+	expected := "root@host:~# l\nx.sh\ndone"
+	if text := transcript(events); text != expected {
+		t.Errorf("transcript=%q, want %q", text, expected)
+	}
+}
+
+func TestAsciicastPlayer(t *testing.T) {
+	events := []asciicastEvent{{0, "o", "a"}, {1, "r", "100x30"}, {2, "o", "b"}, {60, "o", "c"}}
+	output := &strings.Builder{}
+	player := &asciicastPlayer{events: events, output: output, speed: 1000}
+
+	if err := player.seek(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := player.seek(1); err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != "ab\x1b[H\x1b[2Ja" || player.next != 2 {
+		t.Errorf("output=%q, next=%v, want the screen redrawn up to the seek position", output.String(), player.next)
+	}
+
+	output.Reset()
+	if err := player.play(nil); err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != "bc" {
+		t.Errorf("output=%q, want the rest of the recording", output.String())
+	}
+
+	controls := make(chan byte, 1)
+	controls <- playerQuit
+	player = &asciicastPlayer{events: events, output: output, speed: 1}
+	if err := player.play(controls); err != errPlayerQuit {
+		t.Errorf("err=%v, want %v", err, errPlayerQuit)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type recordingConfig struct {
+	Enabled bool  `yaml:"enabled"`
+	MaxSize int64 `yaml:"max_size"`
+}
+
+// asciicastHeader is the first line of an asciicast v2 recording.
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// asciicastRecording records a PTY session in both directions as an asciicast v2 file.
+type asciicastRecording struct {
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	start  time.Time
+	// size counts the bytes written, which stop at maxSize if it's set
+	size    int64
+	maxSize int64
+	// pending holds the start of a UTF-8 sequence split across writes, by event code
+	pending map[string][]byte
+}
+
+// newAsciicastRecording starts a recording of a channel in the artifacts, sized by its PTY request.
+// The recording stops once it would grow past maxSize bytes, unless maxSize is 0.
+func newAsciicastRecording(store *artifactStore, channelID string, pty ptyRequestPayload, maxSize int64) (*asciicastRecording, error) {
+	file, err := store.create("recordings", channelID, ".cast")
+	if err != nil {
+		return nil, err
+	}
+	recording := &asciicastRecording{
+		file:    file,
+		writer:  bufio.NewWriter(file),
+		start:   time.Now(),
+		maxSize: maxSize,
+		pending: map[string][]byte{},
+	}
+	header := asciicastHeader{
+		Version:   2,
+		Width:     pty.Width,
+		Height:    pty.Height,
+		Timestamp: recording.start.Unix(),
+	}
+	if pty.Term != "" {
+		header.Env = map[string]string{"TERM": pty.Term}
+	}
+	if err := recording.writeLine(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return recording, nil
+}
+
+var errRecordingTooLarge = errors.New("recording reached its size limit")
+
+func (recording *asciicastRecording) writeLine(value interface{}) error {
+	lineBytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	lineBytes = append(lineBytes, '\n')
+	if recording.maxSize > 0 && recording.size+int64(len(lineBytes)) > recording.maxSize {
+		return errRecordingTooLarge
+	}
+	if _, err := recording.writer.Write(lineBytes); err != nil {
+		return err
+	}
+	recording.size += int64(len(lineBytes))
+	return recording.writer.Flush()
+}
+
+// event records data with an asciicast event code: "o" for output, "i" for input and "r" for resizes.
+func (recording *asciicastRecording) event(code string, data []byte) {
+	recording.mutex.Lock()
+	defer recording.mutex.Unlock()
+	if recording.file == nil {
+		return
+	}
+	var complete []byte
+	complete, recording.pending[code] = splitIncompleteUTF8(recording.pending[code], data)
+	if len(complete) == 0 {
+		return
+	}
+	elapsed := time.Since(recording.start).Seconds()
+	if err := recording.writeLine([]interface{}{elapsed, code, string(complete)}); errors.Is(err, errRecordingTooLarge) {
+		warningLogger.Printf("Stopping recording %v: %v", recording.file.Name(), err)
+		recording.file.Close()
+		recording.file = nil
+	} else if err != nil {
+		warningLogger.Printf("Failed to write recording: %v", err)
+	}
+}
+
+// splitIncompleteUTF8 appends data to what's pending and splits off an incomplete trailing UTF-8 sequence,
+// so characters written across several writes aren't split between events.
+func splitIncompleteUTF8(pending []byte, data []byte) ([]byte, []byte) {
+	data = append(pending, data...)
+	complete := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax+1; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				complete = i
+			}
+			break
+		}
+	}
+	return data[:complete], append([]byte{}, data[complete:]...)
+}
+
+// resize records a terminal size change.
+func (recording *asciicastRecording) resize(width, height uint32) {
+	recording.event("r", []byte(fmt.Sprintf("%vx%v", width, height)))
+}
+
+func (recording *asciicastRecording) close() error {
+	recording.mutex.Lock()
+	defer recording.mutex.Unlock()
+	if recording.file == nil {
+		return nil
+	}
+	file := recording.file
+	recording.file = nil
+	return file.Close()
+}
+
+// terminalObserver gets everything going through a PTY session, as asciicast events.
+type terminalObserver interface {
+	event(code string, data []byte)
+	resize(width, height uint32)
+}
+
+// observedReadWriter passes everything read from and written to a channel to observers.
+type observedReadWriter struct {
+	io.ReadWriter
+	observers []terminalObserver
+}
+
+func (readWriter observedReadWriter) Read(p []byte) (int, error) {
+	n, err := readWriter.ReadWriter.Read(p)
+	if n > 0 {
+		for _, observer := range readWriter.observers {
+			observer.event("i", p[:n])
+		}
+	}
+	return n, err
+}
+
+func (readWriter observedReadWriter) Write(p []byte) (int, error) {
+	n, err := readWriter.ReadWriter.Write(p)
+	if n > 0 {
+		for _, observer := range readWriter.observers {
+			observer.event("o", p[:n])
+		}
+	}
+	return n, err
+}
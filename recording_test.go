@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jaksi/sshutils"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAsciicastRecording(t *testing.T) {
+	store := &artifactStore{t.TempDir()}
+	recording, err := newAsciicastRecording(store, "736f6d6573657373-0", ptyRequestPayload{Term: "xterm", Width: 80, Height: 24}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recording.event("i", []byte("ls\r"))
+	// A multi-byte character split across writes is recorded whole
+	recording.event("o", []byte("h\xc3"))
+	recording.event("o", []byte("\xa9\r\n"))
+	recording.resize(100, 30)
+	if err := recording.close(); err != nil {
+		t.Fatal(err)
+	}
+	recording.event("o", []byte("ignored"))
+
+	files, err := filepath.Glob(path.Join(store.dir, "recordings", "*-736f6d6573657373-0.cast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("files=%v, want one recording", files)
+	}
+	lines := strings.Split(strings.TrimSuffix(readLogFile(t, files[0]), "\n"), "\n")
+	header := asciicastHeader{}
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 2 || header.Width != 80 || header.Height != 24 || header.Env["TERM"] != "xterm" {
+		t.Errorf("header=%+v, want a v2 80x24 xterm header", header)
+	}
+	events := [][]interface{}{}
+	for _, line := range lines[1:] {
+		event := []interface{}{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event[1:])
+	}
+	expectedEvents := [][]interface{}{{"i", "ls\r"}, {"o", "h"}, {"o", "é\r\n"}, {"r", "100x30"}}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Errorf("events=%v, want %v", events, expectedEvents)
+	}
+}
+
+func TestAsciicastRecordingSizeLimit(t *testing.T) {
+	store := &artifactStore{t.TempDir()}
+	recording, err := newAsciicastRecording(store, "736f6d6573657373-0", ptyRequestPayload{Width: 80, Height: 24}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recording.event("o", []byte("ok\r\n"))
+	recording.event("o", []byte(strings.Repeat("a", 100)))
+	recording.event("o", []byte("ignored"))
+	if err := recording.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(path.Join(store.dir, "recordings", "*.cast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("files=%v, want one recording", files)
+	}
+	recorded := readLogFile(t, files[0])
+	if lines := strings.Split(strings.TrimSuffix(recorded, "\n"), "\n"); len(recorded) > 100 || len(lines) != 2 || !strings.Contains(lines[1], "ok") {
+		t.Errorf("recording=%q, want it stopped before the limit", recorded)
+	}
+}
+
+func TestPTYSessionRecorded(t *testing.T) {
+	keyFile, err := generateKey(t.TempDir(), ecdsa_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config{}
+	cfg.Server.HostKeys = []string{keyFile}
+	cfg.Auth.PasswordAuth.Enabled = true
+	cfg.Auth.PasswordAuth.Accepted = true
+	cfg.artifacts = &artifactStore{t.TempDir()}
+	cfg.Logging.Recordings.Enabled = true
+	if err := cfg.setupSSHConfig(); err != nil {
+		t.Fatal(err)
+	}
+	setupLogBuffer(t, cfg)
+
+	listener, err := sshutils.Listen("127.0.0.1:0", cfg.sshConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		handleConnection(conn, cfg)
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "root",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	session.Stdin = strings.NewReader("true\rexit\r")
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.WindowChange(30, 100); err != nil {
+		t.Fatal(err)
+	}
+	session.Wait()
+	client.Close()
+	<-done
+
+	files, err := filepath.Glob(path.Join(cfg.artifacts.dir, "recordings", "*.cast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("files=%v, want one recording", files)
+	}
+	recording := readLogFile(t, files[0])
+	for _, expected := range []string{`"width":80,"height":24`, `"i","true`, `"o","root@`, `"r","100x30"`} {
+		if !strings.Contains(recording, expected) {
+			t.Errorf("recording=%v, want %v", recording, expected)
+		}
+	}
+}
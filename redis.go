@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type redisServer struct{}
+
+const (
+	// redisMaxBulkLength caps a single argument of a command.
+	redisMaxBulkLength = 1024 * 1024
+	// redisMaxCommandSize caps the total length of the arguments of a command.
+	redisMaxCommandSize = 4 * 1024 * 1024
+	// redisMaxLineLength caps inline commands and the lines of RESP headers.
+	redisMaxLineLength = 64 * 1024
+	// redisMaxKeys and redisMaxDataSize cap what a connection can store with SET and CONFIG SET.
+	redisMaxKeys     = 10000
+	redisMaxDataSize = 16 * 1024 * 1024
+)
+
+var redisOOMError = redisError("OOM command not allowed when used memory > 'maxmemory'.")
+
+// readCommand reads a command either as a RESP array of bulk strings or as an inline command.
+// Commands over the size limits are rejected before their arguments are read.
+func (redisServer) readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := readLimitedLine(reader, redisMaxLineLength)
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 0 || count > 1024 {
+		return nil, errors.New("invalid multibulk length")
+	}
+	args := make([]string, count)
+	size := 0
+	for i := range args {
+		line, err := readLimitedLine(reader, redisMaxLineLength)
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("expected '$', got %q", line)
+		}
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 || length > redisMaxBulkLength {
+			return nil, errors.New("invalid bulk length")
+		}
+		size += length
+		if size > redisMaxCommandSize {
+			return nil, errors.New("command too large")
+		}
+		// Only allocate for the data that actually arrives
+		data, err := io.ReadAll(io.LimitReader(reader, int64(length)+2))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < length+2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		args[i] = string(data[:length])
+	}
+	return args, nil
+}
+
+type redisSimpleString string
+
+type redisError string
+
+func (redisServer) writeReply(writer io.Writer, reply interface{}) error {
+	var err error
+	switch reply := reply.(type) {
+	case nil:
+		_, err = fmt.Fprint(writer, "$-1\r\n")
+	case redisSimpleString:
+		_, err = fmt.Fprintf(writer, "+%s\r\n", reply)
+	case redisError:
+		_, err = fmt.Fprintf(writer, "-%s\r\n", reply)
+	case int:
+		_, err = fmt.Fprintf(writer, ":%d\r\n", reply)
+	case string:
+		_, err = fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(reply), reply)
+	case []string:
+		if _, err = fmt.Fprintf(writer, "*%d\r\n", len(reply)); err != nil {
+			return err
+		}
+		for _, element := range reply {
+			if _, err = fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(element), element); err != nil {
+				return err
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported reply type %T", reply)
+	}
+	return err
+}
+
+// redisLoggedCommands are commands commonly used to turn Redis into a foothold, logged as structured events.
+var redisLoggedCommands = map[string]bool{
+	"CONFIG":    true,
+	"SLAVEOF":   true,
+	"REPLICAOF": true,
+	"MODULE":    true,
+	"EVAL":      true,
+	"SAVE":      true,
+	"BGSAVE":    true,
+	"FLUSHALL":  true,
+}
+
+type redisSession struct {
+	context channelContext
+	data    map[string]string
+	config  map[string]string
+	// size counts the bytes stored in data and config by the client
+	size int
+}
+
+// set stores a value in data or config, unless it would take the session past the limits.
+func (session *redisSession) set(values map[string]string, key string, value string) bool {
+	previous, exists := values[key]
+	size := session.size - len(previous) + len(value)
+	if !exists {
+		size += len(key)
+		if len(session.data)+len(session.config) >= redisMaxKeys {
+			return false
+		}
+	}
+	if size > redisMaxDataSize {
+		return false
+	}
+	values[key] = value
+	session.size = size
+	return true
+}
+
+func (session *redisSession) delete(key string) bool {
+	value, ok := session.data[key]
+	if ok {
+		delete(session.data, key)
+		session.size -= len(key) + len(value)
+	}
+	return ok
+}
+
+func (session *redisSession) info() string {
+	return strings.Join([]string{
+		"# Server",
+		"redis_version:5.0.7",
+		"redis_mode:standalone",
+		"os:Linux 5.15.0-101-generic x86_64",
+		"arch_bits:64",
+		"tcp_port:6379",
+		"uptime_in_seconds:2592131",
+		"",
+		"# Clients",
+		"connected_clients:1",
+		"",
+		"# Replication",
+		"role:master",
+		"connected_slaves:0",
+		"",
+		"# Keyspace",
+		fmt.Sprintf("db0:keys=%d,expires=0,avg_ttl=0", len(session.data)),
+		"",
+	}, "\r\n")
+}
+
+func (session *redisSession) handle(args []string) (interface{}, bool) {
+	command := strings.ToUpper(args[0])
+	wrongArgs := redisError(fmt.Sprintf("ERR wrong number of arguments for '%v' command", strings.ToLower(command)))
+	switch command {
+	case "PING":
+		if len(args) > 1 {
+			return args[1], false
+		}
+		return redisSimpleString("PONG"), false
+	case "ECHO":
+		if len(args) != 2 {
+			return wrongArgs, false
+		}
+		return args[1], false
+	case "AUTH":
+		if len(args) < 2 || len(args) > 3 {
+			return wrongArgs, false
+		}
+		username, password := "default", args[1]
+		if len(args) == 3 {
+			username, password = args[1], args[2]
+		}
+		session.context.logEvent(tcpipAuthLog{
+			channelLog: channelLog{ChannelID: session.context.channelID},
+			Service:    "redis",
+			Username:   username,
+			Password:   password,
+			Accepted:   true,
+		})
+		return redisSimpleString("OK"), false
+	case "INFO":
+		return session.info(), false
+	case "SELECT", "SAVE", "FLUSHDB", "FLUSHALL", "SLAVEOF", "REPLICAOF":
+		if command == "FLUSHDB" || command == "FLUSHALL" {
+			for key := range session.data {
+				session.delete(key)
+			}
+		}
+		return redisSimpleString("OK"), false
+	case "BGSAVE":
+		return redisSimpleString("Background saving started"), false
+	case "DBSIZE":
+		return len(session.data), false
+	case "SET":
+		if len(args) < 3 {
+			return wrongArgs, false
+		}
+		if !session.set(session.data, args[1], args[2]) {
+			return redisOOMError, false
+		}
+		return redisSimpleString("OK"), false
+	case "GET":
+		if len(args) != 2 {
+			return wrongArgs, false
+		}
+		value, ok := session.data[args[1]]
+		if !ok {
+			return nil, false
+		}
+		return value, false
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if session.delete(key) {
+				deleted++
+			}
+		}
+		return deleted, false
+	case "KEYS":
+		if len(args) != 2 {
+			return wrongArgs, false
+		}
+		keys := []string{}
+		for key := range session.data {
+			if matched, _ := path.Match(args[1], key); matched {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		return keys, false
+	case "CONFIG":
+		if len(args) < 3 {
+			return wrongArgs, false
+		}
+		switch strings.ToUpper(args[1]) {
+		case "GET":
+			result := []string{}
+			for name, value := range session.config {
+				if matched, _ := path.Match(args[2], name); matched {
+					result = append(result, name, value)
+				}
+			}
+			return result, false
+		case "SET":
+			if len(args) != 4 {
+				return wrongArgs, false
+			}
+			if !session.set(session.config, strings.ToLower(args[2]), args[3]) {
+				return redisOOMError, false
+			}
+			return redisSimpleString("OK"), false
+		default:
+			return redisError(fmt.Sprintf("ERR Unknown subcommand or wrong number of arguments for '%v'. Try CONFIG HELP.", args[1])), false
+		}
+	case "MODULE":
+		if len(args) >= 2 && strings.ToUpper(args[1]) == "LOAD" {
+			return redisError("ERR Error loading the extension. Please check the server logs."), false
+		}
+		return []string{}, false
+	case "EVAL":
+		return redisError("ERR Error running script (call to f_8d3f4e2c1b0a): @user_script:1: Script attempted to access nonexistent global variable"), false
+	case "COMMAND", "CLIENT":
+		return []string{}, false
+	case "QUIT":
+		return redisSimpleString("OK"), true
+	default:
+		warningLogger.Printf("Unknown Redis command: %v", command)
+		return redisError(fmt.Sprintf("ERR unknown command `%v`, with args beginning with: ", args[0])), false
+	}
+}
+
+func (server redisServer) serve(context channelContext, readWriter io.ReadWriter, input chan<- string) {
+	session := &redisSession{
+		context: context,
+		data:    map[string]string{},
+		config: map[string]string{
+			"dir":            "/var/lib/redis",
+			"dbfilename":     "dump.rdb",
+			"bind":           "127.0.0.1",
+			"protected-mode": "yes",
+		},
+	}
+	reader := bufio.NewReader(readWriter)
+	for {
+		args, err := server.readCommand(reader)
+		if err != nil {
+			if err != io.EOF {
+				warningLogger.Printf("Error reading command: %v", err)
+				server.writeReply(readWriter, redisError(fmt.Sprintf("ERR Protocol error: %v", err)))
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		input <- strings.Join(args, " ")
+		if redisLoggedCommands[strings.ToUpper(args[0])] {
+			context.logEvent(redisCommandLog{
+				channelLog: channelLog{ChannelID: context.channelID},
+				Command:    strings.ToUpper(args[0]),
+				Args:       args[1:],
+			})
+		}
+		reply, quit := session.handle(args)
+		if err := server.writeReply(readWriter, reply); err != nil {
+			warningLogger.Printf("Error writing reply: %v", err)
+			return
+		}
+		if quit {
+			return
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jaksi/sshutils"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+// configReloader holds the config in effect and swaps in a new one on reloads.
+// Connections keep using the config they were accepted with until they end.
+type configReloader struct {
+	configFiles []string
+	dataDir     string
+
+	mutex   sync.Mutex
+	current atomic.Pointer[config]
+}
+
+// newConfigReloader loads the layered config and logs where its settings come from.
+func newConfigReloader(configFiles []string, dataDir string) (*configReloader, error) {
+	configString, sources, err := readConfig(configFiles)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := loadConfig(configString, dataDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	sources.log()
+	reloader := &configReloader{configFiles: configFiles, dataDir: dataDir}
+	reloader.current.Store(cfg)
+	return reloader, nil
+}
+
+// config returns the config in effect.
+func (reloader *configReloader) config() *config {
+	return reloader.current.Load()
+}
+
+// acquire returns the config in effect, keeping its outputs open for a connection until it's released.
+func (reloader *configReloader) acquire() *config {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	cfg := reloader.config()
+	cfg.acquire()
+	return cfg
+}
+
+// reopenLogs reopens the log files of the config in effect, waiting for a reload swapping them to finish.
+func (reloader *configReloader) reopenLogs() {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	reloader.config().reopenLogs()
+}
+
+// reload loads the config files again and puts the config in effect if it's valid, logging a config_reload event either way.
+func (reloader *configReloader) reload() error {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	previous := reloader.config()
+	configString, _, err := readConfig(reloader.configFiles)
+	var cfg *config
+	if err == nil {
+		cfg, err = loadConfig(configString, reloader.dataDir, previous)
+	}
+	if err != nil {
+		previous.logLocalEvent(configReloadLog{Error: err.Error(), Changed: []string{}})
+		return err
+	}
+	reloader.current.Store(cfg)
+	cfg.logLocalEvent(configReloadLog{Success: true, Changed: changedConfigKeys(previous, cfg)})
+	if cfg.Server.ListenAddress != previous.Server.ListenAddress {
+		warningLogger.Printf("The listen address only changes on restart, still listening on %v", previous.Server.ListenAddress)
+	}
+	if cfg.Admin.Address != previous.Admin.Address {
+		warningLogger.Printf("The admin API address only changes on restart, still serving it on %q", previous.Admin.Address)
+	}
+	if cfg.Logging.MetricsAddress != previous.Logging.MetricsAddress {
+		warningLogger.Printf("The metrics address only changes on restart, still serving metrics on %q", previous.Logging.MetricsAddress)
+	}
+	return nil
+}
+
+// flattenConfig maps the dotted keys of the settings in a YAML document to their values.
+func flattenConfig(prefix string, value interface{}, keys map[string]interface{}) {
+	section, ok := value.(map[interface{}]interface{})
+	if !ok || (len(section) == 0 && prefix != "") {
+		keys[prefix] = value
+		return
+	}
+	for key, value := range section {
+		name := fmt.Sprint(key)
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		flattenConfig(name, value, keys)
+	}
+}
+
+func configKeys(cfg *config) map[string]interface{} {
+	keys := map[string]interface{}{}
+	configBytes, err := yaml.Marshal(cfg)
+	if err != nil {
+		warningLogger.Printf("Failed to marshal config: %v", err)
+		return keys
+	}
+	var document interface{}
+	if err := yaml.Unmarshal(configBytes, &document); err != nil {
+		warningLogger.Printf("Failed to unmarshal config: %v", err)
+		return keys
+	}
+	flattenConfig("", document, keys)
+	return keys
+}
+
+// changedConfigKeys lists the dotted keys of the settings that differ between two configs.
+func changedConfigKeys(previous *config, cfg *config) []string {
+	previousKeys, keys := configKeys(previous), configKeys(cfg)
+	changed := []string{}
+	for key, value := range keys {
+		if previousValue, ok := previousKeys[key]; !ok || !reflect.DeepEqual(value, previousValue) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range previousKeys {
+		if _, ok := keys[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// configListener accepts SSH connections with the config in effect when they're accepted.
+type configListener struct {
+	net.Listener
+	configs *configReloader
+}
+
+// serve handles connections until the listener is closed.
+func (listener configListener) serve() error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			warningLogger.Printf("Failed to accept connection: %v", err)
+			continue
+		}
+		cfg := listener.configs.acquire()
+		go func() {
+			defer cfg.release()
+			sshConn, err := newServerConn(conn, cfg)
+			if err != nil {
+				warningLogger.Printf("Failed to establish SSH server connection: %v", err)
+				return
+			}
+			handleConnection(sshConn, cfg)
+		}()
+	}
+}
+
+// newServerConn does the SSH handshake of a connection, like sshutils.Listener.Accept but with a given config.
+func newServerConn(conn net.Conn, cfg *config) (*sshutils.Conn, error) {
+	sshConn, sshNewChannels, sshRequests, err := ssh.NewServerConn(conn, cfg.sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	newChannels := make(chan *sshutils.NewChannel)
+	requests := make(chan *ssh.Request)
+	go func() {
+		for sshNewChannels != nil || sshRequests != nil {
+			select {
+			case newChannel, ok := <-sshNewChannels:
+				if !ok {
+					close(newChannels)
+					sshNewChannels = nil
+					continue
+				}
+				newChannels <- &sshutils.NewChannel{NewChannel: newChannel}
+			case request, ok := <-sshRequests:
+				if !ok {
+					close(requests)
+					sshRequests = nil
+					continue
+				}
+				requests <- request
+			}
+		}
+	}()
+	return &sshutils.Conn{Conn: sshConn, NewChannels: newChannels, Requests: requests}, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func writeConfigFile(t *testing.T, file string, logFile string, accepted bool) {
+	t.Helper()
+	configString := fmt.Sprintf(`
+logging:
+  file: %v
+  json: true
+auth:
+  password_auth:
+    enabled: true
+    accepted: %v
+`, logFile, accepted)
+	if err := os.WriteFile(file, []byte(configString), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func configReloadEvents(t *testing.T, logFile string) []map[string]interface{} {
+	t.Helper()
+	events := []map[string]interface{}{}
+	for _, entry := range parseJSONLogs(t, readLogFile(t, logFile)) {
+		if entry["event_type"] == "config_reload" {
+			events = append(events, entry["event"].(map[string]interface{}))
+		}
+	}
+	return events
+}
+
+func TestConfigReload(t *testing.T) {
+	dataDir := t.TempDir()
+	writeTestKeys(t, dataDir)
+	configFile := path.Join(t.TempDir(), "sshesame.yaml")
+	logFile := path.Join(t.TempDir(), "sshesame.log")
+	writeConfigFile(t, configFile, logFile, false)
+	configs, err := newConfigReloader([]string{configFile}, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { configs.config().logFileHandle.Close() }()
+	previous := configs.config()
+
+	writeConfigFile(t, configFile, logFile, true)
+	if err := configs.reload(); err != nil {
+		t.Fatalf("reload()=%v, want success", err)
+	}
+	cfg := configs.config()
+	if cfg == previous || !cfg.Auth.PasswordAuth.Accepted || previous.Auth.PasswordAuth.Accepted {
+		t.Error("reload changed the previous config, want a new one")
+	}
+
+	if err := os.WriteFile(configFile, []byte("unknown_key: true\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := configs.reload(); err == nil {
+		t.Error("reload() of an invalid config succeeded, want error")
+	}
+	if configs.config() != cfg {
+		t.Error("a failed reload replaced the config, want the previous one kept")
+	}
+
+	events := configReloadEvents(t, logFile)
+	if len(events) != 2 {
+		t.Fatalf("config_reload events=%v, want 2", events)
+	}
+	if events[0]["success"] != true || !reflect.DeepEqual(events[0]["changed"], []interface{}{"auth.password_auth.accepted"}) {
+		t.Errorf("event=%v, want the changed key", events[0])
+	}
+	if events[1]["success"] != false || events[1]["error"] == nil {
+		t.Errorf("event=%v, want the error", events[1])
+	}
+}
+
+func TestConfigReloadWithoutConfigFile(t *testing.T) {
+	dataDir := t.TempDir()
+	writeTestKeys(t, dataDir)
+	configs, err := newConfigReloader(nil, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := configs.config()
+	if err := configs.reload(); err != nil {
+		t.Fatalf("reload()=%v, want the defaults reloaded", err)
+	}
+	if configs.config() == previous {
+		t.Error("reload kept the previous config, want a new one")
+	}
+}
+
+func TestChangedConfigKeys(t *testing.T) {
+	previous := &config{}
+	previous.setDefaults()
+	cfg := &config{}
+	cfg.setDefaults()
+	if changed := changedConfigKeys(previous, cfg); len(changed) != 0 {
+		t.Errorf("changedConfigKeys()=%v, want none", changed)
+	}
+	cfg.Server.ListenAddress = "0.0.0.0:22"
+	cfg.Logging.JSON = !previous.Logging.JSON
+	cfg.Server.HostKeys = append(cfg.Server.HostKeys, "key")
+	expected := []string{"logging.json", "server.host_keys", "server.listen_address"}
+	if changed := changedConfigKeys(previous, cfg); !reflect.DeepEqual(changed, expected) {
+		t.Errorf("changedConfigKeys()=%v, want %v", changed, expected)
+	}
+}
+
+func TestConfigListenerUsesReloadedConfig(t *testing.T) {
+	dataDir := t.TempDir()
+	writeTestKeys(t, dataDir)
+	configFile := path.Join(t.TempDir(), "sshesame.yaml")
+	logFile := path.Join(t.TempDir(), "sshesame.log")
+	writeConfigFile(t, configFile, logFile, false)
+	configs, err := newConfigReloader([]string{configFile}, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { configs.config().logFileHandle.Close() }()
+	netListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netListener.Close()
+	listener := configListener{trackingListener{netListener}, configs}
+	go listener.serve()
+
+	dial := func() error {
+		client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+			User:            "root",
+			Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+	if err := dial(); err == nil {
+		t.Error("login succeeded before the reload, want it rejected")
+	}
+	writeConfigFile(t, configFile, logFile, true)
+	if err := configs.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dial(); err != nil {
+		t.Errorf("login failed after the reload: %v", err)
+	}
+}
+
+func TestReloadKeepsEventStoreForConnections(t *testing.T) {
+	dataDir := t.TempDir()
+	writeTestKeys(t, dataDir)
+	configFile := path.Join(t.TempDir(), "sshesame.yaml")
+	logFile := path.Join(t.TempDir(), "sshesame.log")
+	writeStoreConfig := func(enabled bool) {
+		configString := fmt.Sprintf("logging:\n  file: %v\n  store:\n    enabled: %v\n", logFile, enabled)
+		if err := os.WriteFile(configFile, []byte(configString), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeStoreConfig(true)
+	configs, err := newConfigReloader([]string{configFile}, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { configs.config().logFileHandle.Close() }()
+	cfg := configs.acquire()
+	store := cfg.eventStore
+	cfg.logLocalEvent(connectionCloseLog{})
+
+	writeStoreConfig(false)
+	if err := configs.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if configs.config().eventStore != nil {
+		t.Error("the reloaded config has an event store, want it disabled")
+	}
+	if events := queryStore(t, store, eventFilter{eventTypes: map[string]bool{"connection_close": true}}); len(events) != 1 {
+		t.Errorf("events=%v, want the event queued before the reload stored", events)
+	}
+	if store.done == nil {
+		t.Error("the event store was closed while a connection still uses it, want it kept open")
+	}
+	cfg.release()
+	if store.done != nil {
+		t.Error("the event store is still open after the connection ended, want it closed")
+	}
+}
+
+func TestReloadRotatesAdminToken(t *testing.T) {
+	dataDir := t.TempDir()
+	writeTestKeys(t, dataDir)
+	configFile := path.Join(t.TempDir(), "sshesame.yaml")
+	logFile := path.Join(t.TempDir(), "sshesame.log")
+	writeAdminConfig := func(token string) {
+		configString := fmt.Sprintf("logging:\n  file: %v\nadmin:\n  address: 127.0.0.1:0\n  token: %v\n", logFile, token)
+		if err := os.WriteFile(configFile, []byte(configString), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeAdminConfig("old")
+	configs, err := newConfigReloader([]string{configFile}, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { configs.config().logFileHandle.Close() }()
+	server := httptest.NewServer(newAdminHandler(configs))
+	defer server.Close()
+	if response := adminRequest(t, "GET", server.URL+"/api/dashboard", "old"); response.StatusCode != http.StatusOK {
+		t.Errorf("status=%v, want 200 with the token", response.StatusCode)
+	}
+
+	writeAdminConfig("new")
+	if err := configs.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if response := adminRequest(t, "GET", server.URL+"/api/dashboard", "old"); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status=%v, want 401 with the revoked token", response.StatusCode)
+	}
+	if response := adminRequest(t, "GET", server.URL+"/api/dashboard", "new"); response.StatusCode != http.StatusOK {
+		t.Errorf("status=%v, want 200 with the new token", response.StatusCode)
+	}
+}
@@ -23,6 +23,7 @@ type replayTest struct {
 	Events    []replayTestEvent        `json:"events"`
 	PlainLogs []string                 `json:"plain_logs"`
 	JSONLogs  []map[string]interface{} `json:"json_logs"`
+	ECSLogs   []map[string]interface{} `json:"ecs_logs"`
 }
 
 type replayTestEvent struct {
@@ -584,6 +585,7 @@ func TestReplay(t *testing.T) {
 				for request := range requests {
 					t.Errorf("unexpected request: %#v", request)
 				}
+				connectionID := connContext{ConnMetadata: sshConn}.connectionID()
 				logs := strings.TrimSpace(logBuffer.String())
 				logLines := strings.Split(logs, "\n")
 				if !jsonLogging {
@@ -595,6 +597,7 @@ func TestReplay(t *testing.T) {
 							break
 						}
 						expectedLogLine := strings.ReplaceAll(testCase.PlainLogs[i], "SOURCE", conn.LocalAddr().String())
+						expectedLogLine = strings.ReplaceAll(expectedLogLine, "CONNECTION_ID", connectionID)
 						if logLine != expectedLogLine {
 							t.Errorf("Log mismatch at line %d: got \n%q, want \n%q", i, logLine, expectedLogLine)
 						}
@@ -613,6 +616,10 @@ func TestReplay(t *testing.T) {
 						}
 						expectedLogLine := testCase.JSONLogs[i]
 						expectedLogLine["source"] = conn.LocalAddr().String()
+						expectedLogLine["connection_id"] = connectionID
+						if channelID, ok := expectedLogLine["channel_id"].(string); ok {
+							expectedLogLine["channel_id"] = strings.ReplaceAll(channelID, "CONNECTION_ID", connectionID)
+						}
 						if !reflect.DeepEqual(parsedLogLine, expectedLogLine) {
 							t.Errorf("Log mismatch at line %d: got \n%#v, want \n%#v", i, parsedLogLine, expectedLogLine)
 						}
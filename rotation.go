@@ -0,0 +1,275 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultLogDatePattern = "20060102T150405"
+
+type logRotationConfig struct {
+	MaxSize     int64         `yaml:"max_size"`
+	Interval    time.Duration `yaml:"interval"`
+	MaxBackups  int           `yaml:"max_backups"`
+	Compress    bool          `yaml:"compress"`
+	DatePattern string        `yaml:"date_pattern"`
+}
+
+// rotatingFile is an append-only log file that rotates itself by size or age and can be reopened on demand.
+type rotatingFile struct {
+	mutex    sync.Mutex
+	path     string
+	rotation logRotationConfig
+	file     *os.File
+	size     int64
+	period   time.Time
+	closed   bool
+	// cleanup serializes the passes compressing and removing rotated files, which happen in the background
+	cleanup     sync.Mutex
+	cleanupDone sync.WaitGroup
+}
+
+func openRotatingFile(path string, rotation logRotationConfig) (*rotatingFile, error) {
+	if rotation.MaxSize < 0 || rotation.Interval < 0 || rotation.MaxBackups < 0 {
+		return nil, fmt.Errorf("negative log rotation setting")
+	}
+	if rotation.DatePattern == "" {
+		rotation.DatePattern = defaultLogDatePattern
+	}
+	if strings.ContainsRune(time.Now().Format(rotation.DatePattern), filepath.Separator) {
+		return nil, fmt.Errorf("date pattern %q contains a path separator", rotation.DatePattern)
+	}
+	file := &rotatingFile{path: path, rotation: rotation}
+	if err := file.open(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (file *rotatingFile) open() error {
+	f, err := os.OpenFile(file.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	file.file = f
+	file.size = info.Size()
+	// An existing file belongs to the period it was last written in
+	if file.size == 0 {
+		file.period = file.periodStart(time.Now())
+	} else {
+		file.period = file.periodStart(info.ModTime())
+	}
+	return nil
+}
+
+func (file *rotatingFile) periodStart(t time.Time) time.Time {
+	if file.rotation.Interval <= 0 {
+		return time.Time{}
+	}
+	return t.Truncate(file.rotation.Interval)
+}
+
+func (file *rotatingFile) Write(data []byte) (int, error) {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if file.file == nil {
+		return 0, os.ErrClosed
+	}
+	now := time.Now()
+	sizeExceeded := file.rotation.MaxSize > 0 && file.size > 0 && file.size+int64(len(data)) > file.rotation.MaxSize
+	periodEnded := file.rotation.Interval > 0 && !file.periodStart(now).Equal(file.period)
+	if sizeExceeded || periodEnded {
+		if err := file.rotate(now); err != nil {
+			warningLogger.Printf("Failed to rotate log file %v: %v", file.path, err)
+			if file.file == nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := file.file.Write(data)
+	file.size += int64(n)
+	return n, err
+}
+
+// backupPath names a rotated file after the period it covers, or after the rotation time for size based rotation.
+func (file *rotatingFile) backupPath(now time.Time) string {
+	stamp := now
+	if file.rotation.Interval > 0 {
+		stamp = file.period
+	}
+	backupPath := fmt.Sprintf("%v.%v", file.path, stamp.Format(file.rotation.DatePattern))
+	for i := 1; ; i++ {
+		_, err := os.Stat(backupPath)
+		_, gzErr := os.Stat(backupPath + ".gz")
+		if os.IsNotExist(err) && os.IsNotExist(gzErr) {
+			return backupPath
+		}
+		backupPath = fmt.Sprintf("%v.%v.%v", file.path, stamp.Format(file.rotation.DatePattern), i)
+	}
+}
+
+func (file *rotatingFile) rotate(now time.Time) error {
+	backupPath := file.backupPath(now)
+	if err := file.file.Close(); err != nil {
+		return err
+	}
+	file.file = nil
+	renameErr := os.Rename(file.path, backupPath)
+	if err := file.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	file.cleanupDone.Add(1)
+	go file.cleanupBackups()
+	return nil
+}
+
+// isBackup tells whether a file was rotated from this one, being named after it, a date in the date pattern,
+// and optionally a counter and .gz extension.
+func (file *rotatingFile) isBackup(name string) bool {
+	stamp, ok := strings.CutPrefix(name, file.path+".")
+	if !ok {
+		return false
+	}
+	stamp = strings.TrimSuffix(stamp, ".gz")
+	if _, err := time.Parse(file.rotation.DatePattern, stamp); err == nil {
+		return true
+	}
+	i := strings.LastIndex(stamp, ".")
+	if i < 0 {
+		return false
+	}
+	if _, err := strconv.Atoi(stamp[i+1:]); err != nil {
+		return false
+	}
+	_, err := time.Parse(file.rotation.DatePattern, stamp[:i])
+	return err == nil
+}
+
+// cleanupBackups compresses and removes rotated files in a single pass, so it never removes a file it's about to compress.
+func (file *rotatingFile) cleanupBackups() {
+	defer file.cleanupDone.Done()
+	file.cleanup.Lock()
+	defer file.cleanup.Unlock()
+	matches, err := filepath.Glob(file.path + ".*")
+	if err != nil {
+		warningLogger.Printf("Failed to list rotated log files: %v", err)
+		return
+	}
+	backups := []string{}
+	for _, backup := range matches {
+		if !file.isBackup(backup) {
+			continue
+		}
+		if file.rotation.Compress && !strings.HasSuffix(backup, ".gz") {
+			if err := compressFile(backup); err != nil {
+				warningLogger.Printf("Failed to compress rotated log file %v: %v", backup, err)
+			} else {
+				backup += ".gz"
+			}
+		}
+		backups = append(backups, backup)
+	}
+	if file.rotation.MaxBackups <= 0 {
+		return
+	}
+	modTimes := map[string]time.Time{}
+	for _, backup := range backups {
+		info, err := os.Stat(backup)
+		if err != nil {
+			continue
+		}
+		modTimes[backup] = info.ModTime()
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if !modTimes[backups[i]].Equal(modTimes[backups[j]]) {
+			return modTimes[backups[i]].After(modTimes[backups[j]])
+		}
+		return backups[i] > backups[j]
+	})
+	for _, backup := range backups[min(len(backups), file.rotation.MaxBackups):] {
+		if err := os.Remove(backup); err != nil {
+			warningLogger.Printf("Failed to remove rotated log file %v: %v", backup, err)
+		}
+	}
+}
+
+// compressFile replaces a file with a gzipped copy that keeps its modification time.
+func compressFile(path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	destination, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(destination)
+	if _, err := io.Copy(writer, source); err != nil {
+		destination.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		destination.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := destination.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := os.Chtimes(path+".gz", info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// reopen closes and reopens the file, so that an external tool can move it away.
+func (file *rotatingFile) reopen() error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if file.closed {
+		return os.ErrClosed
+	}
+	if file.file != nil {
+		if err := file.file.Close(); err != nil {
+			return err
+		}
+		file.file = nil
+	}
+	return file.open()
+}
+
+func (file *rotatingFile) Close() error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	file.cleanupDone.Wait()
+	file.closed = true
+	if file.file == nil {
+		return nil
+	}
+	err := file.file.Close()
+	file.file = nil
+	return err
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func readLogFile(t *testing.T, file string) string {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var reader io.Reader = f
+	if path.Ext(file) == ".gz" {
+		gzipReader, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = gzipReader
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotateBySize(t *testing.T) {
+	logFile := path.Join(t.TempDir(), "test.log")
+	file, err := openRotatingFile(logFile, logRotationConfig{MaxSize: 10, MaxBackups: 2, Compress: true, DatePattern: "20060102T150405.000000000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"line1\n", "line2\n", "line3\n", "line4\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if logs := readLogFile(t, logFile); logs != "line4\n" {
+		t.Errorf("logs=%q, want %q", logs, "line4\n")
+	}
+	backups, err := filepath.Glob(logFile + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(backups)
+	if len(backups) != 2 {
+		t.Fatalf("backups=%v, want 2", backups)
+	}
+	for i, expectedLogs := range []string{"line2\n", "line3\n"} {
+		if path.Ext(backups[i]) != ".gz" {
+			t.Errorf("backup=%v, want .gz", backups[i])
+		}
+		if logs := readLogFile(t, backups[i]); logs != expectedLogs {
+			t.Errorf("logs=%q, want %q", logs, expectedLogs)
+		}
+	}
+}
+
+func TestRotationKeepsUnrelatedFiles(t *testing.T) {
+	logFile := path.Join(t.TempDir(), "test.log")
+	unrelated := []string{logFile + ".json", logFile + ".20060102.bak"}
+	for _, name := range unrelated {
+		if err := os.WriteFile(name, []byte("keep\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file, err := openRotatingFile(logFile, logRotationConfig{MaxSize: 10, MaxBackups: 1, Compress: true, DatePattern: "20060102"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"line1\n", "line2\n", "line3\n", "line4\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range unrelated {
+		if logs := readLogFile(t, name); logs != "keep\n" {
+			t.Errorf("%v=%q, want it kept as it was", name, logs)
+		}
+	}
+	backups, err := filepath.Glob(logFile + ".2*.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || readLogFile(t, backups[0]) != "line3\n" {
+		t.Errorf("backups=%v, want the newest one compressed", backups)
+	}
+}
+
+func TestRotateByInterval(t *testing.T) {
+	logFile := path.Join(t.TempDir(), "test.log")
+	file, err := openRotatingFile(logFile, logRotationConfig{Interval: 24 * time.Hour, DatePattern: "2006-01-02"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("yesterday\n")); err != nil {
+		t.Fatal(err)
+	}
+	yesterday := time.Now().Add(-24 * time.Hour)
+	file.period = file.periodStart(yesterday)
+	if _, err := file.Write([]byte("today\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if logs := readLogFile(t, logFile); logs != "today\n" {
+		t.Errorf("logs=%q, want %q", logs, "today\n")
+	}
+	backup := logFile + "." + file.periodStart(yesterday).Format("2006-01-02")
+	if logs := readLogFile(t, backup); logs != "yesterday\n" {
+		t.Errorf("logs=%q, want %q", logs, "yesterday\n")
+	}
+}
+
+func TestReopenLogs(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config{}
+	cfg.Logging.File = path.Join(dir, "test.log")
+	cfg.Logging.Sinks = []logSinkConfig{{Type: "file", Path: path.Join(dir, "sink.log"), Format: "plain"}}
+	if err := cfg.setupLogging(); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"test.log", "sink.log"} {
+		if err := os.Rename(path.Join(dir, file), path.Join(dir, file+".old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg.reopenLogs()
+	connContext{ConnMetadata: mockConnContext{}, cfg: cfg}.logEvent(mockLogEntry{"lorem"})
+	cfg.logSinks.close()
+	if err := cfg.logFileHandle.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"test.log", "sink.log"} {
+		if logs := readLogFile(t, path.Join(dir, file)); logs != "[127.0.0.1:1234 736f6d6573657373] test lorem\n" {
+			t.Errorf("%v: logs=%q, want the event", file, logs)
+		}
+		if logs := readLogFile(t, path.Join(dir, file+".old")); logs != "" {
+			t.Errorf("%v.old: logs=%q, want empty", file, logs)
+		}
+	}
+}
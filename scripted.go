@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+type scriptedRuleConfig struct {
+	Match    string `yaml:"match"`
+	Response string `yaml:"response"`
+	Close    bool   `yaml:"close"`
+}
+
+type scriptedServiceConfig struct {
+	Mode    string               `yaml:"mode"`
+	Banner  string               `yaml:"banner"`
+	Rules   []scriptedRuleConfig `yaml:"rules"`
+	Default string               `yaml:"default"`
+}
+
+type scriptedRule struct {
+	match    *regexp.Regexp
+	response string
+	close    bool
+}
+
+// scriptedMaxRequestSize caps the lines read in line mode and the chunks read in bytes mode.
+const scriptedMaxRequestSize = 4096
+
+// scriptedServer fakes a protocol with a banner and canned responses to matching requests.
+type scriptedServer struct {
+	lineMode bool
+	banner   string
+	rules    []scriptedRule
+	fallback string
+}
+
+func newScriptedServer(serviceConfig scriptedServiceConfig) (scriptedServer, error) {
+	server := scriptedServer{
+		banner:   serviceConfig.Banner,
+		fallback: serviceConfig.Default,
+	}
+	switch serviceConfig.Mode {
+	case "", "line":
+		server.lineMode = true
+	case "bytes":
+	default:
+		return scriptedServer{}, fmt.Errorf("unknown mode %q", serviceConfig.Mode)
+	}
+	for _, ruleConfig := range serviceConfig.Rules {
+		match, err := regexp.Compile(ruleConfig.Match)
+		if err != nil {
+			return scriptedServer{}, err
+		}
+		server.rules = append(server.rules, scriptedRule{match, ruleConfig.Response, ruleConfig.Close})
+	}
+	return server, nil
+}
+
+// newScriptedServers compiles the scripted services, which must not shadow the built-in ones.
+func newScriptedServers(serviceConfigs map[string]scriptedServiceConfig) (map[string]tcpipServer, error) {
+	scriptedServers := map[string]tcpipServer{}
+	for name, serviceConfig := range serviceConfigs {
+		if _, ok := servers[name]; ok {
+			return nil, fmt.Errorf("scripted service %q conflicts with a built-in service", name)
+		}
+		server, err := newScriptedServer(serviceConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scripted service %q: %w", name, err)
+		}
+		scriptedServers[name] = server
+	}
+	return scriptedServers, nil
+}
+
+// respond returns the response to a request, expanding $1 style references to groups of the matching rule.
+func (server scriptedServer) respond(request string) (string, bool) {
+	for _, rule := range server.rules {
+		submatches := rule.match.FindStringSubmatchIndex(request)
+		if submatches == nil {
+			continue
+		}
+		return string(rule.match.ExpandString(nil, rule.response, request, submatches)), rule.close
+	}
+	return server.fallback, false
+}
+
+func (server scriptedServer) read(reader *bufio.Reader) (string, error) {
+	if server.lineMode {
+		line, err := readLimitedLine(reader, scriptedMaxRequestSize)
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	buffer := make([]byte, scriptedMaxRequestSize)
+	n, err := reader.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+	return string(buffer[:n]), nil
+}
+
+func (server scriptedServer) serve(context channelContext, readWriter io.ReadWriter, input chan<- string) {
+	if _, err := io.WriteString(readWriter, server.banner); err != nil {
+		warningLogger.Printf("Error writing banner: %v", err)
+		return
+	}
+	reader := bufio.NewReader(readWriter)
+	for {
+		request, err := server.read(reader)
+		if errors.Is(err, errLineTooLong) {
+			// Overlong lines get the default response without being matched
+			if _, err := io.WriteString(readWriter, server.fallback); err != nil {
+				warningLogger.Printf("Error writing response: %v", err)
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				warningLogger.Printf("Error reading request: %v", err)
+			}
+			return
+		}
+		input <- request
+		response, close := server.respond(request)
+		if _, err := io.WriteString(readWriter, response); err != nil {
+			warningLogger.Printf("Error writing response: %v", err)
+			return
+		}
+		if close {
+			return
+		}
+	}
+}
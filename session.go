@@ -141,6 +141,21 @@ type sessionContext struct {
 	inputChan chan string
 	active    bool
 	pty       bool
+	recording *asciicastRecording // Recording of the PTY session, if artifacts are kept
+	broadcast *terminalBroadcast  // The PTY session shared with spectators on the admin API
+	takeover  *sessionTakeover    // Lets an operator answer instead of the emulator on the admin API
+}
+
+// observers returns what the PTY session is passed to.
+func (context *sessionContext) observers() []terminalObserver {
+	observers := []terminalObserver{}
+	if context.recording != nil {
+		observers = append(observers, context.recording)
+	}
+	if context.broadcast != nil {
+		observers = append(observers, context.broadcast)
+	}
+	return observers
 }
 
 type scannerReadLiner struct {
@@ -207,12 +222,20 @@ func (context *sessionContext) handleProgram(program []string) {
 	context.active = true // Mark session as active
 	var stdin readLiner
 	var stdout, stderr io.Writer
+	var channel io.ReadWriter = context // context itself implements io.ReadWriter
 
 	// Set up I/O based on whether a PTY was requested
 	if context.pty {
 		// Use terminal for I/O in PTY mode
-		terminal := term.NewTerminal(context, "") // context itself implements io.ReadWriter
+		if observers := context.observers(); len(observers) > 0 {
+			channel = observedReadWriter{channel, observers}
+		}
+		terminal := term.NewTerminal(channel, "")
 		stdin = terminalReadLiner{terminal, context.inputChan}
+		if context.takeover != nil {
+			context.takeover.start(terminal)
+			stdin = takeoverReadLiner{stdin, context.takeover}
+		}
 		stdout = terminal
 		stderr = terminal
 	} else {
@@ -247,6 +270,7 @@ func (context *sessionContext) handleProgram(program []string) {
 			user:     context.User(), // Get user from embedded channelContext
 			cwd:      nil,            // cwd is managed internally by the shell command
 			hostname: remoteAddrStr,  // Provide an initial hostname
+			channel:  context.channelContext,
 		})
 
 		// Log execution errors (excluding expected EOF types)
@@ -259,7 +283,7 @@ func (context *sessionContext) handleProgram(program []string) {
 
 		// Handle client EOF in PTY mode by sending CRLF for cleaner terminal output
 		if err == clientEOF && context.pty {
-			if _, writeErr := context.Write([]byte("\r\n")); writeErr != nil {
+			if _, writeErr := channel.Write([]byte("\r\n")); writeErr != nil {
 				warningLogger.Printf("发送CRLF时出错: %s", writeErr) // Changed to Chinese
 				// Don't return here, still try to send exit status
 			}
@@ -320,6 +344,19 @@ func (context *sessionContext) handleRequest(request *ssh.Request) error {
 			return err // Error sending reply
 		}
 		context.pty = true // Mark PTY as active for this session
+		if context.cfg.artifacts != nil && context.cfg.Logging.Recordings.Enabled {
+			recording, err := newAsciicastRecording(context.cfg.artifacts, uniqueChannelID(context.connectionID(), context.channelID), *payload, context.cfg.Logging.Recordings.MaxSize)
+			if err != nil {
+				warningLogger.Printf("无法创建会话录像: %v", err)
+			} else {
+				context.recording = recording
+			}
+		}
+		if live := getLiveConnection(context.connectionID()); live != nil && context.broadcast == nil {
+			context.broadcast = newTerminalBroadcast(*payload)
+			context.takeover = &sessionTakeover{context: context.channelContext}
+			live.addTerminal(context.channelID, liveTerminal{context.broadcast, context.takeover})
+		}
 		return nil
 
 	case "shell":
@@ -417,6 +454,9 @@ func (context *sessionContext) handleRequest(request *ssh.Request) error {
 			return err
 		}
 		context.logEvent(payload.logEntry(context.channelID)) // Log window change
+		for _, observer := range context.observers() {
+			observer.resize(payload.Width, payload.Height)
+		}
 		// NOTE: Window size changes are logged but not acted upon in this example.
 		// A real implementation would potentially resize the PTY.
 		// No reply is sent for window-change requests according to RFC 4254 Section 6.7
@@ -481,7 +521,7 @@ func handleSessionChannel(newChannel ssh.NewChannel, context channelContext) err
 	}
 
 	// Increment metrics and log channel opening
-	sessionChannelsMetric.Inc()
+	incWithExemplar(sessionChannelsMetric, context.connectionID())
 	activeSessionChannelsMetric.Inc()
 	defer activeSessionChannelsMetric.Dec() // Decrement active count when function returns
 
@@ -498,7 +538,21 @@ func handleSessionChannel(newChannel ssh.NewChannel, context channelContext) err
 
 	// Create the session context
 	inputChan := make(chan string, 10) // Buffered channel for input logging
-	session := sessionContext{context, channel, inputChan, false, false}
+	session := sessionContext{context, channel, inputChan, false, false, nil, nil, nil}
+	defer func() {
+		if session.broadcast != nil {
+			if live := getLiveConnection(context.connectionID()); live != nil {
+				live.removeTerminal(context.channelID)
+			}
+			session.broadcast.close()
+			session.takeover.close()
+		}
+		if session.recording != nil {
+			if err := session.recording.close(); err != nil {
+				warningLogger.Printf("无法关闭会话录像: %v", err)
+			}
+		}
+	}()
 
 	// Main loop to handle requests and logged input
 	for inputChan != nil || requests != nil {
@@ -509,11 +563,13 @@ func handleSessionChannel(newChannel ssh.NewChannel, context channelContext) err
 				continue
 			}
 			// Log input received from the program execution context
+			encodedInput, encoding := encodePayload([]byte(input), context.cfg.Logging.PayloadEncoding)
 			context.logEvent(sessionInputLog{
 				channelLog: channelLog{
 					ChannelID: context.channelID,
 				},
-				Input: input,
+				Input:    encodedInput,
+				Encoding: encoding,
 			})
 		case request, ok := <-requests:
 			if !ok {
@@ -530,13 +586,16 @@ func handleSessionChannel(newChannel ssh.NewChannel, context channelContext) err
 			}
 
 			// Log the raw request for debugging if needed
+			payload, encoding := encodePayload(request.Payload, context.cfg.Logging.PayloadEncoding)
 			context.logEvent(debugChannelRequestLog{
 				channelLog: channelLog{
 					ChannelID: context.channelID,
 				},
 				RequestType: request.Type,
 				WantReply:   request.WantReply,
-				Payload:     string(request.Payload), // Log payload as string
+				Payload:     payload,
+				Encoding:    encoding,
+				Decoded:     channelRequestDecoders.decode(request.Type, request.Payload),
 			})
 
 			// Handle the specific request type
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const smtpMaxRecipients = 100
+
+// smtpMaxLineLength caps command and message lines, well above the 1000 bytes RFC 5321 allows.
+const smtpMaxLineLength = 4096
+
+var smtpMessagesMetric = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "sshesame_smtp_messages_total",
+	Help: "Total number of messages received by the fake SMTP server",
+})
+
+type smtpServer struct{}
+
+type smtpReply struct {
+	code    int
+	message string
+}
+
+func (smtpServer) writeReply(writer io.Writer, reply smtpReply) error {
+	lines := strings.Split(reply.message, "\n")
+	for _, line := range lines[:len(lines)-1] {
+		if _, err := fmt.Fprintf(writer, "%d-%s\r\n", reply.code, line); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(writer, "%d %s\r\n", reply.code, lines[len(lines)-1]); err != nil {
+		return err
+	}
+	return nil
+}
+
+type smtpCommand struct {
+	command string
+	params  []string
+}
+
+func (command smtpCommand) String() string {
+	if len(command.params) == 0 {
+		return command.command
+	}
+	return fmt.Sprintf("%s %s", command.command, strings.Join(command.params, " "))
+}
+
+func (smtpServer) readCommand(reader *bufio.Reader) (smtpCommand, error) {
+	line, err := readLimitedLine(reader, smtpMaxLineLength)
+	if err != nil {
+		return smtpCommand{}, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return smtpCommand{}, nil
+	}
+	command := strings.ToUpper(fields[0])
+	params := fields[1:]
+	return smtpCommand{command, params}, nil
+}
+
+// readData reads a dot-terminated message body, undoing dot-stuffing.
+// Data beyond maxSize and overlong lines are read and discarded, and reported by the second return value.
+func (smtpServer) readData(reader *bufio.Reader, maxSize int) ([]byte, bool, error) {
+	data := bytes.Buffer{}
+	exceeded := false
+	for {
+		line, err := readLimitedLine(reader, smtpMaxLineLength)
+		if errors.Is(err, errLineTooLong) {
+			exceeded = true
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if line == ".\r\n" || line == ".\n" {
+			return data.Bytes(), exceeded, nil
+		}
+		line = strings.TrimPrefix(line, ".")
+		if maxSize > 0 && data.Len()+len(line) > maxSize {
+			exceeded = true
+			continue
+		}
+		data.WriteString(line)
+	}
+}
+
+// smtpSession holds the state of a single SMTP conversation.
+type smtpSession struct {
+	server     smtpServer
+	context    channelContext
+	readWriter io.ReadWriter
+	reader     *bufio.Reader
+	input      chan<- string
+	tls        bool
+	helo       string
+	user       string
+	from       string
+	recipients []string
+}
+
+func (session *smtpSession) hostname() string {
+	if session.context.cfg.Services.SMTP.Hostname == "" {
+		return "localhost"
+	}
+	return session.context.cfg.Services.SMTP.Hostname
+}
+
+func (session *smtpSession) startTLSAvailable() bool {
+	return session.context.cfg.Services.SMTP.StartTLS && session.context.cfg.tlsConfig != nil && !session.tls
+}
+
+func (session *smtpSession) reset() {
+	session.from = ""
+	session.recipients = nil
+}
+
+func (session *smtpSession) readLine() (string, error) {
+	line, err := readLimitedLine(session.reader, smtpMaxLineLength)
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	session.input <- line
+	return line, nil
+}
+
+// parsePath extracts the address from a "FROM:<address>" or "TO:<address>" argument and returns the remaining ESMTP parameters.
+func (smtpServer) parsePath(params []string, prefix string) (string, []string, bool) {
+	arg := strings.Join(params, " ")
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		fields := strings.Fields(arg)
+		if len(fields) == 0 {
+			return "", nil, false
+		}
+		return fields[0], fields[1:], true
+	}
+	end := strings.Index(arg, ">")
+	if end == -1 {
+		return "", nil, false
+	}
+	return arg[1:end], strings.Fields(arg[end+1:]), true
+}
+
+func (session *smtpSession) ehlo(command smtpCommand) smtpReply {
+	if len(command.params) == 0 {
+		return smtpReply{501, "5.5.4 Syntax: EHLO hostname"}
+	}
+	session.reset()
+	session.helo = command.params[0]
+	extensions := []string{session.hostname(), "PIPELINING"}
+	if maxSize := session.context.cfg.Services.SMTP.MaxMessageSize; maxSize > 0 {
+		extensions = append(extensions, fmt.Sprintf("SIZE %d", maxSize))
+	} else {
+		extensions = append(extensions, "SIZE")
+	}
+	if session.startTLSAvailable() {
+		extensions = append(extensions, "STARTTLS")
+	}
+	extensions = append(extensions, "AUTH PLAIN LOGIN", "ENHANCEDSTATUSCODES", "8BITMIME")
+	return smtpReply{250, strings.Join(extensions, "\n")}
+}
+
+func (session *smtpSession) startTLS() (smtpReply, error) {
+	if session.tls {
+		return smtpReply{503, "5.5.1 Error: TLS already active"}, nil
+	}
+	if !session.startTLSAvailable() {
+		return smtpReply{502, "5.5.2 Error: command not recognized"}, nil
+	}
+	if err := session.server.writeReply(session.readWriter, smtpReply{220, "2.0.0 Ready to start TLS"}); err != nil {
+		return smtpReply{}, err
+	}
+	tlsConn := tls.Server(readWriterConn{session.readWriter}, session.context.cfg.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return smtpReply{}, err
+	}
+	session.readWriter = tlsConn
+	session.reader = bufio.NewReader(tlsConn)
+	session.tls = true
+	session.helo = ""
+	session.reset()
+	return smtpReply{}, nil
+}
+
+func (session *smtpSession) authResponse(initial string, challenge string) ([]byte, error) {
+	response := initial
+	if response == "" {
+		if err := session.server.writeReply(session.readWriter, smtpReply{334, challenge}); err != nil {
+			return nil, err
+		}
+		var err error
+		response, err = session.readLine()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if response == "*" {
+		return nil, errSMTPAuthCanceled
+	}
+	if response == "=" {
+		return []byte{}, nil
+	}
+	return base64.StdEncoding.DecodeString(response)
+}
+
+var errSMTPAuthCanceled = errors.New("authentication canceled")
+
+func (session *smtpSession) auth(command smtpCommand) (smtpReply, error) {
+	if session.helo == "" {
+		return smtpReply{503, "5.5.1 Error: send HELO/EHLO first"}, nil
+	}
+	if session.user != "" {
+		return smtpReply{503, "5.5.1 Error: already authenticated"}, nil
+	}
+	if len(command.params) == 0 {
+		return smtpReply{501, "5.5.4 Syntax: AUTH mechanism"}, nil
+	}
+	mechanism := strings.ToUpper(command.params[0])
+	initial := ""
+	if len(command.params) > 1 {
+		initial = command.params[1]
+	}
+	var username, password string
+	switch mechanism {
+	case "PLAIN":
+		response, err := session.authResponse(initial, "")
+		if err != nil {
+			return session.authError(err)
+		}
+		parts := strings.SplitN(string(response), "\x00", 3)
+		if len(parts) != 3 {
+			return smtpReply{501, "5.5.2 Error: invalid SASL PLAIN response"}, nil
+		}
+		username, password = parts[1], parts[2]
+	case "LOGIN":
+		response, err := session.authResponse(initial, base64.StdEncoding.EncodeToString([]byte("Username:")))
+		if err != nil {
+			return session.authError(err)
+		}
+		username = string(response)
+		response, err = session.authResponse("", base64.StdEncoding.EncodeToString([]byte("Password:")))
+		if err != nil {
+			return session.authError(err)
+		}
+		password = string(response)
+	default:
+		return smtpReply{504, "5.5.4 Unrecognized authentication type"}, nil
+	}
+	accepted := session.context.cfg.Services.SMTP.AuthAccepted
+	session.context.logEvent(smtpAuthLog{
+		channelLog: channelLog{ChannelID: session.context.channelID},
+		Mechanism:  mechanism,
+		Username:   username,
+		Password:   password,
+		Accepted:   authAccepted(accepted),
+	})
+	if !accepted {
+		return smtpReply{535, "5.7.8 Error: authentication failed"}, nil
+	}
+	session.user = username
+	return smtpReply{235, "2.7.0 Authentication successful"}, nil
+}
+
+func (session *smtpSession) authError(err error) (smtpReply, error) {
+	if err == errSMTPAuthCanceled {
+		return smtpReply{501, "5.7.0 Authentication aborted"}, nil
+	}
+	if _, ok := err.(base64.CorruptInputError); ok {
+		return smtpReply{501, "5.5.2 Cannot decode response"}, nil
+	}
+	if errors.Is(err, errLineTooLong) {
+		return smtpReply{500, "5.5.2 Error: line too long"}, nil
+	}
+	return smtpReply{}, err
+}
+
+func (session *smtpSession) mail(command smtpCommand) smtpReply {
+	if session.helo == "" {
+		return smtpReply{503, "5.5.1 Error: send HELO/EHLO first"}
+	}
+	if session.from != "" {
+		return smtpReply{503, "5.5.1 Error: nested MAIL command"}
+	}
+	from, params, ok := session.server.parsePath(command.params, "FROM:")
+	if !ok {
+		return smtpReply{501, "5.5.4 Syntax: MAIL FROM:<address>"}
+	}
+	for _, param := range params {
+		if !strings.HasPrefix(strings.ToUpper(param), "SIZE=") {
+			continue
+		}
+		size, err := strconv.Atoi(param[len("SIZE="):])
+		if err != nil {
+			return smtpReply{501, "5.5.4 Bad message size syntax"}
+		}
+		if maxSize := session.context.cfg.Services.SMTP.MaxMessageSize; maxSize > 0 && size > maxSize {
+			return smtpReply{552, "5.3.4 Message size exceeds fixed limit"}
+		}
+	}
+	if from == "" {
+		// Null reverse-path, used by bounces
+		from = "<>"
+	}
+	session.from = from
+	return smtpReply{250, "2.1.0 Ok"}
+}
+
+func (session *smtpSession) rcpt(command smtpCommand) smtpReply {
+	if session.from == "" {
+		return smtpReply{503, "5.5.1 Error: need MAIL command"}
+	}
+	if len(session.recipients) >= smtpMaxRecipients {
+		return smtpReply{452, "4.5.3 Error: too many recipients"}
+	}
+	to, _, ok := session.server.parsePath(command.params, "TO:")
+	if !ok || to == "" {
+		return smtpReply{501, "5.5.4 Syntax: RCPT TO:<address>"}
+	}
+	session.recipients = append(session.recipients, to)
+	return smtpReply{250, "2.1.5 Ok"}
+}
+
+func (session *smtpSession) data() (smtpReply, error) {
+	if session.from == "" {
+		return smtpReply{503, "5.5.1 Error: need MAIL command"}, nil
+	}
+	if len(session.recipients) == 0 {
+		return smtpReply{554, "5.5.1 Error: no valid recipients"}, nil
+	}
+	if err := session.server.writeReply(session.readWriter, smtpReply{354, "End data with <CR><LF>.<CR><LF>"}); err != nil {
+		return smtpReply{}, err
+	}
+	data, exceeded, err := session.server.readData(session.reader, session.context.cfg.Services.SMTP.MaxMessageSize)
+	if err != nil {
+		return smtpReply{}, err
+	}
+	defer session.reset()
+	if exceeded {
+		return smtpReply{552, "5.3.4 Error: message file too big"}, nil
+	}
+	queueID := session.queueID()
+	message := session.message(queueID, data)
+	smtpMessagesMetric.Inc()
+	file := ""
+	if session.context.cfg.artifacts != nil {
+		file, err = session.context.cfg.artifacts.save("smtp", session.context.connectionID(), ".eml", message)
+		if err != nil {
+			warningLogger.Printf("Error saving message: %v", err)
+		}
+	}
+	if file == "" {
+		session.input <- string(data)
+	}
+	session.context.logEvent(smtpMessageLog{
+		channelLog: channelLog{ChannelID: session.context.channelID},
+		From:       session.from,
+		To:         session.recipients,
+		Subject:    session.subject(data),
+		Size:       len(data),
+		File:       file,
+	})
+	return smtpReply{250, fmt.Sprintf("2.0.0 Ok: queued as %v", queueID)}, nil
+}
+
+func (smtpSession) queueID() string {
+	id := make([]byte, 5)
+	if _, err := rand.Read(id); err != nil {
+		return "0000000000"
+	}
+	return strings.ToUpper(hex.EncodeToString(id))
+}
+
+// message prepends the trace headers a real MTA would add, making the message a complete RFC 5322 file.
+func (session *smtpSession) message(queueID string, data []byte) []byte {
+	protocol := "ESMTP"
+	if session.tls {
+		protocol += "S"
+	}
+	if session.user != "" {
+		protocol += "A"
+	}
+	remoteHost := session.context.RemoteAddr().String()
+	if tcpAddr, ok := session.context.RemoteAddr().(*net.TCPAddr); ok {
+		remoteHost = tcpAddr.IP.String()
+	}
+	from := session.from
+	if from == "<>" {
+		from = ""
+	}
+	message := bytes.Buffer{}
+	fmt.Fprintf(&message, "Return-Path: <%v>\r\n", from)
+	fmt.Fprintf(&message, "Received: from %v ([%v])\r\n\tby %v with %v id %v\r\n\tfor <%v>; %v\r\n",
+		session.helo, remoteHost, session.hostname(), protocol, queueID, session.recipients[0], time.Now().Format(time.RFC1123Z))
+	message.Write(data)
+	return message.Bytes()
+}
+
+func (smtpSession) subject(data []byte) string {
+	message, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	subject := message.Header.Get("Subject")
+	decoded, err := new(mime.WordDecoder).DecodeHeader(subject)
+	if err != nil {
+		return subject
+	}
+	return decoded
+}
+
+func (session *smtpSession) handle(command smtpCommand) (smtpReply, error) {
+	switch command.command {
+	case "":
+		return smtpReply{500, "5.5.2 Error: bad syntax"}, nil
+	case "HELO":
+		if len(command.params) == 0 {
+			return smtpReply{501, "Syntax: HELO hostname"}, nil
+		}
+		session.reset()
+		session.helo = command.params[0]
+		return smtpReply{250, session.hostname()}, nil
+	case "EHLO":
+		return session.ehlo(command), nil
+	case "STARTTLS":
+		return session.startTLS()
+	case "AUTH":
+		return session.auth(command)
+	case "MAIL":
+		return session.mail(command), nil
+	case "RCPT":
+		return session.rcpt(command), nil
+	case "DATA":
+		return session.data()
+	case "RSET":
+		session.reset()
+		return smtpReply{250, "2.0.0 Ok"}, nil
+	case "NOOP":
+		return smtpReply{250, "2.0.0 Ok"}, nil
+	case "VRFY":
+		return smtpReply{252, "2.0.0 Cannot VRFY user, but will accept message and attempt delivery"}, nil
+	case "QUIT":
+		return smtpReply{221, "2.0.0 Bye"}, nil
+	default:
+		warningLogger.Printf("Unknown SMTP command: %v", command)
+		return smtpReply{502, "5.5.2 Error: command not recognized"}, nil
+	}
+}
+
+func (server smtpServer) serve(context channelContext, readWriter io.ReadWriter, input chan<- string) {
+	session := &smtpSession{
+		server:     server,
+		context:    context,
+		readWriter: readWriter,
+		reader:     bufio.NewReader(readWriter),
+		input:      input,
+	}
+	if err := server.writeReply(readWriter, smtpReply{220, fmt.Sprintf("%v ESMTP", session.hostname())}); err != nil {
+		warningLogger.Printf("Error writing greeting: %v", err)
+		return
+	}
+	for {
+		command, err := server.readCommand(session.reader)
+		if errors.Is(err, errLineTooLong) {
+			if err := server.writeReply(session.readWriter, smtpReply{500, "5.5.2 Error: line too long"}); err != nil {
+				warningLogger.Printf("Error writing reply: %v", err)
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				warningLogger.Printf("Error reading command: %v", err)
+			}
+			return
+		}
+		input <- command.String()
+		reply, err := session.handle(command)
+		if err != nil {
+			warningLogger.Printf("Error handling %v command: %v", command.command, err)
+			return
+		}
+		if reply.code == 0 {
+			continue
+		}
+		if err := server.writeReply(session.readWriter, reply); err != nil {
+			warningLogger.Printf("Error writing reply: %v", err)
+			return
+		}
+		if command.command == "QUIT" {
+			return
+		}
+	}
+}
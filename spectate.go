@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// terminalBroadcastBuffer is how many events a spectator can fall behind before events are dropped for it.
+const terminalBroadcastBuffer = 1024
+
+// terminalBroadcast shares a PTY session with spectators, without ever blocking the session.
+type terminalBroadcast struct {
+	start time.Time
+	term  string
+
+	mutex         sync.Mutex
+	width, height uint32
+	spectators    map[chan asciicastEvent]bool
+	closed        bool
+}
+
+func newTerminalBroadcast(pty ptyRequestPayload) *terminalBroadcast {
+	return &terminalBroadcast{
+		start:      time.Now(),
+		term:       pty.Term,
+		width:      pty.Width,
+		height:     pty.Height,
+		spectators: map[chan asciicastEvent]bool{},
+	}
+}
+
+func (broadcast *terminalBroadcast) event(code string, data []byte) {
+	broadcast.mutex.Lock()
+	defer broadcast.mutex.Unlock()
+	if len(broadcast.spectators) == 0 {
+		return
+	}
+	event := asciicastEvent{time.Since(broadcast.start).Seconds(), code, string(data)}
+	for spectator := range broadcast.spectators {
+		select {
+		case spectator <- event:
+		default:
+		}
+	}
+}
+
+func (broadcast *terminalBroadcast) resize(width, height uint32) {
+	broadcast.mutex.Lock()
+	broadcast.width, broadcast.height = width, height
+	broadcast.mutex.Unlock()
+	broadcast.event("r", []byte(fmt.Sprintf("%vx%v", width, height)))
+}
+
+// spectate subscribes to the session, returning the header describing the terminal at this point.
+// The events channel is closed when the session ends.
+func (broadcast *terminalBroadcast) spectate() (asciicastHeader, chan asciicastEvent) {
+	broadcast.mutex.Lock()
+	defer broadcast.mutex.Unlock()
+	header := asciicastHeader{
+		Version:   2,
+		Width:     broadcast.width,
+		Height:    broadcast.height,
+		Timestamp: broadcast.start.Unix(),
+	}
+	if broadcast.term != "" {
+		header.Env = map[string]string{"TERM": broadcast.term}
+	}
+	events := make(chan asciicastEvent, terminalBroadcastBuffer)
+	if broadcast.closed {
+		close(events)
+	} else {
+		broadcast.spectators[events] = true
+	}
+	return header, events
+}
+
+func (broadcast *terminalBroadcast) stopSpectating(events chan asciicastEvent) {
+	broadcast.mutex.Lock()
+	defer broadcast.mutex.Unlock()
+	if broadcast.spectators[events] {
+		delete(broadcast.spectators, events)
+		close(events)
+	}
+}
+
+func (broadcast *terminalBroadcast) close() {
+	broadcast.mutex.Lock()
+	defer broadcast.mutex.Unlock()
+	broadcast.closed = true
+	for spectator := range broadcast.spectators {
+		close(spectator)
+	}
+	broadcast.spectators = map[chan asciicastEvent]bool{}
+}
+
+// liveTerminal is a PTY session of a live connection.
+type liveTerminal struct {
+	broadcast *terminalBroadcast
+	takeover  *sessionTakeover
+}
+
+func (connection *liveConnection) addTerminal(channelID int, terminal liveTerminal) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	connection.terminals[channelID] = terminal
+}
+
+func (connection *liveConnection) removeTerminal(channelID int) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	delete(connection.terminals, channelID)
+}
+
+// terminal returns the PTY session of a channel, or the first one of the connection if channelID is negative.
+func (connection *liveConnection) terminal(channelID int) (liveTerminal, bool) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if channelID >= 0 {
+		terminal, ok := connection.terminals[channelID]
+		return terminal, ok
+	}
+	first := liveTerminal{}
+	firstID := -1
+	for id, terminal := range connection.terminals {
+		if firstID == -1 || id < firstID {
+			first, firstID = terminal, id
+		}
+	}
+	return first, firstID != -1
+}
+
+// requestedTerminal returns the PTY session selected by the channel query parameter of a request,
+// or writes an error if there's no such session.
+func requestedTerminal(writer http.ResponseWriter, request *http.Request, connection *liveConnection) (liveTerminal, bool) {
+	channelID := -1
+	if channel := request.URL.Query().Get("channel"); channel != "" {
+		var err error
+		if channelID, err = strconv.Atoi(channel); err != nil || channelID < 0 {
+			http.Error(writer, "invalid channel", http.StatusBadRequest)
+			return liveTerminal{}, false
+		}
+	}
+	terminal, ok := connection.terminal(channelID)
+	if !ok {
+		http.Error(writer, "no PTY session on the connection", http.StatusNotFound)
+	}
+	return terminal, ok
+}
+
+// serveSpectator streams a PTY session of a connection as asciicast v2 until it ends or the spectator leaves.
+func serveSpectator(writer http.ResponseWriter, request *http.Request, connection *liveConnection) {
+	terminal, ok := requestedTerminal(writer, request, connection)
+	if !ok {
+		return
+	}
+	header, events := terminal.broadcast.spectate()
+	defer terminal.broadcast.stopSpectating(events)
+	flusher, _ := writer.(http.Flusher)
+	writer.Header().Set("Content-Type", "application/x-asciicast")
+	encoder := json.NewEncoder(writer)
+	if err := encoder.Encode(header); err != nil {
+		return
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	pending := map[string][]byte{}
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			var data []byte
+			data, pending[event.code] = splitIncompleteUTF8(pending[event.code], []byte(event.data))
+			if len(data) == 0 {
+				continue
+			}
+			if err := encoder.Encode([]interface{}{event.time, event.code, string(data)}); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// adminClient talks to the admin API about a PTY session, for the watch and takeover subcommands.
+type adminClient struct {
+	url          string
+	token        string
+	connectionID string
+	channel      string
+}
+
+// newAdminClient parses the flags shared by the admin API subcommands and the connection or channel ID argument.
+func newAdminClient(name string, description string, args []string) (*adminClient, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	adminURL := flags.String("admin", "http://127.0.0.1:2023", "URL of the admin API")
+	token := flags.String("token", os.Getenv("SSHESAME_ADMIN_TOKEN"), "admin API token, defaults to $SSHESAME_ADMIN_TOKEN")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v %v [flags] <connection or channel ID>\n\n%v\n\n", os.Args[0], name, description)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return nil, errors.New("expected a single connection or channel ID")
+	}
+	connectionID, channel, _ := strings.Cut(flags.Arg(0), "-")
+	return &adminClient{strings.TrimSuffix(*adminURL, "/"), *token, connectionID, channel}, nil
+}
+
+// do sends a request about the session to the admin API, failing unless it succeeds.
+func (client *adminClient) do(method string, endpoint string, body io.Reader) (*http.Response, error) {
+	url := fmt.Sprintf("%v/api/connections/%v/%v", client.url, client.connectionID, endpoint)
+	if client.channel != "" {
+		url += "?channel=" + client.channel
+	}
+	request, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+client.token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 != 2 {
+		defer response.Body.Close()
+		message, _ := bufio.NewReader(response.Body).ReadString('\n')
+		return nil, fmt.Errorf("%v: %v", response.Status, strings.TrimSpace(message))
+	}
+	return response, nil
+}
+
+// watch writes the output of the session to output until it ends.
+func (client *adminClient) watch(output io.Writer) error {
+	response, err := client.do("GET", "watch", nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	header, events, err := newAsciicastReader(response.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Watching %v (%vx%v), press Ctrl+C to stop\r\n", client.connectionID, header.Width, header.Height)
+	for {
+		event, err := events.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if event.code == "o" {
+			io.WriteString(output, event.data)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\r\nSession ended\r\n")
+	return nil
+}
+
+func watchCommand(args []string) error {
+	client, err := newAdminClient("watch", "Watches a live PTY session read-only until it ends.", args)
+	if err != nil {
+		return err
+	}
+	return client.watch(os.Stdout)
+}
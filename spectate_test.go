@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaksi/sshutils"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestTerminalBroadcastDropsForSlowSpectators(t *testing.T) {
+	broadcast := newTerminalBroadcast(ptyRequestPayload{Term: "xterm", Width: 80, Height: 24})
+	header, events := broadcast.spectate()
+	if header.Width != 80 || header.Height != 24 || header.Env["TERM"] != "xterm" {
+		t.Errorf("header=%+v, want the PTY size and terminal", header)
+	}
+	for i := 0; i < terminalBroadcastBuffer+10; i++ {
+		broadcast.event("o", []byte("x"))
+	}
+	broadcast.resize(100, 30)
+	if header, _ := broadcast.spectate(); header.Width != 100 || header.Height != 30 {
+		t.Errorf("header=%+v, want the new size", header)
+	}
+	broadcast.close()
+	received := 0
+	for range events {
+		received++
+	}
+	if received != terminalBroadcastBuffer {
+		t.Errorf("received=%v, want %v", received, terminalBroadcastBuffer)
+	}
+	if _, events := broadcast.spectate(); len(events) != 0 || isOpen(events) {
+		t.Error("spectating an ended session, want no events")
+	}
+}
+
+func isOpen(events chan asciicastEvent) bool {
+	select {
+	case _, ok := <-events:
+		return ok
+	default:
+		return true
+	}
+}
+
+func TestWatchPTYSession(t *testing.T) {
+	keyFile, err := generateKey(t.TempDir(), ecdsa_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config{}
+	cfg.Server.HostKeys = []string{keyFile}
+	cfg.Auth.PasswordAuth.Enabled = true
+	cfg.Auth.PasswordAuth.Accepted = true
+	cfg.Admin.Address = "127.0.0.1:0"
+	cfg.Admin.Token = "secret"
+	if err := cfg.setupSSHConfig(); err != nil {
+		t.Fatal(err)
+	}
+	setupLogBuffer(t, cfg)
+	server := httptest.NewServer(newAdminHandler(staticConfigs(cfg)))
+	defer server.Close()
+
+	listener, err := sshutils.Listen("127.0.0.1:0", cfg.sshConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	listener.Listener = trackingListener{listener.Listener}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		handleConnection(conn, cfg)
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "root",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Stdout = io.Discard
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+
+	var infos []liveConnectionInfo
+	for start := time.Now(); len(infos) != 1 && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		infos = getLiveConnectionInfos(t, server.URL)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("connections=%v, want one", infos)
+	}
+	watchURL := server.URL + "/api/connections/" + infos[0].ConnectionID + "/watch"
+	if response := adminRequest(t, "GET", watchURL, ""); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status=%v, want 401 without a token", response.StatusCode)
+	}
+	if response := adminRequest(t, "GET", watchURL+"?channel=1", "secret"); response.StatusCode != http.StatusNotFound {
+		t.Errorf("status=%v, want 404 for a channel without a PTY", response.StatusCode)
+	}
+	response := adminRequest(t, "GET", watchURL, "secret")
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status=%v, want 200", response.StatusCode)
+	}
+	header, events, err := newAsciicastReader(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Width != 80 || header.Height != 24 {
+		t.Errorf("header=%+v, want the PTY size", header)
+	}
+
+	if _, err := stdin.Write([]byte("uname\r")); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.WindowChange(30, 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stdin.Write([]byte("exit\r")); err != nil {
+		t.Fatal(err)
+	}
+	watched := map[string]string{}
+	for {
+		event, err := events.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		watched[event.code] += event.data
+	}
+	if !strings.Contains(watched["i"], "uname\r") || !strings.Contains(watched["o"], "Linux") || watched["r"] != "100x30" {
+		t.Errorf("watched=%v, want the input, output and resize", watched)
+	}
+	session.Wait()
+	client.Close()
+	<-done
+}
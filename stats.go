@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/adrg/xdg"
+)
+
+// loggedEvent is an activity log line in the JSON format.
+type loggedEvent struct {
+	Time         string                 `json:"time"`
+	Source       interface{}            `json:"source"`
+	User         string                 `json:"user"`
+	ConnectionID string                 `json:"connection_id"`
+	ChannelID    string                 `json:"channel_id"`
+	EventType    string                 `json:"event_type"`
+	Event        map[string]interface{} `json:"event"`
+	line         []byte
+}
+
+func (event loggedEvent) field(name string) string {
+	value, _ := event.Event[name].(string)
+	return value
+}
+
+// user returns the SSH user of an event if it's known, or the user the event is about.
+func (event loggedEvent) user() string {
+	if event.User != "" {
+		return event.User
+	}
+	if user := event.field("user"); user != "" {
+		return user
+	}
+	return event.field("username")
+}
+
+// eventFilter selects logged events by time, type, source IP, user and connection.
+type eventFilter struct {
+	since, until time.Time
+	eventTypes   map[string]bool
+	sourceIP     string
+	user         string
+	connectionID string
+}
+
+func (filter eventFilter) matches(event loggedEvent) bool {
+	if len(filter.eventTypes) != 0 && !filter.eventTypes[event.EventType] {
+		return false
+	}
+	if filter.sourceIP != "" {
+		if sourceIP, _ := splitLoggedAddress(event.Source); sourceIP != filter.sourceIP {
+			return false
+		}
+	}
+	if filter.user != "" && event.user() != filter.user {
+		return false
+	}
+	if filter.connectionID != "" && event.ConnectionID != filter.connectionID {
+		return false
+	}
+	if filter.since.IsZero() && filter.until.IsZero() {
+		return true
+	}
+	eventTime, err := time.Parse(time.RFC3339, event.Time)
+	if err != nil {
+		// Logs without timestamps can't be placed in the time range
+		return false
+	}
+	return (filter.since.IsZero() || !eventTime.Before(filter.since)) && (filter.until.IsZero() || eventTime.Before(filter.until))
+}
+
+// parseTimeFlag parses a time given either as RFC 3339 or as a duration before now, like 24h.
+func parseTimeFlag(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// readLoggedEvents reads the matching events from JSON activity logs, gzipped or not, or stdin if no files are given.
+func readLoggedEvents(files []string, filter eventFilter, handle func(event loggedEvent) error) error {
+	if len(files) == 0 {
+		return scanLoggedEvents(os.Stdin, "stdin", filter, handle)
+	}
+	for _, file := range files {
+		if err := readLoggedEventsFile(file, filter, handle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readLoggedEventsFile(file string, filter eventFilter, handle func(event loggedEvent) error) error {
+	logFile, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	var reader io.Reader = logFile
+	if strings.HasSuffix(file, ".gz") {
+		gzipReader, err := gzip.NewReader(logFile)
+		if err != nil {
+			return fmt.Errorf("%v: %w", file, err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	return scanLoggedEvents(reader, file, filter, handle)
+}
+
+func scanLoggedEvents(reader io.Reader, name string, filter eventFilter, handle func(event loggedEvent) error) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, 1<<24)
+	skipped := 0
+	for scanner.Scan() {
+		event := loggedEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || event.EventType == "" {
+			skipped++
+			continue
+		}
+		if !filter.matches(event) {
+			continue
+		}
+		event.line = append([]byte{}, scanner.Bytes()...)
+		if err := handle(event); err != nil {
+			return err
+		}
+	}
+	if skipped != 0 {
+		warningLogger.Printf("%v: skipped %v lines that aren't JSON activity logs", name, skipped)
+	}
+	return scanner.Err()
+}
+
+// statsCategories lists the statistics in the order they're printed.
+var statsCategories = []string{"usernames", "passwords", "password_pairs", "client_versions", "source_ips", "commands", "exec", "tunnel_destinations"}
+
+// eventStats counts values by statistic.
+type eventStats map[string]map[string]int
+
+func (stats eventStats) add(category string, value string) {
+	if value == "" {
+		return
+	}
+	if stats[category] == nil {
+		stats[category] = map[string]int{}
+	}
+	stats[category][value]++
+}
+
+// addEvent updates the statistics with a logged event.
+func (stats eventStats) addEvent(event loggedEvent) {
+	switch event.EventType {
+	case "connection":
+		sourceIP, _ := splitLoggedAddress(event.Source)
+		stats.add("source_ips", sourceIP)
+		stats.add("client_versions", event.field("client_version"))
+	case "no_auth", "public_key_auth", "keyboard_interactive_auth":
+		stats.add("usernames", event.field("user"))
+	case "password_auth":
+		stats.add("usernames", event.field("user"))
+		stats.add("passwords", event.field("password"))
+		stats.add("password_pairs", event.field("user")+":"+event.field("password"))
+	case "tcpip_auth", "smtp_auth":
+		stats.add("usernames", event.field("username"))
+		if password := event.field("password"); password != "" {
+			stats.add("passwords", password)
+			stats.add("password_pairs", event.field("username")+":"+password)
+		}
+	case "mysql_auth":
+		stats.add("usernames", event.field("username"))
+	case "session_input":
+		stats.add("commands", decodedText(event.field("input"), event.field("encoding")))
+	case "exec":
+		stats.add("exec", event.field("command"))
+	case "direct_tcpip":
+		host, port := splitLoggedAddress(event.Event["to"])
+		stats.add("tunnel_destinations", fmt.Sprintf("%v:%v", host, port))
+	}
+}
+
+type statsCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// top returns the most common values of a statistic, up to limit if it's positive.
+func (stats eventStats) top(category string, limit int) []statsCount {
+	counts := []statsCount{}
+	for value, count := range stats[category] {
+		counts = append(counts, statsCount{value, count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Value < counts[j].Value
+	})
+	if limit > 0 && len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts
+}
+
+func (stats eventStats) write(output io.Writer, format string, limit int) error {
+	switch format {
+	case "table":
+		writer := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+		for i, category := range statsCategories {
+			if i != 0 {
+				fmt.Fprintln(writer)
+			}
+			fmt.Fprintf(writer, "%v\tcount\n", strings.ToUpper(category))
+			for _, count := range stats.top(category, limit) {
+				fmt.Fprintf(writer, "%q\t%v\n", count.Value, count.Count)
+			}
+		}
+		return writer.Flush()
+	case "csv":
+		writer := csv.NewWriter(output)
+		writer.Write([]string{"category", "value", "count"})
+		for _, category := range statsCategories {
+			for _, count := range stats.top(category, limit) {
+				writer.Write([]string{category, count.Value, fmt.Sprint(count.Count)})
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	case "json":
+		result := map[string][]statsCount{}
+		for _, category := range statsCategories {
+			result[category] = stats.top(category, limit)
+		}
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// logQuery reads the events selected by the flags of the log subcommands.
+type logQuery struct {
+	filter  eventFilter
+	store   bool
+	dataDir string
+	files   []string
+}
+
+// read reads the matching events from the event store or the log files.
+func (query logQuery) read(handle func(event loggedEvent) error) error {
+	if !query.store {
+		return readLoggedEvents(query.files, query.filter, handle)
+	}
+	store, err := openEventStore(path.Join(query.dataDir, "events"), 0)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	return store.query(query.filter, handle)
+}
+
+// logQueryFlags sets up the flags shared by the log subcommands.
+func logQueryFlags(name string, usage string) (*flag.FlagSet, func(args []string) (logQuery, error)) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	since := flags.String("since", "", "only include events at or after this time, given as RFC 3339 or a duration before now like 24h")
+	until := flags.String("until", "", "only include events before this time, given as RFC 3339 or a duration before now like 1h")
+	eventTypes := flags.String("event", "", "comma separated event types to include, e.g. password_auth,exec")
+	sourceIP := flags.String("ip", "", "only include events from this source IP")
+	user := flags.String("user", "", "only include events of this user")
+	connectionID := flags.String("connection", "", "only include events of this connection ID")
+	store := flags.Bool("store", false, "read the event store in the data directory instead of log files")
+	dataDir := flags.String("data_dir", path.Join(xdg.DataHome, "sshesame"), "data directory the event store is in")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v %v [flags] [JSON log files...]\n\n%v Logs are read from stdin if no files are given; gzipped rotated logs are supported.\n\n", os.Args[0], name, usage)
+		flags.PrintDefaults()
+	}
+	parse := func(args []string) (logQuery, error) {
+		query := logQuery{}
+		if err := flags.Parse(args); err != nil {
+			return query, err
+		}
+		filter := eventFilter{sourceIP: *sourceIP, user: *user, connectionID: *connectionID}
+		now := time.Now()
+		var err error
+		if filter.since, err = parseTimeFlag(*since, now); err != nil {
+			return query, fmt.Errorf("invalid since time: %w", err)
+		}
+		if filter.until, err = parseTimeFlag(*until, now); err != nil {
+			return query, fmt.Errorf("invalid until time: %w", err)
+		}
+		if *eventTypes != "" {
+			filter.eventTypes = map[string]bool{}
+			for _, eventType := range strings.Split(*eventTypes, ",") {
+				filter.eventTypes[strings.TrimSpace(eventType)] = true
+			}
+		}
+		if *store && flags.NArg() != 0 {
+			return query, errors.New("log files can't be given when reading the event store")
+		}
+		return logQuery{filter, *store, *dataDir, flags.Args()}, nil
+	}
+	return flags, parse
+}
+
+func statsCommand(args []string) error {
+	flags, parse := logQueryFlags("stats", "Prints the top usernames, passwords, credential pairs, client versions, source IPs, commands, exec strings and tunnel destinations.")
+	format := flags.String("format", "table", "output format: table, csv or json")
+	limit := flags.Int("top", 10, "number of values to print per statistic, or 0 for all")
+	query, err := parse(args)
+	if err != nil {
+		return err
+	}
+	if *format != "table" && *format != "csv" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	stats := eventStats{}
+	if err := query.read(func(event loggedEvent) error {
+		stats.addEvent(event)
+		return nil
+	}); err != nil {
+		return err
+	}
+	return stats.write(os.Stdout, *format, *limit)
+}
+
+// queryColumns are the columns of the table and CSV query output.
+var queryColumns = []string{"time", "source", "connection_id", "channel_id", "event_type", "event"}
+
+func (event loggedEvent) columns() []string {
+	eventJSON, _ := json.Marshal(event.Event)
+	source := event.Source
+	if host, port := splitLoggedAddress(event.Source); host != "" {
+		source = fmt.Sprintf("%v:%v", host, port)
+	}
+	return []string{event.Time, fmt.Sprint(source), event.ConnectionID, event.ChannelID, event.EventType, string(eventJSON)}
+}
+
+func queryCommand(args []string) error {
+	flags, parse := logQueryFlags("query", "Prints the matching events.")
+	format := flags.String("format", "table", "output format: table, csv or json (one event per line, as logged)")
+	query, err := parse(args)
+	if err != nil {
+		return err
+	}
+	var handle func(event loggedEvent) error
+	var flush func() error
+	switch *format {
+	case "table":
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, strings.Join(queryColumns, "\t"))
+		handle = func(event loggedEvent) error {
+			_, err := fmt.Fprintln(writer, strings.Join(event.columns(), "\t"))
+			return err
+		}
+		flush = writer.Flush
+	case "csv":
+		writer := csv.NewWriter(os.Stdout)
+		writer.Write(queryColumns)
+		handle = func(event loggedEvent) error {
+			return writer.Write(event.columns())
+		}
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	case "json":
+		handle = func(event loggedEvent) error {
+			_, err := os.Stdout.Write(append(event.line, '\n'))
+			return err
+		}
+		flush = func() error { return nil }
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if err := query.read(handle); err != nil {
+		flush()
+		return err
+	}
+	return flush()
+}
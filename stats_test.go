@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testActivityLogs = `{"time":"2026-01-01T10:00:00Z","source":"192.0.2.1:1234","connection_id":"a","event_type":"connection","event":{"client_version":"SSH-2.0-Go"}}
+{"time":"2026-01-01T10:00:01Z","source":"192.0.2.1:1234","connection_id":"a","event_type":"password_auth","event":{"user":"root","password":"123456","accepted":false}}
+{"time":"2026-01-01T10:00:02Z","source":"192.0.2.1:1234","connection_id":"a","event_type":"password_auth","event":{"user":"root","password":"admin","accepted":true}}
+{"time":"2026-01-01T10:00:03Z","source":"192.0.2.1:1234","connection_id":"a","channel_id":"a-0","event_type":"exec","event":{"channel_id":0,"command":"uname -a"}}
+2026/01/01 10:00:04 [192.0.2.1:1234 a] not a JSON log
+{"time":"2026-01-02T10:00:00Z","source":{"host":"198.51.100.7","port":4321},"connection_id":"b","event_type":"connection","event":{"client_version":"SSH-2.0-Go"}}
+{"time":"2026-01-02T10:00:01Z","source":{"host":"198.51.100.7","port":4321},"connection_id":"b","event_type":"password_auth","event":{"user":"admin","password":"123456","accepted":true}}
+{"time":"2026-01-02T10:00:02Z","source":{"host":"198.51.100.7","port":4321},"connection_id":"b","channel_id":"b-0","event_type":"session_input","event":{"channel_id":0,"input":"d2dldCBodHRwOi8veA==","encoding":"base64"}}
+{"time":"2026-01-02T10:00:03Z","source":{"host":"198.51.100.7","port":4321},"connection_id":"b","channel_id":"b-1","event_type":"direct_tcpip","event":{"channel_id":1,"from":"127.0.0.1:1","to":"example.com:80"}}
+`
+
+func TestStats(t *testing.T) {
+	logDir := t.TempDir()
+	lines := strings.SplitAfter(testActivityLogs, "\n")
+	plainFile := path.Join(logDir, "sshesame.log")
+	if err := os.WriteFile(plainFile, []byte(strings.Join(lines[5:], "")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Rotated logs are gzipped
+	compressed := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(compressed)
+	gzipWriter.Write([]byte(strings.Join(lines[:5], "")))
+	gzipWriter.Close()
+	gzipFile := path.Join(logDir, "sshesame.log.1.gz")
+	if err := os.WriteFile(gzipFile, compressed.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := eventStats{}
+	if err := readLoggedEvents([]string{gzipFile, plainFile}, eventFilter{}, func(event loggedEvent) error {
+		stats.addEvent(event)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]statsCount{
+		"usernames":           {{"root", 2}, {"admin", 1}},
+		"passwords":           {{"123456", 2}, {"admin", 1}},
+		"password_pairs":      {{"admin:123456", 1}, {"root:123456", 1}, {"root:admin", 1}},
+		"client_versions":     {{"SSH-2.0-Go", 2}},
+		"source_ips":          {{"192.0.2.1", 1}, {"198.51.100.7", 1}},
+		"commands":            {{"wget http://x", 1}},
+		"exec":                {{"uname -a", 1}},
+		"tunnel_destinations": {{"example.com:80", 1}},
+	}
+	for category, expectedCounts := range expected {
+		if counts := stats.top(category, 0); !reflect.DeepEqual(counts, expectedCounts) {
+			t.Errorf("%v=%v, want %v", category, counts, expectedCounts)
+		}
+	}
+	if counts := stats.top("usernames", 1); len(counts) != 1 {
+		t.Errorf("counts=%v, want only the top username", counts)
+	}
+
+	output := &bytes.Buffer{}
+	if err := stats.write(output, "json", 0); err != nil {
+		t.Fatal(err)
+	}
+	result := map[string][]statsCount{}
+	if err := json.Unmarshal(output.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("result=%v, want %v", result, expected)
+	}
+	output.Reset()
+	if err := stats.write(output, "csv", 1); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(output.String(), "category,value,count\nusernames,root,2\npasswords,123456,2\n") {
+		t.Errorf("output=%q, want CSV stats", output.String())
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	since, err := parseTimeFlag("2026-01-02T00:00:00Z", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 2, 10, 0, 2, 0, time.UTC)
+	until, err := parseTimeFlag("1s", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := eventFilter{since: since, until: until, eventTypes: map[string]bool{"connection": true, "password_auth": true}}
+	connections := []string{}
+	if err := scanLoggedEvents(strings.NewReader(testActivityLogs), "test", filter, func(event loggedEvent) error {
+		connections = append(connections, event.ConnectionID+" "+event.EventType)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"b connection"}
+	if !reflect.DeepEqual(connections, expected) {
+		t.Errorf("events=%v, want %v", connections, expected)
+	}
+	if filter.matches(loggedEvent{EventType: "connection"}) {
+		t.Errorf("an event without a timestamp matched a time range")
+	}
+}
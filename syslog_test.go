@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var syslogMessageRegexp = regexp.MustCompile(`^<134>1 \d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{6}\S+ \S+ sshesame \d+ test \[sshesame@32473 event_type="test" source="127\.0\.0\.1:1234" session_id="736f6d6573657373696f6e" connection_id="736f6d6573657373"\] \[127\.0\.0\.1:1234 736f6d6573657373\] test lorem$`)
+
+func logToSyslogSink(t *testing.T, sinkConfig logSinkConfig) {
+	t.Helper()
+	cfg := &config{}
+	cfg.Logging.Sinks = []logSinkConfig{sinkConfig}
+	setupLogBuffer(t, cfg)
+	connContext{ConnMetadata: mockConnContext{}, cfg: cfg}.logEvent(mockLogEntry{"lorem"})
+	cfg.logSinks.close()
+}
+
+// readOctetCounted reads a message framed as in RFC 6587.
+func readOctetCounted(conn net.Conn) (string, error) {
+	reader := bufio.NewReader(conn)
+	length, err := reader.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil {
+		return "", err
+	}
+	message := make([]byte, n)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return "", err
+	}
+	return string(message), nil
+}
+
+func TestSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	logToSyslogSink(t, logSinkConfig{Type: "syslog", Address: conn.LocalAddr().String(), Format: "plain"})
+	message := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !syslogMessageRegexp.Match(message[:n]) {
+		t.Errorf("message=%q, want match for %v", message[:n], syslogMessageRegexp)
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(messages)
+			return
+		}
+		defer conn.Close()
+		message, err := readOctetCounted(conn)
+		if err != nil {
+			t.Error(err)
+		}
+		messages <- message
+	}()
+	logToSyslogSink(t, logSinkConfig{Type: "syslog", Network: "tcp", Address: listener.Addr().String(), Format: "plain"})
+	if message := <-messages; !syslogMessageRegexp.MatchString(message) {
+		t.Errorf("message=%q, want match for %v", message, syslogMessageRegexp)
+	}
+}
+
+func TestSyslogTLS(t *testing.T) {
+	serverCfg := &config{}
+	serverCfg.Services.SMTP.Hostname = "localhost"
+	if err := serverCfg.setupTLSConfig(); err != nil {
+		t.Fatal(err)
+	}
+	caFile := path.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverCfg.tlsConfig.Certificates[0].Certificate[0]})
+	if err := os.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverCfg.tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(messages)
+			return
+		}
+		defer conn.Close()
+		message, err := readOctetCounted(conn)
+		if err != nil {
+			t.Error(err)
+		}
+		messages <- message
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	logToSyslogSink(t, logSinkConfig{Type: "syslog", Network: "tls", Address: net.JoinHostPort("localhost", port), CAFile: caFile, Format: "plain"})
+	if message := <-messages; !syslogMessageRegexp.MatchString(message) {
+		t.Errorf("message=%q, want match for %v", message, syslogMessageRegexp)
+	}
+}
+
+func TestSyslogUnix(t *testing.T) {
+	socket := path.Join(t.TempDir(), "log")
+	conn, err := net.ListenPacket("unixgram", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	logToSyslogSink(t, logSinkConfig{Type: "syslog", Network: "unixgram", Address: socket, Facility: "auth", Format: "json"})
+	message := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(message[:n]), "<38>1 ") || !strings.HasSuffix(string(message[:n]), `"event_type":"test","event":{"content":"lorem"}}`) {
+		t.Errorf("message=%q, want auth facility and JSON message", message[:n])
+	}
+}
+
+func TestSyslogParamValue(t *testing.T) {
+	if value := syslogParamValue(`a"b\c]d`); value != `a\"b\\c\]d` {
+		t.Errorf("value=%v, want %v", value, `a\"b\\c\]d`)
+	}
+}
+
+func TestJournald(t *testing.T) {
+	socket := path.Join(t.TempDir(), "socket")
+	conn, err := net.ListenPacket("unixgram", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cfg := &config{}
+	cfg.Logging.Sinks = []logSinkConfig{{Type: "journald", Path: socket, Format: "plain"}}
+	setupLogBuffer(t, cfg)
+	connContext{ConnMetadata: mockConnContext{}, cfg: cfg}.logEvent(mockLogEntry{"multi\nline"})
+	cfg.logSinks.close()
+
+	message := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := "[127.0.0.1:1234 736f6d6573657373] test multi\nline"
+	length := make([]byte, 8)
+	binary.LittleEndian.PutUint64(length, uint64(len(value)))
+	expectedMessage := fmt.Sprintf("MESSAGE\n%s%s\nPRIORITY=6\nSYSLOG_IDENTIFIER=sshesame\nSSHESAME_EVENT_TYPE=test\nSSHESAME_SOURCE=127.0.0.1:1234\nSSHESAME_SESSION_ID=736f6d6573657373696f6e\nSSHESAME_CONNECTION_ID=736f6d6573657373\n", length, value)
+	if !bytes.Equal(message[:n], []byte(expectedMessage)) {
+		t.Errorf("message=%q, want %q", message[:n], expectedMessage)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// maxOperatorOutputSize caps a single write of an operator to a session.
+const maxOperatorOutputSize = 1 << 20
+
+var (
+	errSessionNotStarted = errors.New("the session hasn't started a shell or command yet")
+	errNotTakenOver      = errors.New("the session isn't taken over")
+)
+
+// sessionTakeover lets an operator answer the attacker of a PTY session instead of the emulator.
+type sessionTakeover struct {
+	context channelContext
+
+	mutex    sync.Mutex
+	terminal *term.Terminal
+	operator bool
+}
+
+// start makes the session available to take over once the program runs in the terminal.
+func (takeover *sessionTakeover) start(terminal *term.Terminal) {
+	takeover.mutex.Lock()
+	defer takeover.mutex.Unlock()
+	takeover.terminal = terminal
+}
+
+func (takeover *sessionTakeover) takenOver() bool {
+	takeover.mutex.Lock()
+	defer takeover.mutex.Unlock()
+	return takeover.operator
+}
+
+// setOperator takes the session over from the emulator, or hands it back.
+func (takeover *sessionTakeover) setOperator(operator bool) error {
+	takeover.mutex.Lock()
+	if takeover.terminal == nil {
+		takeover.mutex.Unlock()
+		return errSessionNotStarted
+	}
+	changed := takeover.operator != operator
+	takeover.operator = operator
+	takeover.mutex.Unlock()
+	if !changed {
+		return nil
+	}
+	if operator {
+		takeover.context.logEvent(operatorTakeoverLog{channelLog{takeover.context.channelID}})
+	} else {
+		takeover.context.logEvent(operatorReleaseLog{channelLog{takeover.context.channelID}})
+	}
+	return nil
+}
+
+// write sends output of the operator to the attacker, as if it came from the emulator.
+func (takeover *sessionTakeover) write(output []byte) error {
+	takeover.mutex.Lock()
+	defer takeover.mutex.Unlock()
+	if takeover.terminal == nil {
+		return errSessionNotStarted
+	}
+	if !takeover.operator {
+		return errNotTakenOver
+	}
+	if _, err := takeover.terminal.Write(output); err != nil {
+		return err
+	}
+	logged, encoding := encodePayload(output, takeover.context.cfg.Logging.PayloadEncoding)
+	takeover.context.logEvent(operatorOutputLog{
+		channelLog: channelLog{takeover.context.channelID},
+		Output:     logged,
+		Encoding:   encoding,
+	})
+	return nil
+}
+
+func (takeover *sessionTakeover) close() {
+	takeover.mutex.Lock()
+	defer takeover.mutex.Unlock()
+	takeover.terminal = nil
+	takeover.operator = false
+}
+
+// takeoverReadLiner keeps the lines typed while the session is taken over from the emulator.
+// They're still logged as input.
+type takeoverReadLiner struct {
+	readLiner
+	takeover *sessionTakeover
+}
+
+func (r takeoverReadLiner) ReadLine() (string, error) {
+	for {
+		line, err := r.readLiner.ReadLine()
+		if err != nil || !r.takeover.takenOver() {
+			return line, err
+		}
+	}
+}
+
+// serveTakeover takes a PTY session of a connection over, or hands it back to the emulator.
+func serveTakeover(operator bool) func(writer http.ResponseWriter, request *http.Request, connection *liveConnection) {
+	return func(writer http.ResponseWriter, request *http.Request, connection *liveConnection) {
+		terminal, ok := requestedTerminal(writer, request, connection)
+		if !ok {
+			return
+		}
+		if err := terminal.takeover.setOperator(operator); err != nil {
+			http.Error(writer, err.Error(), http.StatusConflict)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// serveOperatorOutput writes the request body to the attacker of a taken over PTY session.
+func serveOperatorOutput(writer http.ResponseWriter, request *http.Request, connection *liveConnection) {
+	terminal, ok := requestedTerminal(writer, request, connection)
+	if !ok {
+		return
+	}
+	output, err := io.ReadAll(http.MaxBytesReader(writer, request.Body, maxOperatorOutputSize))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := terminal.takeover.write(output); err != nil {
+		http.Error(writer, err.Error(), http.StatusConflict)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func takeoverCommand(args []string) error {
+	client, err := newAdminClient("takeover", "Takes a live PTY session over: lines typed are sent to the attacker as the output of the fake machine.\nEnd input (Ctrl+D) or interrupt (Ctrl+C) to hand the session back to the emulator.", args)
+	if err != nil {
+		return err
+	}
+	response, err := client.do("POST", "takeover", nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	ended := make(chan error, 1)
+	go func() {
+		ended <- client.watch(os.Stdout)
+	}()
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return client.release()
+			}
+			response, err := client.do("POST", "output", strings.NewReader(line+"\n"))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to send output: %v\r\n", err)
+				continue
+			}
+			response.Body.Close()
+		case <-interrupts:
+			return client.release()
+		case err := <-ended:
+			return err
+		}
+	}
+}
+
+// release hands the session back to the emulator.
+func (client *adminClient) release() error {
+	response, err := client.do("DELETE", "takeover", nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	fmt.Fprintf(os.Stderr, "\r\nHanded the session back\r\n")
+	return nil
+}
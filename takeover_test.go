@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaksi/sshutils"
+	"golang.org/x/crypto/ssh"
+)
+
+func operatorRequest(t *testing.T, method string, url string, body string) *http.Response {
+	t.Helper()
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer secret")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	return response
+}
+
+func TestTakeoverPTYSession(t *testing.T) {
+	keyFile, err := generateKey(t.TempDir(), ecdsa_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config{}
+	cfg.Server.HostKeys = []string{keyFile}
+	cfg.Auth.PasswordAuth.Enabled = true
+	cfg.Auth.PasswordAuth.Accepted = true
+	cfg.Admin.Address = "127.0.0.1:0"
+	cfg.Admin.Token = "secret"
+	if err := cfg.setupSSHConfig(); err != nil {
+		t.Fatal(err)
+	}
+	logBuffer := setupLogBuffer(t, cfg)
+	server := httptest.NewServer(newAdminHandler(staticConfigs(cfg)))
+	defer server.Close()
+
+	listener, err := sshutils.Listen("127.0.0.1:0", cfg.sshConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	listener.Listener = trackingListener{listener.Listener}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		handleConnection(conn, cfg)
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "root",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := &bytes.Buffer{}
+	session.Stdout = stdout
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+
+	var infos []liveConnectionInfo
+	for start := time.Now(); len(infos) != 1 && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		infos = getLiveConnectionInfos(t, server.URL)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("connections=%v, want one", infos)
+	}
+	connectionURL := server.URL + "/api/connections/" + infos[0].ConnectionID
+
+	if response := adminRequest(t, "POST", connectionURL+"/takeover", ""); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status=%v, want 401 without a token", response.StatusCode)
+	}
+	if response := operatorRequest(t, "POST", connectionURL+"/output", "too early\n"); response.StatusCode != http.StatusConflict {
+		t.Errorf("status=%v, want 409 before taking over", response.StatusCode)
+	}
+	var response *http.Response
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if response = operatorRequest(t, "POST", connectionURL+"/takeover", ""); response.StatusCode != http.StatusConflict {
+			break
+		}
+	}
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatalf("status=%v, want 204", response.StatusCode)
+	}
+
+	if _, err := stdin.Write([]byte("uname\r")); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		transcript := adminRequest(t, "GET", connectionURL+"/transcript", "secret")
+		lines, _ := io.ReadAll(transcript.Body)
+		transcript.Body.Close()
+		if strings.Contains(string(lines), `输入："uname"`) {
+			break
+		}
+	}
+	if response := operatorRequest(t, "POST", connectionURL+"/output", "Linux honeypot\n"); response.StatusCode != http.StatusNoContent {
+		t.Errorf("status=%v, want 204", response.StatusCode)
+	}
+	if response := operatorRequest(t, "DELETE", connectionURL+"/takeover", ""); response.StatusCode != http.StatusNoContent {
+		t.Errorf("status=%v, want 204", response.StatusCode)
+	}
+	if _, err := stdin.Write([]byte("exit\r")); err != nil {
+		t.Fatal(err)
+	}
+	session.Wait()
+	client.Close()
+	<-done
+
+	if !strings.Contains(stdout.String(), "Linux honeypot\r\n") || strings.Contains(stdout.String(), "generic") {
+		t.Errorf("stdout=%q, want the operator's answer instead of the emulator's", stdout.String())
+	}
+	logs := logBuffer.String()
+	for _, expected := range []string{`[通道 0] 操作员接管了会话`, `[通道 0] 输入："uname"`, `[通道 0] 操作员输出："Linux honeypot\n"`, `[通道 0] 操作员交还了会话`, `[通道 0] 输入："exit"`} {
+		if !strings.Contains(logs, expected) {
+			t.Errorf("logs=%v, want %v", logs, expected)
+		}
+	}
+}
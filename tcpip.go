@@ -2,12 +2,12 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
-	"net/http/httputil"
+	"net"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -15,13 +15,46 @@ import (
 )
 
 type tcpipServer interface {
-	serve(readWriter io.ReadWriter, input chan<- string)
+	serve(context channelContext, readWriter io.ReadWriter, input chan<- string)
 }
 
 var servers = map[string]tcpipServer{
-	"SMTP": smtpServer{},
-	"HTTP": httpServer{},
-	"POP3": pop3Server{},
+	"SMTP":   smtpServer{},
+	"HTTP":   httpServer{},
+	"POP3":   pop3Server{},
+	"IMDS":   imdsServer{},
+	"REDIS":  redisServer{},
+	"MYSQL":  mysqlServer{},
+	"TELNET": telnetServer{},
+	"FTP":    ftpServer{},
+}
+
+// errLineTooLong is returned for lines longer than a fake service accepts.
+var errLineTooLong = errors.New("line too long")
+
+// readLimitedLine reads a line of at most maxLength bytes, including its newline.
+// The rest of a longer line is skipped up to its newline without being buffered, and errLineTooLong is returned.
+// Like ReadString, it returns what was read before an error.
+func readLimitedLine(reader *bufio.Reader, maxLength int) (string, error) {
+	line := []byte{}
+	tooLong := false
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		if !tooLong && len(line)+len(fragment) > maxLength {
+			tooLong = true
+			line = nil
+		}
+		if !tooLong {
+			line = append(line, fragment...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if tooLong && err == nil {
+			return "", errLineTooLong
+		}
+		return string(line), err
+	}
 }
 
 type tcpipChannelData struct {
@@ -46,19 +79,35 @@ var (
 	}, []string{"service"})
 )
 
+// directTCPIPService names the service answering a direct-tcpip channel to an address and port, if any.
+// The metadata service takes over HTTP to its addresses.
+func directTCPIPService(cfg *config, address string, port uint32) string {
+	if cfg.Services.IMDS.Enabled && imdsHosts[address] && port == 80 {
+		return "IMDS"
+	}
+	return cfg.Server.TCPIPServices[port]
+}
+
 func handleDirectTCPIPChannel(newChannel ssh.NewChannel, context channelContext) error {
 	channelData := &tcpipChannelData{}
 	if err := ssh.Unmarshal(newChannel.ExtraData(), channelData); err != nil {
 		return err
 	}
-	service := context.cfg.Server.TCPIPServices[channelData.Port]
+	service := directTCPIPService(context.cfg, channelData.Address, channelData.Port)
 	server := servers[service]
+	if server == nil {
+		server = context.cfg.scriptedServers[service]
+	}
+	if listener := getFTPPassiveListener(context, channelData.Port); listener != nil {
+		service = "FTP-DATA"
+		server = ftpDataServer{listener}
+	}
 	if server == nil {
 		tcpipChannelsMetric.WithLabelValues("unknown").Inc()
 		warningLogger.Printf("不支持的端口 %v", channelData.Port)
 		return newChannel.Reject(ssh.ConnectionFailed, "连接被拒绝")
 	}
-	tcpipChannelsMetric.WithLabelValues(service).Inc()
+	incWithExemplar(tcpipChannelsMetric.WithLabelValues(service), context.connectionID())
 	activeTCPIPChannelsMetric.WithLabelValues(service).Inc()
 	defer activeTCPIPChannelsMetric.WithLabelValues(service).Dec()
 	channel, requests, err := newChannel.Accept()
@@ -81,7 +130,7 @@ func handleDirectTCPIPChannel(newChannel ssh.NewChannel, context channelContext)
 	inputChan := make(chan string)
 	go func() {
 		defer close(inputChan)
-		server.serve(channel, inputChan)
+		server.serve(context, channel, inputChan)
 		if err := channel.CloseWrite(); err != nil {
 			warningLogger.Printf("向频道发送 EOF 时出错:%v", err)
 			return
@@ -99,11 +148,13 @@ func handleDirectTCPIPChannel(newChannel ssh.NewChannel, context channelContext)
 				inputChan = nil
 				continue
 			}
+			encodedInput, encoding := encodePayload([]byte(input), context.cfg.Logging.PayloadEncoding)
 			context.logEvent(directTCPIPInputLog{
 				channelLog: channelLog{
 					ChannelID: context.channelID,
 				},
-				Input: input,
+				Input:    encodedInput,
+				Encoding: encoding,
 			})
 		case request, ok := <-requests:
 			if !ok {
@@ -111,11 +162,14 @@ func handleDirectTCPIPChannel(newChannel ssh.NewChannel, context channelContext)
 				continue
 			}
 			tcpipChannelRequestsMetric.WithLabelValues("unknown").Inc()
+			payload, encoding := encodePayload(request.Payload, context.cfg.Logging.PayloadEncoding)
 			context.logEvent(debugChannelRequestLog{
 				channelLog:  channelLog{ChannelID: context.channelID},
 				RequestType: request.Type,
 				WantReply:   request.WantReply,
-				Payload:     string(request.Payload),
+				Payload:     payload,
+				Encoding:    encoding,
+				Decoded:     channelRequestDecoders.decode(request.Type, request.Payload),
 			})
 			warningLogger.Printf("不支持的直接 TCPIP 请求类型 %v", request.Type)
 			if request.WantReply {
@@ -129,148 +183,36 @@ func handleDirectTCPIPChannel(newChannel ssh.NewChannel, context channelContext)
 	return nil
 }
 
-type httpServer struct{}
-
-func (server httpServer) serve(readWriter io.ReadWriter, input chan<- string) {
-	for {
-		request, err := http.ReadRequest(bufio.NewReader(readWriter))
-		if err != nil {
-			if err != io.EOF {
-				warningLogger.Printf("读取请求时出错:%v", err)
-			}
-			return
-		}
-		requestBytes, err := httputil.DumpRequest(request, true)
-		if err != nil {
-			warningLogger.Printf("转储请求时出错:%v", err)
-			return
-		}
-		input <- string(requestBytes)
-		response := &http.Response{
-			StatusCode: 404,
-			ProtoMajor: 1,
-			ProtoMinor: 1,
-		}
-		responseBytes, err := httputil.DumpResponse(response, true)
-		if err != nil {
-			warningLogger.Printf("转储请求时出错:%v", err)
-			return
-		}
-		_, err = readWriter.Write(responseBytes)
-		if err != nil {
-			warningLogger.Printf("写请求时出错:%v", err)
-			return
-		}
-	}
-}
-
-type smtpServer struct{}
-
-type smtpReply struct {
-	code    int
-	message string
+// readWriterConn adapts a channel to net.Conn so that it can be wrapped in TLS.
+type readWriterConn struct {
+	io.ReadWriter
 }
 
-func (smtpServer) writeReply(writer io.Writer, reply smtpReply) error {
-	lines := strings.Split(reply.message, "\n")
-	for _, line := range lines[:len(lines)-1] {
-		if _, err := fmt.Fprintf(writer, "%d-%s\r\n", reply.code, line); err != nil {
-			return err
-		}
-	}
-	if _, err := fmt.Fprintf(writer, "%d %s\r\n", reply.code, lines[len(lines)-1]); err != nil {
-		return err
+func (conn readWriterConn) Close() error {
+	if closer, ok := conn.ReadWriter.(io.Closer); ok {
+		return closer.Close()
 	}
 	return nil
 }
 
-type smtpCommand struct {
-	command string
-	params  []string
+func (readWriterConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
 }
 
-func (command smtpCommand) String() string {
-	if len(command.params) == 0 {
-		return command.command
-	}
-	return fmt.Sprintf("%s %s", command.command, strings.Join(command.params, " "))
+func (readWriterConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
 }
 
-func (smtpServer) readCommand(reader io.Reader) (smtpCommand, error) {
-	line, err := bufio.NewReader(reader).ReadString('\n')
-	if err != nil {
-		return smtpCommand{}, err
-	}
-	fields := strings.Fields(line)
-	if len(fields) == 0 {
-		return smtpCommand{}, fmt.Errorf("empty command")
-	}
-	command := strings.ToUpper(fields[0])
-	params := fields[1:]
-	return smtpCommand{command, params}, nil
+func (readWriterConn) SetDeadline(t time.Time) error {
+	return nil
 }
 
-func (smtpServer) readData(reader io.Reader) (string, error) {
-	bufioReader := bufio.NewReader(reader)
-	data := bytes.Buffer{}
-	crlf := false
-	for {
-		line, err := bufioReader.ReadString('\n')
-		if err != nil {
-			return "", err
-		}
-		data.WriteString(line)
-		if crlf && line == ".\r\n" {
-			return data.String(), nil
-		}
-		crlf = strings.HasSuffix(line, "\r\n")
-	}
+func (readWriterConn) SetReadDeadline(t time.Time) error {
+	return nil
 }
 
-func (server smtpServer) serve(readWriter io.ReadWriter, input chan<- string) {
-	if err := server.writeReply(readWriter, smtpReply{220, "localhost"}); err != nil {
-		warningLogger.Printf("Error writing greeting: %v", err)
-		return
-	}
-	for {
-		command, err := server.readCommand(readWriter)
-		if err != nil {
-			warningLogger.Printf("Error reading command: %v", err)
-			return
-		}
-		input <- command.String()
-		reply := smtpReply{250, "OK"}
-		switch command.command {
-		case "HELO":
-		case "EHLO":
-		case "MAIL":
-		case "RCPT":
-		case "RSET":
-		case "DATA":
-			if err := server.writeReply(readWriter, smtpReply{354, "Start mail input; end with <CRLF>.<CRLF>"}); err != nil {
-				warningLogger.Printf("Error writing reply: %v", err)
-				return
-			}
-			data, err := server.readData(readWriter)
-			if err != nil {
-				warningLogger.Printf("Error reading data: %v", err)
-				return
-			}
-			input <- data
-		case "QUIT":
-			reply = smtpReply{221, "Bye!"}
-		default:
-			warningLogger.Printf("Unknown SMTP command: %v", command)
-			reply = smtpReply{500, "unknown command"}
-		}
-		if err := server.writeReply(readWriter, reply); err != nil {
-			warningLogger.Printf("Error writing reply: %v", err)
-			return
-		}
-		if command.command == "QUIT" {
-			break
-		}
-	}
+func (readWriterConn) SetWriteDeadline(t time.Time) error {
+	return nil
 }
 
 type pop3Server struct{}
@@ -339,7 +281,7 @@ func (pop3Server) readCommand(reader io.Reader) (pop3Command, error) {
 	return pop3Command{keyword, args}, nil
 }
 
-func (server pop3Server) serve(readWriter io.ReadWriter, input chan<- string) {
+func (server pop3Server) serve(context channelContext, readWriter io.ReadWriter, input chan<- string) {
 	if err := server.writeResponse(readWriter, pop3Response{true, "localhost", false}); err != nil {
 		warningLogger.Printf("Error writing greeting: %v", err)
 		return
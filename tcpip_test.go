@@ -0,0 +1,731 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func serveTestService(t *testing.T, cfg *config, server tcpipServer) (net.Conn, <-chan string) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	input := make(chan string)
+	inputs := make(chan string, 100)
+	go func() {
+		defer close(inputs)
+		for line := range input {
+			inputs <- line
+		}
+	}()
+	go func() {
+		defer close(input)
+		defer serverConn.Close()
+		server.serve(channelContext{connContext{ConnMetadata: mockConnContext{}, cfg: cfg}, 0}, serverConn, input)
+	}()
+	t.Cleanup(func() { clientConn.Close() })
+	return clientConn, inputs
+}
+
+func parseJSONLogs(t *testing.T, logs string) []map[string]interface{} {
+	t.Helper()
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs), "\n") {
+		if line == "" {
+			continue
+		}
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Failed to parse log line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestSMTPMessage(t *testing.T) {
+	cfg := &config{}
+	cfg.setDefaults()
+	cfg.Logging.JSON = true
+	if err := cfg.setupTLSConfig(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.artifacts = &artifactStore{t.TempDir()}
+	logBuffer := setupLogBuffer(t, cfg)
+
+	conn, _ := serveTestService(t, cfg, smtpServer{})
+	client, err := smtp.NewClient(conn, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		t.Fatalf("STARTTLS not advertised")
+	}
+	if err := client.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Auth(smtp.PlainAuth("", "spammer", "hunter2", "localhost")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rcpt("victim@example.com"); err == nil {
+		t.Errorf("RCPT before MAIL accepted")
+	}
+	if err := client.Mail("spammer@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, to := range []string{"victim1@example.com", "victim2@example.com"} {
+		if err := client.Rcpt(to); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := "From: spammer@example.com\r\nSubject: =?UTF-8?B?5L2g5aW9?=\r\n\r\n.leading dot\r\nbody\r\n"
+	if _, err := writer.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The server closes the pipe after replying to QUIT, so the TLS close alert can't be sent
+	client.Quit()
+
+	entries := parseJSONLogs(t, logBuffer.String())
+	if len(entries) != 2 {
+		t.Fatalf("len(entries)=%v, want 2", len(entries))
+	}
+	expectedAuth := map[string]interface{}{"channel_id": 0.0, "mechanism": "PLAIN", "username": "spammer", "password": "hunter2", "accepted": true}
+	if !reflect.DeepEqual(entries[0]["event"], expectedAuth) {
+		t.Errorf("event=%v, want %v", entries[0]["event"], expectedAuth)
+	}
+	if entries[1]["event_type"] != "smtp_message" {
+		t.Fatalf("event_type=%v, want smtp_message", entries[1]["event_type"])
+	}
+	event := entries[1]["event"].(map[string]interface{})
+	if event["from"] != "spammer@example.com" || event["subject"] != "你好" {
+		t.Errorf("event=%v, want from spammer@example.com and subject 你好", event)
+	}
+	if !reflect.DeepEqual(event["to"], []interface{}{"victim1@example.com", "victim2@example.com"}) {
+		t.Errorf("to=%v", event["to"])
+	}
+	message, err := os.ReadFile(event["file"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Ext(event["file"].(string)) != ".eml" || !strings.Contains(path.Base(event["file"].(string)), "-736f6d6573657373-") {
+		t.Errorf("file=%v, want .eml named after the connection", event["file"])
+	}
+	if entries[1]["channel_id"] != "736f6d6573657373-0" {
+		t.Errorf("channel_id=%v, want 736f6d6573657373-0", entries[1]["channel_id"])
+	}
+	if !strings.HasPrefix(string(message), "Return-Path: <spammer@example.com>\r\nReceived: from localhost") {
+		t.Errorf("message=%q, want trace headers", message)
+	}
+	if !strings.HasSuffix(string(message), body) {
+		t.Errorf("message=%q, want suffix %q", message, body)
+	}
+}
+
+func TestSMTPSizeLimit(t *testing.T) {
+	cfg := &config{}
+	cfg.setDefaults()
+	cfg.Services.SMTP.MaxMessageSize = 10
+	setupLogBuffer(t, cfg)
+
+	conn, _ := serveTestService(t, cfg, smtpServer{})
+	client, err := smtp.NewClient(conn, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		t.Errorf("STARTTLS advertised without a certificate")
+	}
+	if err := client.Mail("a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rcpt("b@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	writer, err := client.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write([]byte("Subject: too long\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err == nil || !strings.HasPrefix(err.Error(), "552") {
+		t.Errorf("err=%v, want 552", err)
+	}
+}
+
+func TestSMTPLineLimit(t *testing.T) {
+	cfg := &config{}
+	cfg.setDefaults()
+	setupLogBuffer(t, cfg)
+
+	conn, _ := serveTestService(t, cfg, smtpServer{})
+	text := textproto.NewConn(conn)
+	if _, _, err := text.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	longLine := strings.Repeat("a", 2*smtpMaxLineLength)
+	for _, testCase := range []struct {
+		command      string
+		expectedCode int
+	}{
+		{"NOOP " + longLine, 500},
+		{"NOOP", 250},
+		{"HELO localhost", 250},
+		{"MAIL FROM:<a@example.com>", 250},
+		{"RCPT TO:<b@example.com>", 250},
+		{"DATA", 354},
+		{"Subject: long line\r\n\r\n" + longLine + "\r\n.", 552},
+	} {
+		if err := text.PrintfLine("%s", testCase.command); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := text.ReadResponse(testCase.expectedCode); err != nil {
+			t.Errorf("%.20q: %v", testCase.command, err)
+		}
+	}
+}
+
+func TestHTTPRoutes(t *testing.T) {
+	cfg := &config{}
+	cfg.Logging.JSON = true
+	mux, err := newHTTPMux(append([]httpRouteConfig{{
+		Method:   "GET",
+		Path:     "/status/{name}",
+		Headers:  map[string]string{"Content-Type": "text/plain"},
+		Body:     "{{.Request.PathValue \"name\"}} on {{.Hostname}}",
+		Template: true,
+	}}, defaultHTTPRoutes...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.httpMux = mux
+	logBuffer := setupLogBuffer(t, cfg)
+
+	conn, _ := serveTestService(t, cfg, httpServer{})
+	reader := bufio.NewReader(conn)
+	for _, testCase := range []struct {
+		request        string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"GET /status/web HTTP/1.1\r\nHost: example.com\r\n\r\n", 200, fmt.Sprintf("web on %v", globalHostname)},
+		{"GET /missing HTTP/1.1\r\nHost: example.com\r\n\r\n", 404, ""},
+		{"GET /latest/meta-data/instance-type HTTP/1.1\r\nHost: 169.254.169.254\r\n\r\n", 200, "t2.micro"},
+		{"POST /admin/login HTTP/1.1\r\nHost: example.com\r\nCookie: session=abc\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 30\r\n\r\nusername=admin&password=secret", 200, ""},
+	} {
+		if _, err := conn.Write([]byte(testCase.request)); err != nil {
+			t.Fatal(err)
+		}
+		response, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != testCase.expectedStatus {
+			t.Errorf("StatusCode=%v, want %v", response.StatusCode, testCase.expectedStatus)
+		}
+		if testCase.expectedBody != "" && string(body) != testCase.expectedBody {
+			t.Errorf("body=%q, want %q", body, testCase.expectedBody)
+		}
+	}
+
+	var events []map[string]interface{}
+	for _, entry := range parseJSONLogs(t, logBuffer.String()) {
+		if entry["event_type"] == "http_request" {
+			events = append(events, entry["event"].(map[string]interface{}))
+		}
+	}
+	if len(events) != 4 {
+		t.Fatalf("len(events)=%v, want 4", len(events))
+	}
+	event := events[3]
+	if event["username"] != "admin" || event["password"] != "secret" {
+		t.Errorf("credentials=%v/%v, want admin/secret", event["username"], event["password"])
+	}
+	if !reflect.DeepEqual(event["cookies"], map[string]interface{}{"session": "abc"}) {
+		t.Errorf("cookies=%v, want session=abc", event["cookies"])
+	}
+	if event["body"] != "username=admin&password=secret" || event["encoding"] != "utf8" {
+		t.Errorf("body=%v, encoding=%v", event["body"], event["encoding"])
+	}
+}
+
+func TestHTTPLargeBody(t *testing.T) {
+	cfg := &config{}
+	setupLogBuffer(t, cfg)
+	conn, _ := serveTestService(t, cfg, httpServer{})
+	reader := bufio.NewReader(conn)
+	body := strings.Repeat("a", httpMaxBodySize+10)
+	go func() {
+		fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: %v\r\n\r\n%v", len(body), body)
+		fmt.Fprint(conn, "GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	}()
+	for _, expectedURI := range []string{"/upload", "/next"} {
+		response, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("reading the response to %v: %v", expectedURI, err)
+		}
+		io.Copy(io.Discard, response.Body)
+		if response.StatusCode != http.StatusNotFound || response.Close {
+			t.Errorf("%v: StatusCode=%v, Close=%v, want 404 on a kept connection", expectedURI, response.StatusCode, response.Close)
+		}
+	}
+}
+
+func TestHTTPInvalidRoutes(t *testing.T) {
+	for _, routes := range [][]httpRouteConfig{
+		{{App: "nonexistent"}},
+		{{Path: "/a"}, {Path: "/a"}},
+		{{Body: "{{", Template: true}},
+	} {
+		if _, err := newHTTPMux(routes); err == nil {
+			t.Errorf("newHTTPMux(%v) succeeded, want error", routes)
+		}
+	}
+}
+
+func TestIMDS(t *testing.T) {
+	cfg := &config{}
+	cfg.setDefaults()
+	cfg.Logging.JSON = true
+	logBuffer := setupLogBuffer(t, cfg)
+	persona := newIMDSPersona(cfg.Services.IMDS)
+
+	conn, _ := serveTestService(t, cfg, imdsServer{})
+	reader := bufio.NewReader(conn)
+	for _, testCase := range []struct {
+		request        string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"PUT /latest/api/token HTTP/1.1\r\nHost: 169.254.169.254\r\nX-aws-ec2-metadata-token-ttl-seconds: 21600\r\n\r\n", 200, ""},
+		{"GET /latest/meta-data/instance-id HTTP/1.1\r\nHost: 169.254.169.254\r\n\r\n", 200, persona.instanceID},
+		{"GET /latest/meta-data/iam/security-credentials/ HTTP/1.1\r\nHost: 169.254.169.254\r\n\r\n", 200, "ec2-admin-role"},
+		{"GET /latest/meta-data/iam/security-credentials/ec2-admin-role HTTP/1.1\r\nHost: 169.254.169.254\r\n\r\n", 200, ""},
+		{"GET /latest/user-data HTTP/1.1\r\nHost: 169.254.169.254\r\n\r\n", 404, ""},
+	} {
+		if _, err := conn.Write([]byte(testCase.request)); err != nil {
+			t.Fatal(err)
+		}
+		response, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != testCase.expectedStatus {
+			t.Errorf("StatusCode=%v, want %v", response.StatusCode, testCase.expectedStatus)
+		}
+		if testCase.expectedBody != "" && string(body) != testCase.expectedBody {
+			t.Errorf("body=%q, want %q", body, testCase.expectedBody)
+		}
+	}
+
+	var paths, tokenTypes []interface{}
+	for _, entry := range parseJSONLogs(t, logBuffer.String()) {
+		event := entry["event"].(map[string]interface{})
+		switch entry["event_type"] {
+		case "imds_request":
+			paths = append(paths, event["path"])
+		case "imds_token":
+			tokenTypes = append(tokenTypes, event["token_type"])
+			if event["token_type"] == "iam_credentials" && event["token"] != persona.accessKeyID {
+				t.Errorf("token=%v, want %v", event["token"], persona.accessKeyID)
+			}
+		}
+	}
+	expectedPaths := []interface{}{"/latest/api/token", "/latest/meta-data/instance-id", "/latest/meta-data/iam/security-credentials/", "/latest/meta-data/iam/security-credentials/ec2-admin-role", "/latest/user-data"}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("paths=%v, want %v", paths, expectedPaths)
+	}
+	if !reflect.DeepEqual(tokenTypes, []interface{}{"imdsv2_token", "iam_credentials"}) {
+		t.Errorf("tokenTypes=%v, want imdsv2_token and iam_credentials", tokenTypes)
+	}
+}
+
+func TestDirectTCPIPService(t *testing.T) {
+	cfg := &config{}
+	cfg.setDefaults()
+	cfg.Server.TCPIPServices = defaultTCPIPServices
+	if service := directTCPIPService(cfg, "169.254.169.254", 80); service != "HTTP" {
+		t.Errorf("service=%v, want HTTP with the metadata service disabled by default", service)
+	}
+	cfg.Services.IMDS.Enabled = true
+	for _, testCase := range []struct {
+		address         string
+		port            uint32
+		expectedService string
+	}{
+		{"169.254.169.254", 80, "IMDS"},
+		{"metadata.google.internal", 80, "IMDS"},
+		{"169.254.169.254", 25, "SMTP"},
+		{"169.254.169.254", 22, ""},
+		{"203.0.113.1", 80, "HTTP"},
+	} {
+		if service := directTCPIPService(cfg, testCase.address, testCase.port); service != testCase.expectedService {
+			t.Errorf("%v:%v: service=%v, want %v", testCase.address, testCase.port, service, testCase.expectedService)
+		}
+	}
+}
+
+func TestIMDSPersonaConsistent(t *testing.T) {
+	for _, provider := range []string{"aws", "gcp", "azure"} {
+		cfg := imdsServiceConfig{Provider: provider}
+		if !reflect.DeepEqual(newIMDSPersona(cfg), newIMDSPersona(cfg)) {
+			t.Errorf("persona for %v is not deterministic", provider)
+		}
+	}
+}
+
+func TestJoinQuotedArgs(t *testing.T) {
+	args := joinQuotedArgs(strings.Fields(`-H "Metadata-Flavor: Google" 'a b c' "x" http://metadata/`))
+	expected := []string{"-H", "Metadata-Flavor: Google", "a b c", "x", "http://metadata/"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("args=%q, want %q", args, expected)
+	}
+}
+
+func TestRedis(t *testing.T) {
+	cfg := &config{}
+	cfg.setDefaults()
+	cfg.Logging.JSON = true
+	logBuffer := setupLogBuffer(t, cfg)
+
+	conn, _ := serveTestService(t, cfg, redisServer{})
+	reader := bufio.NewReader(conn)
+	for _, test := range []struct {
+		request, response string
+	}{
+		{"*2\r\n$4\r\nAUTH\r\n$7\r\nhunter2\r\n", "+OK\r\n"},
+		{"*3\r\n$3\r\nSET\r\n$1\r\nx\r\n$5\r\n\r\n*/1\r\n", "+OK\r\n"},
+		{"GET x\r\n", "$5\r\n\r\n*/1\r\n"},
+		{"*4\r\n$6\r\nCONFIG\r\n$3\r\nSET\r\n$3\r\ndir\r\n$16\r\n/var/spool/cron/\r\n", "+OK\r\n"},
+		{"CONFIG GET dir\r\n", "*2\r\n$3\r\ndir\r\n$16\r\n/var/spool/cron/\r\n"},
+		{"*3\r\n$6\r\nMODULE\r\n$4\r\nLOAD\r\n$9\r\n/tmp/x.so\r\n", "-ERR Error loading the extension. Please check the server logs.\r\n"},
+		{"GET missing\r\n", "$-1\r\n"},
+		{"QUIT\r\n", "+OK\r\n"},
+	} {
+		if _, err := conn.Write([]byte(test.request)); err != nil {
+			t.Fatal(err)
+		}
+		response := make([]byte, len(test.response))
+		if _, err := io.ReadFull(reader, response); err != nil {
+			t.Fatal(err)
+		}
+		if string(response) != test.response {
+			t.Errorf("request=%q, response=%q, want %q", test.request, response, test.response)
+		}
+	}
+
+	entries := parseJSONLogs(t, logBuffer.String())
+	eventTypes := []interface{}{}
+	for _, entry := range entries {
+		eventTypes = append(eventTypes, entry["event_type"])
+	}
+	expectedEventTypes := []interface{}{"tcpip_auth", "redis_command", "redis_command", "redis_command"}
+	if !reflect.DeepEqual(eventTypes, expectedEventTypes) {
+		t.Fatalf("eventTypes=%v, want %v", eventTypes, expectedEventTypes)
+	}
+	expectedAuth := map[string]interface{}{"channel_id": 0.0, "service": "redis", "username": "default", "password": "hunter2", "accepted": true}
+	if !reflect.DeepEqual(entries[0]["event"], expectedAuth) {
+		t.Errorf("event=%v, want %v", entries[0]["event"], expectedAuth)
+	}
+	expectedCommand := map[string]interface{}{"channel_id": 0.0, "command": "CONFIG", "args": []interface{}{"SET", "dir", "/var/spool/cron/"}}
+	if !reflect.DeepEqual(entries[1]["event"], expectedCommand) {
+		t.Errorf("event=%v, want %v", entries[1]["event"], expectedCommand)
+	}
+}
+
+func TestRedisCommandLimits(t *testing.T) {
+	for _, request := range []string{
+		fmt.Sprintf("*1\r\n$%v\r\n", redisMaxBulkLength+1),
+		strings.Repeat(fmt.Sprintf("$%v\r\n%v\r\n", redisMaxBulkLength, strings.Repeat("x", redisMaxBulkLength)), 4) + "$1\r\n",
+		"*1\r\n$536870911\r\nshort",
+		strings.Repeat("x", redisMaxLineLength+1) + "\r\n",
+	} {
+		if strings.HasPrefix(request, "$") {
+			request = "*5\r\n" + request
+		}
+		if _, err := (redisServer{}).readCommand(bufio.NewReader(strings.NewReader(request))); err == nil {
+			t.Errorf("readCommand(%.40q) succeeded, want error", request)
+		}
+	}
+	args, err := redisServer{}.readCommand(bufio.NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$1\r\nx\r\n")))
+	if err != nil || !reflect.DeepEqual(args, []string{"GET", "x"}) {
+		t.Errorf("args=%q, err=%v, want GET x", args, err)
+	}
+}
+
+func TestRedisDataLimits(t *testing.T) {
+	session := &redisSession{data: map[string]string{}, config: map[string]string{}}
+	value := strings.Repeat("x", redisMaxBulkLength)
+	for i := 0; i < redisMaxDataSize/redisMaxBulkLength-1; i++ {
+		if reply, _ := session.handle([]string{"SET", fmt.Sprint(i), value}); reply != redisSimpleString("OK") {
+			t.Fatalf("SET %v=%v, want OK", i, reply)
+		}
+	}
+	if reply, _ := session.handle([]string{"SET", "last", value}); reply != redisOOMError {
+		t.Errorf("SET past the data limit=%v, want OOM", reply)
+	}
+	if reply, _ := session.handle([]string{"FLUSHALL"}); reply != redisSimpleString("OK") || session.size != 0 {
+		t.Errorf("FLUSHALL=%v, size=%v, want the data freed", reply, session.size)
+	}
+	for i := 0; i < redisMaxKeys; i++ {
+		session.handle([]string{"SET", fmt.Sprint(i), ""})
+	}
+	if reply, _ := session.handle([]string{"CONFIG", "SET", "dir", "/tmp"}); reply != redisOOMError {
+		t.Errorf("CONFIG SET past the key limit=%v, want OOM", reply)
+	}
+	if reply, _ := session.handle([]string{"SET", "0", "replaced"}); reply != redisSimpleString("OK") {
+		t.Errorf("SET of an existing key=%v, want OK", reply)
+	}
+}
+
+func TestMySQL(t *testing.T) {
+	cfg := &config{}
+	cfg.setDefaults()
+	cfg.Logging.JSON = true
+	logBuffer := setupLogBuffer(t, cfg)
+
+	conn, _ := serveTestService(t, cfg, mysqlServer{})
+	sequence, handshake, err := mysqlServer{}.readPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequence != 0 || handshake[0] != 10 || !strings.HasPrefix(string(handshake[1:]), mysqlServerVersion+"\x00") {
+		t.Fatalf("handshake=%q", handshake)
+	}
+	response := []byte{0x08, 0x82, 0x08, 0x00}
+	response = append(response, make([]byte, 28)...)
+	response = append(response, "root\x00"...)
+	response = append(response, 4, 0xde, 0xad, 0xbe, 0xef)
+	response = append(response, "mysql\x00mysql_native_password\x00"...)
+	if err := (mysqlServer{}).writePacket(conn, 1, response); err != nil {
+		t.Fatal(err)
+	}
+	sequence, reply, err := mysqlServer{}.readPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedReply := "\xff\x15\x04#28000Access denied for user 'root'@'localhost' (using password: YES)"
+	if sequence != 2 || string(reply) != expectedReply {
+		t.Errorf("sequence=%v, reply=%q, want 2 and %q", sequence, reply, expectedReply)
+	}
+
+	entries := parseJSONLogs(t, logBuffer.String())
+	if len(entries) != 1 {
+		t.Fatalf("len(entries)=%v, want 1", len(entries))
+	}
+	event := entries[0]["event"].(map[string]interface{})
+	if event["username"] != "root" || event["database"] != "mysql" || event["auth_plugin"] != "mysql_native_password" || event["auth_response"] != "deadbeef" {
+		t.Errorf("event=%v", event)
+	}
+}
+
+func TestTelnet(t *testing.T) {
+	cfg := &config{}
+	cfg.setDefaults()
+	cfg.Logging.JSON = true
+	logBuffer := setupLogBuffer(t, cfg)
+
+	conn, _ := serveTestService(t, cfg, telnetServer{})
+	reader := bufio.NewReader(conn)
+	readUntil := func(suffix string) string {
+		t.Helper()
+		output := ""
+		for !strings.HasSuffix(output, suffix) {
+			b, err := reader.ReadByte()
+			if err != nil {
+				t.Fatalf("output=%q: %v", output, err)
+			}
+			output += string(b)
+		}
+		return output
+	}
+	readUntil("login: ")
+	if _, err := conn.Write([]byte("\xff\xfd\x01\xff\xfa\x18\x00xterm\xff\xf0admin\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if echo := readUntil("Password: "); echo != "admin\r\nPassword: " {
+		t.Errorf("echo=%q, want username echoed", echo)
+	}
+	if _, err := conn.Write([]byte("admin\r\x00")); err != nil {
+		t.Fatal(err)
+	}
+	readUntil("Login incorrect\r\n")
+
+	entries := parseJSONLogs(t, logBuffer.String())
+	if len(entries) != 1 {
+		t.Fatalf("len(entries)=%v, want 1", len(entries))
+	}
+	expectedAuth := map[string]interface{}{"channel_id": 0.0, "service": "telnet", "username": "admin", "password": "admin", "accepted": false}
+	if !reflect.DeepEqual(entries[0]["event"], expectedAuth) {
+		t.Errorf("event=%v, want %v", entries[0]["event"], expectedAuth)
+	}
+}
+
+func TestFTPUpload(t *testing.T) {
+	cfg := &config{}
+	cfg.setDefaults()
+	cfg.Logging.JSON = true
+	cfg.artifacts = &artifactStore{t.TempDir()}
+	logBuffer := setupLogBuffer(t, cfg)
+
+	conn, _ := serveTestService(t, cfg, ftpServer{})
+	reader := bufio.NewReader(conn)
+	command := func(line string, expectedCode string) string {
+		t.Helper()
+		if line != "" {
+			if _, err := fmt.Fprintf(conn, "%v\r\n", line); err != nil {
+				t.Fatal(err)
+			}
+		}
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(reply, expectedCode+" ") {
+			t.Fatalf("command=%q, reply=%q, want %v", line, reply, expectedCode)
+		}
+		return reply
+	}
+	command("", "220")
+	command("STOR x", "530")
+	command("USER anonymous", "331")
+	command("STOR x", "530")
+	command("USER "+strings.Repeat("a", 2*ftpMaxLineLength), "500")
+	command("PASS guest@example.com", "230")
+	command("CWD /tmp", "250")
+	reply := command("EPSV", "229")
+	var port uint32
+	if _, err := fmt.Sscanf(reply, "229 Entering Extended Passive Mode (|||%d|)", &port); err != nil {
+		t.Fatal(err)
+	}
+	context := channelContext{connContext{ConnMetadata: mockConnContext{}, cfg: cfg}, 1}
+	listener := getFTPPassiveListener(context, port)
+	if listener == nil {
+		t.Fatalf("no passive listener on port %v", port)
+	}
+	dataClient, dataServer := net.Pipe()
+	go func() {
+		defer dataServer.Close()
+		ftpDataServer{listener}.serve(context, dataServer, nil)
+	}()
+	go func() {
+		dataClient.Write([]byte("#!/bin/sh\nexit 0\n"))
+		dataClient.Close()
+	}()
+	command("STOR payload.sh", "150")
+	command("", "226")
+	if getFTPPassiveListener(context, port) != nil {
+		t.Errorf("passive listener still registered after transfer")
+	}
+	command("QUIT", "221")
+
+	entries := parseJSONLogs(t, logBuffer.String())
+	if len(entries) != 2 {
+		t.Fatalf("len(entries)=%v, want 2", len(entries))
+	}
+	expectedAuth := map[string]interface{}{"channel_id": 0.0, "service": "ftp", "username": "anonymous", "password": "guest@example.com", "accepted": true}
+	if !reflect.DeepEqual(entries[0]["event"], expectedAuth) {
+		t.Errorf("event=%v, want %v", entries[0]["event"], expectedAuth)
+	}
+	event := entries[1]["event"].(map[string]interface{})
+	if event["filename"] != "/tmp/payload.sh" || event["size"] != 17.0 {
+		t.Errorf("event=%v", event)
+	}
+	data, err := os.ReadFile(event["file"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "#!/bin/sh\nexit 0\n" {
+		t.Errorf("data=%q", data)
+	}
+}
+
+func TestScriptedService(t *testing.T) {
+	server, err := newScriptedServer(scriptedServiceConfig{
+		Banner: "220 ready\r\n",
+		Rules: []scriptedRuleConfig{
+			{Match: `^GET (?P<key>\S+)$`, Response: "VALUE ${key}\r\n"},
+			{Match: `^QUIT`, Response: "BYE\r\n", Close: true},
+		},
+		Default: "ERROR\r\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config{}
+	cfg.setDefaults()
+	conn, inputs := serveTestService(t, cfg, server)
+	go conn.Write([]byte("GET foo\r\nbar\nGET " + strings.Repeat("x", scriptedMaxRequestSize) + "\r\nQUIT\r\n"))
+	output, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expectedOutput := "220 ready\r\nVALUE foo\r\nERROR\r\nERROR\r\nBYE\r\n"; string(output) != expectedOutput {
+		t.Errorf("output=%q, want %q", output, expectedOutput)
+	}
+	received := []string{}
+	for input := range inputs {
+		received = append(received, input)
+	}
+	if expectedInputs := []string{"GET foo", "bar", "QUIT"}; !reflect.DeepEqual(received, expectedInputs) {
+		t.Errorf("inputs=%q, want %q", received, expectedInputs)
+	}
+}
+
+func TestScriptedServiceBytes(t *testing.T) {
+	server, err := newScriptedServer(scriptedServiceConfig{
+		Mode:  "bytes",
+		Rules: []scriptedRuleConfig{{Match: `^\x16\x03`, Response: "\x15\x03\x01\x00\x02\x02\x28", Close: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config{}
+	cfg.setDefaults()
+	conn, _ := serveTestService(t, cfg, server)
+	go conn.Write([]byte("\x16\x03\x01\x00\x05hello"))
+	output, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "\x15\x03\x01\x00\x02\x02\x28" {
+		t.Errorf("output=%q", output)
+	}
+}
+
+func TestInvalidScriptedServices(t *testing.T) {
+	for _, serviceConfigs := range []map[string]scriptedServiceConfig{
+		{"SMTP": {}},
+		{"X": {Mode: "nonexistent"}},
+		{"X": {Rules: []scriptedRuleConfig{{Match: "("}}}},
+	} {
+		if _, err := newScriptedServers(serviceConfigs); err == nil {
+			t.Errorf("newScriptedServers(%v) succeeded, want error", serviceConfigs)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	telnetIAC  = 255
+	telnetDont = 254
+	telnetDo   = 253
+	telnetWont = 252
+	telnetWill = 251
+	telnetSB   = 250
+	telnetSE   = 240
+
+	telnetOptionEcho = 1
+	telnetOptionSGA  = 3
+
+	telnetMaxLoginAttempts = 3
+	telnetMaxLineLength    = 1024
+)
+
+type telnetServer struct{}
+
+// readLine reads a line from the client, dropping option negotiation and echoing the input back if requested.
+func (telnetServer) readLine(reader *bufio.Reader, writer io.Writer, echo bool) (string, error) {
+	line := []byte{}
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case telnetIAC:
+			command, err := reader.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			switch command {
+			case telnetIAC:
+				line = append(line, telnetIAC)
+			case telnetWill, telnetWont, telnetDo, telnetDont:
+				if _, err := reader.ReadByte(); err != nil {
+					return "", err
+				}
+			case telnetSB:
+				for {
+					b, err := reader.ReadByte()
+					if err != nil {
+						return "", err
+					}
+					if b != telnetIAC {
+						continue
+					}
+					if b, err = reader.ReadByte(); err != nil {
+						return "", err
+					}
+					if b == telnetSE {
+						break
+					}
+				}
+			}
+		case '\r', '\n':
+			// Clients terminate lines with CR LF or CR NUL
+			if b == '\r' {
+				if next, err := reader.Peek(1); err == nil && (next[0] == '\n' || next[0] == 0) {
+					reader.ReadByte()
+				}
+			}
+			if echo {
+				if _, err := io.WriteString(writer, "\r\n"); err != nil {
+					return "", err
+				}
+			}
+			return string(line), nil
+		case '\b', 0x7f:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				if echo {
+					if _, err := io.WriteString(writer, "\b \b"); err != nil {
+						return "", err
+					}
+				}
+			}
+		default:
+			if len(line) >= telnetMaxLineLength {
+				continue
+			}
+			line = append(line, b)
+			if echo {
+				if _, err := writer.Write([]byte{b}); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+}
+
+func (server telnetServer) serve(context channelContext, readWriter io.ReadWriter, input chan<- string) {
+	// The server echoes input itself, so the password prompt can hide it
+	negotiation := []byte{telnetIAC, telnetWill, telnetOptionEcho, telnetIAC, telnetWill, telnetOptionSGA}
+	if _, err := fmt.Fprintf(readWriter, "%s\r\nUbuntu 22.04.4 LTS\r\n", negotiation); err != nil {
+		warningLogger.Printf("Error writing greeting: %v", err)
+		return
+	}
+	reader := bufio.NewReader(readWriter)
+	for attempt := 0; attempt < telnetMaxLoginAttempts; attempt++ {
+		if _, err := fmt.Fprintf(readWriter, "%v login: ", globalHostname); err != nil {
+			warningLogger.Printf("Error writing prompt: %v", err)
+			return
+		}
+		username, err := server.readLine(reader, readWriter, true)
+		if err != nil {
+			if err != io.EOF {
+				warningLogger.Printf("Error reading username: %v", err)
+			}
+			return
+		}
+		if username == "" {
+			attempt--
+			continue
+		}
+		if _, err := io.WriteString(readWriter, "Password: "); err != nil {
+			warningLogger.Printf("Error writing prompt: %v", err)
+			return
+		}
+		password, err := server.readLine(reader, readWriter, false)
+		if err != nil {
+			if err != io.EOF {
+				warningLogger.Printf("Error reading password: %v", err)
+			}
+			return
+		}
+		input <- username
+		context.logEvent(tcpipAuthLog{
+			channelLog: channelLog{ChannelID: context.channelID},
+			Service:    "telnet",
+			Username:   username,
+			Password:   password,
+		})
+		time.Sleep(time.Second)
+		if _, err := io.WriteString(readWriter, "\r\nLogin incorrect\r\n"); err != nil {
+			warningLogger.Printf("Error writing reply: %v", err)
+			return
+		}
+	}
+}
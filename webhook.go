@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWebhookBatchSize     = 100
+	defaultWebhookFlushInterval = 5 * time.Second
+	defaultWebhookMaxRetries    = 3
+	defaultWebhookRetryBackoff  = time.Second
+	defaultWebhookIndex         = "sshesame"
+	defaultWebhookMaxSpoolSize  = 100 << 20
+	webhookTimeout              = 10 * time.Second
+	webhookSignatureHeader      = "X-Sshesame-Signature"
+)
+
+var webhookContentTypes = map[string]string{
+	"json":   "application/json",
+	"ndjson": "application/x-ndjson",
+	"bulk":   "application/x-ndjson",
+}
+
+// webhookPermanentError is a rejection that retrying won't fix.
+type webhookPermanentError struct {
+	status int
+}
+
+func (err webhookPermanentError) Error() string {
+	return fmt.Sprintf("rejected with status %v", err.status)
+}
+
+// webhookLogSink POSTs batches of events, spooling them to disk while the endpoint is unreachable.
+type webhookLogSink struct {
+	url           string
+	mode          string
+	index         string
+	headers       map[string]string
+	hmacSecret    []byte
+	batchSize     int
+	flushInterval time.Duration
+	maxRetries    int
+	retryBackoff  time.Duration
+	spoolDir      string
+	maxSpoolSize  int64
+	client        *http.Client
+
+	batchMutex sync.Mutex
+	batch      [][]byte
+	// deliveryMutex keeps batches in order, whether they're sent or spooled
+	deliveryMutex sync.Mutex
+	spooled       int
+	spoolSize     int64
+	spoolSequence int
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+func newWebhookLogSink(sinkConfig logSinkConfig) (logSink, error) {
+	if sinkConfig.URL == "" {
+		return nil, fmt.Errorf("url not set")
+	}
+	sink := &webhookLogSink{
+		url:           sinkConfig.URL,
+		mode:          sinkConfig.Mode,
+		index:         sinkConfig.Index,
+		headers:       sinkConfig.Headers,
+		hmacSecret:    []byte(sinkConfig.HMACSecret),
+		batchSize:     sinkConfig.BatchSize,
+		flushInterval: sinkConfig.FlushInterval,
+		maxRetries:    sinkConfig.MaxRetries,
+		retryBackoff:  sinkConfig.RetryBackoff,
+		spoolDir:      sinkConfig.SpoolDir,
+		maxSpoolSize:  sinkConfig.MaxSpoolSize,
+		client:        &http.Client{Timeout: webhookTimeout},
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if sink.mode == "" {
+		sink.mode = "ndjson"
+	}
+	if _, ok := webhookContentTypes[sink.mode]; !ok {
+		return nil, fmt.Errorf("unknown mode %q", sink.mode)
+	}
+	if sink.index == "" {
+		sink.index = defaultWebhookIndex
+	}
+	if sink.batchSize <= 0 {
+		sink.batchSize = defaultWebhookBatchSize
+	}
+	if sink.flushInterval <= 0 {
+		sink.flushInterval = defaultWebhookFlushInterval
+	}
+	if sink.maxRetries < 0 {
+		sink.maxRetries = 0
+	} else if sink.maxRetries == 0 {
+		sink.maxRetries = defaultWebhookMaxRetries
+	}
+	if sink.retryBackoff <= 0 {
+		sink.retryBackoff = defaultWebhookRetryBackoff
+	}
+	if sink.maxSpoolSize <= 0 {
+		sink.maxSpoolSize = defaultWebhookMaxSpoolSize
+	}
+	if sink.spoolDir != "" {
+		if err := os.MkdirAll(sink.spoolDir, 0700); err != nil {
+			return nil, err
+		}
+		// Batches spooled before a restart are sent once the endpoint is back
+		spooledBatches, err := sink.spooledBatches()
+		if err != nil {
+			return nil, err
+		}
+		for _, batch := range spooledBatches {
+			info, err := os.Stat(batch)
+			if err != nil {
+				return nil, err
+			}
+			sink.spoolSize += info.Size()
+		}
+		sink.spooled = len(spooledBatches)
+	}
+	go sink.run()
+	return sink, nil
+}
+
+func (sink *webhookLogSink) run() {
+	defer close(sink.done)
+	ticker := time.NewTicker(sink.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sink.flush()
+			sink.drainSpool()
+		case <-sink.stop:
+			return
+		}
+	}
+}
+
+func (sink *webhookLogSink) write(record logRecord, data []byte) error {
+	if !json.Valid(data) {
+		// Batches are always JSON documents, so plain lines are sent as strings
+		var err error
+		if data, err = json.Marshal(string(data)); err != nil {
+			return err
+		}
+	}
+	sink.batchMutex.Lock()
+	sink.batch = append(sink.batch, data)
+	full := len(sink.batch) >= sink.batchSize
+	sink.batchMutex.Unlock()
+	if full {
+		sink.flush()
+	}
+	return nil
+}
+
+func (sink *webhookLogSink) body(batch [][]byte) []byte {
+	body := &bytes.Buffer{}
+	switch sink.mode {
+	case "json":
+		body.WriteByte('[')
+		body.Write(bytes.Join(batch, []byte(",")))
+		body.WriteByte(']')
+	case "ndjson":
+		for _, document := range batch {
+			body.Write(document)
+			body.WriteByte('\n')
+		}
+	case "bulk":
+		action, _ := json.Marshal(map[string]map[string]string{"index": {"_index": sink.index}})
+		for _, document := range batch {
+			body.Write(action)
+			body.WriteByte('\n')
+			body.Write(document)
+			body.WriteByte('\n')
+		}
+	}
+	return body.Bytes()
+}
+
+func (sink *webhookLogSink) flush() {
+	sink.batchMutex.Lock()
+	batch := sink.batch
+	sink.batch = nil
+	sink.batchMutex.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	body := sink.body(batch)
+	sink.deliveryMutex.Lock()
+	defer sink.deliveryMutex.Unlock()
+	if sink.spooled > 0 {
+		sink.spool(body)
+		return
+	}
+	if err := sink.sendWithRetries(body); err != nil {
+		warningLogger.Printf("Failed to send %v events to webhook: %v", len(batch), err)
+		if _, ok := err.(webhookPermanentError); !ok {
+			sink.spool(body)
+		}
+	}
+}
+
+func (sink *webhookLogSink) send(body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, sink.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", webhookContentTypes[sink.mode])
+	for name, value := range sink.headers {
+		request.Header.Set(name, value)
+	}
+	if len(sink.hmacSecret) != 0 {
+		mac := hmac.New(sha256.New, sink.hmacSecret)
+		mac.Write(body)
+		request.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	response, err := sink.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	responseBody, err := io.ReadAll(io.LimitReader(response.Body, httpMaxBodySize))
+	if err != nil {
+		return err
+	}
+	switch {
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return fmt.Errorf("failed with status %v", response.StatusCode)
+	case response.StatusCode >= 300:
+		return webhookPermanentError{response.StatusCode}
+	}
+	if sink.mode == "bulk" {
+		// Bulk requests succeed as a whole even if some of the documents are rejected
+		bulkResponse := struct {
+			Errors bool `json:"errors"`
+		}{}
+		if err := json.Unmarshal(responseBody, &bulkResponse); err == nil && bulkResponse.Errors {
+			warningLogger.Printf("Some events were rejected by the bulk endpoint: %s", responseBody)
+		}
+	}
+	return nil
+}
+
+func (sink *webhookLogSink) sendWithRetries(body []byte) error {
+	backoff := sink.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := sink.send(body)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(webhookPermanentError); ok || attempt >= sink.maxRetries {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-sink.stop:
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// spool saves a batch to be sent later, dropping the oldest spooled batches if the spool would grow past its maximum size.
+func (sink *webhookLogSink) spool(body []byte) {
+	if sink.spoolDir == "" {
+		return
+	}
+	if int64(len(body)) > sink.maxSpoolSize {
+		warningLogger.Printf("Dropping %v bytes of events larger than the webhook spool", len(body))
+		return
+	}
+	if sink.spoolSize+int64(len(body)) > sink.maxSpoolSize {
+		batches, err := sink.spooledBatches()
+		if err != nil {
+			warningLogger.Printf("Failed to list spooled events: %v", err)
+			return
+		}
+		dropped := 0
+		for _, batch := range batches {
+			if sink.spoolSize+int64(len(body)) <= sink.maxSpoolSize {
+				break
+			}
+			if err := sink.removeSpooled(batch); err != nil {
+				warningLogger.Printf("Failed to remove spooled events: %v", err)
+				return
+			}
+			dropped++
+		}
+		warningLogger.Printf("Webhook spool full, dropped the %v oldest spooled batches", dropped)
+	}
+	sink.spoolSequence++
+	file := path.Join(sink.spoolDir, fmt.Sprintf("%020d-%06d.batch", time.Now().UnixNano(), sink.spoolSequence%1000000))
+	if err := os.WriteFile(file, body, 0600); err != nil {
+		warningLogger.Printf("Failed to spool events: %v", err)
+		return
+	}
+	sink.spooled++
+	sink.spoolSize += int64(len(body))
+}
+
+func (sink *webhookLogSink) removeSpooled(batch string) error {
+	info, err := os.Stat(batch)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(batch); err != nil {
+		return err
+	}
+	sink.spooled--
+	sink.spoolSize -= info.Size()
+	return nil
+}
+
+func (sink *webhookLogSink) spooledBatches() ([]string, error) {
+	entries, err := os.ReadDir(sink.spoolDir)
+	if err != nil {
+		return nil, err
+	}
+	batches := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && path.Ext(entry.Name()) == ".batch" {
+			batches = append(batches, path.Join(sink.spoolDir, entry.Name()))
+		}
+	}
+	sort.Strings(batches)
+	return batches, nil
+}
+
+// drainSpool sends the spooled batches in order, stopping at the first failure.
+func (sink *webhookLogSink) drainSpool() {
+	sink.deliveryMutex.Lock()
+	defer sink.deliveryMutex.Unlock()
+	if sink.spooled == 0 {
+		return
+	}
+	batches, err := sink.spooledBatches()
+	if err != nil {
+		warningLogger.Printf("Failed to list spooled events: %v", err)
+		return
+	}
+	for _, batch := range batches {
+		body, err := os.ReadFile(batch)
+		if err != nil {
+			warningLogger.Printf("Failed to read spooled events: %v", err)
+			return
+		}
+		if err := sink.send(body); err != nil {
+			if _, ok := err.(webhookPermanentError); !ok {
+				return
+			}
+			warningLogger.Printf("Dropping spooled events: %v", err)
+		}
+		if err := sink.removeSpooled(batch); err != nil {
+			warningLogger.Printf("Failed to remove spooled events: %v", err)
+			return
+		}
+	}
+}
+
+func (sink *webhookLogSink) close() error {
+	close(sink.stop)
+	<-sink.done
+	sink.drainSpool()
+	sink.flush()
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookTestServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []*http.Request
+	bodies   []string
+	statuses []int
+	down     bool
+}
+
+// newWebhookTestServer responds with the given statuses in order, then with 200 unless it's down.
+func newWebhookTestServer(t *testing.T, statuses ...int) *webhookTestServer {
+	server := &webhookTestServer{statuses: statuses}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		if server.down {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if len(server.statuses) > 0 {
+			status := server.statuses[0]
+			server.statuses = server.statuses[1:]
+			writer.WriteHeader(status)
+			return
+		}
+		server.requests = append(server.requests, request)
+		server.bodies = append(server.bodies, string(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (server *webhookTestServer) receivedBodies() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]string{}, server.bodies...)
+}
+
+func logToWebhook(t *testing.T, sinkConfig logSinkConfig, contents ...string) {
+	t.Helper()
+	cfg := &config{}
+	cfg.Logging.Sinks = []logSinkConfig{sinkConfig}
+	setupLogBuffer(t, cfg)
+	for _, content := range contents {
+		connContext{ConnMetadata: mockConnContext{}, cfg: cfg}.logEvent(mockLogEntry{content})
+	}
+	cfg.logSinks.close()
+}
+
+func TestWebhookNDJSONBatches(t *testing.T) {
+	server := newWebhookTestServer(t)
+	logToWebhook(t, logSinkConfig{Type: "webhook", URL: server.URL, Format: "json", BatchSize: 2, HMACSecret: "secret", Headers: map[string]string{"Authorization": "Bearer token"}}, "lorem", "ipsum", "dolor")
+
+	bodies := server.receivedBodies()
+	expectedBodies := []string{
+		"{\"source\":\"127.0.0.1:1234\",\"connection_id\":\"736f6d6573657373\",\"event_type\":\"test\",\"event\":{\"content\":\"lorem\"}}\n{\"source\":\"127.0.0.1:1234\",\"connection_id\":\"736f6d6573657373\",\"event_type\":\"test\",\"event\":{\"content\":\"ipsum\"}}\n",
+		"{\"source\":\"127.0.0.1:1234\",\"connection_id\":\"736f6d6573657373\",\"event_type\":\"test\",\"event\":{\"content\":\"dolor\"}}\n",
+	}
+	if !reflect.DeepEqual(bodies, expectedBodies) {
+		t.Fatalf("bodies=%q, want %q", bodies, expectedBodies)
+	}
+	for i, request := range server.requests {
+		if request.Header.Get("Content-Type") != "application/x-ndjson" || request.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("headers=%v", request.Header)
+		}
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(server.bodies[i]))
+		if signature := "sha256=" + hex.EncodeToString(mac.Sum(nil)); request.Header.Get("X-Sshesame-Signature") != signature {
+			t.Errorf("signature=%v, want %v", request.Header.Get("X-Sshesame-Signature"), signature)
+		}
+	}
+}
+
+func TestWebhookJSONArray(t *testing.T) {
+	server := newWebhookTestServer(t)
+	logToWebhook(t, logSinkConfig{Type: "webhook", URL: server.URL, Mode: "json", Format: "plain"}, "lorem", "ipsum")
+	expectedBodies := []string{`["[127.0.0.1:1234 736f6d6573657373] test lorem","[127.0.0.1:1234 736f6d6573657373] test ipsum"]`}
+	if bodies := server.receivedBodies(); len(bodies) != 1 || bodies[0] != expectedBodies[0] {
+		t.Errorf("bodies=%q, want %q", bodies, expectedBodies)
+	}
+}
+
+func TestWebhookBulk(t *testing.T) {
+	server := newWebhookTestServer(t)
+	logToWebhook(t, logSinkConfig{Type: "webhook", URL: server.URL, Mode: "bulk", Index: "honeypot", Format: "json"}, "lorem")
+	bodies := server.receivedBodies()
+	if len(bodies) != 1 {
+		t.Fatalf("bodies=%q, want 1", bodies)
+	}
+	lines := strings.Split(bodies[0], "\n")
+	if len(lines) != 3 || lines[0] != `{"index":{"_index":"honeypot"}}` || !strings.HasSuffix(lines[1], `"event":{"content":"lorem"}}`) || lines[2] != "" {
+		t.Errorf("body=%q, want an index action followed by the event", bodies[0])
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	server := newWebhookTestServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	logToWebhook(t, logSinkConfig{Type: "webhook", URL: server.URL, Format: "json", BatchSize: 1, RetryBackoff: time.Millisecond}, "lorem")
+	if bodies := server.receivedBodies(); len(bodies) != 1 {
+		t.Errorf("bodies=%q, want 1", bodies)
+	}
+}
+
+func TestWebhookPermanentError(t *testing.T) {
+	server := newWebhookTestServer(t, http.StatusBadRequest)
+	spoolDir := t.TempDir()
+	logToWebhook(t, logSinkConfig{Type: "webhook", URL: server.URL, Format: "json", BatchSize: 1, RetryBackoff: time.Millisecond, SpoolDir: spoolDir}, "lorem")
+	if bodies := server.receivedBodies(); len(bodies) != 0 {
+		t.Errorf("bodies=%q, want none", bodies)
+	}
+	if files, _ := os.ReadDir(spoolDir); len(files) != 0 {
+		t.Errorf("files=%v, want none spooled", files)
+	}
+}
+
+func TestWebhookSpool(t *testing.T) {
+	server := newWebhookTestServer(t)
+	server.down = true
+	spoolDir := t.TempDir()
+	sinkConfig := logSinkConfig{Type: "webhook", URL: server.URL, Format: "json", BatchSize: 1, MaxRetries: -1, SpoolDir: spoolDir}
+	logToWebhook(t, sinkConfig, "lorem", "ipsum")
+	if files, _ := os.ReadDir(spoolDir); len(files) != 2 {
+		t.Fatalf("files=%v, want 2 spooled batches", files)
+	}
+
+	// Once the endpoint is back, a new sink using the same spool sends the spooled batches before new ones
+	server.mutex.Lock()
+	server.down = false
+	server.mutex.Unlock()
+	sinkConfig.FlushInterval = 10 * time.Millisecond
+	sink, err := newWebhookLogSink(sinkConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(server.receivedBodies()) < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sink.write(logRecord{}, []byte(`"dolor"`))
+	if err := sink.close(); err != nil {
+		t.Fatal(err)
+	}
+	bodies := server.receivedBodies()
+	if len(bodies) != 3 || !strings.Contains(bodies[0], "lorem") || !strings.Contains(bodies[1], "ipsum") || bodies[2] != "\"dolor\"\n" {
+		t.Errorf("bodies=%q, want lorem, ipsum and dolor in order", bodies)
+	}
+	if files, _ := os.ReadDir(spoolDir); len(files) != 0 {
+		t.Errorf("files=%v, want spool drained", files)
+	}
+}
+
+func TestWebhookSpoolLimit(t *testing.T) {
+	server := newWebhookTestServer(t)
+	server.down = true
+	spoolDir := t.TempDir()
+	body := "{\"source\":\"127.0.0.1:1234\",\"connection_id\":\"736f6d6573657373\",\"event_type\":\"test\",\"event\":{\"content\":\"lorem\"}}\n"
+	logToWebhook(t, logSinkConfig{Type: "webhook", URL: server.URL, Format: "json", BatchSize: 1, MaxRetries: -1, SpoolDir: spoolDir, MaxSpoolSize: int64(2 * len(body))}, "lorem", "ipsum", "dolor")
+	files, _ := os.ReadDir(spoolDir)
+	if len(files) != 2 {
+		t.Fatalf("files=%v, want the 2 newest batches spooled", files)
+	}
+	for i, content := range []string{"ipsum", "dolor"} {
+		if spooled, _ := os.ReadFile(path.Join(spoolDir, files[i].Name())); !strings.Contains(string(spooled), content) {
+			t.Errorf("batch %v=%q, want %v", i, spooled, content)
+		}
+	}
+}